@@ -0,0 +1,100 @@
+// avrogen generates go structs from an avro schema file or a schema-registry subject.
+//
+// It's meant to be used with go:generate:
+//
+//	//go:generate go run github.com/sanservices/kit/cmd/avrogen -schema reservation.avsc -topic reservations -out reservation_avro.go
+//
+// Subjects are read from the schema-registry of the "kafka" section of ./config/<env>.json.
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hamba/avro"
+	"github.com/sanservices/kit/config"
+	"github.com/sanservices/kit/kafkalistener"
+	"github.com/sanservices/kit/kafkalistener/avrogen"
+	tlskit "github.com/sanservices/kit/tls"
+)
+
+func main() {
+	schemaFile := flag.String("schema", "", "avro schema file")
+	subject := flag.String("subject", "", "schema-registry subject, instead of -schema")
+	version := flag.Int("version", 0, "version of the subject, the latest when 0")
+	env := flag.String("env", string(config.Dev), "configuration environment used to read the schema-registry")
+	topic := flag.String("topic", "", "kafka topic, generates a kafkalistener.Topic with the schema when set")
+	pkg := flag.String("package", os.Getenv("GOPACKAGE"), "package name, $GOPACKAGE by default")
+	out := flag.String("out", "", "output file, stdout when empty")
+	flag.Parse()
+
+	err := run(*schemaFile, *subject, *version, config.Env(*env), avrogen.Config{Package: *pkg, Topic: *topic}, *out)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "avrogen:", err)
+		os.Exit(1)
+	}
+}
+
+func run(schemaFile, subject string, version int, env config.Env, cfg avrogen.Config, out string) error {
+	var rawSchema string
+	switch {
+	case schemaFile != "":
+		raw, err := os.ReadFile(schemaFile)
+		if err != nil {
+			return err
+		}
+		rawSchema = string(raw)
+
+	case subject != "":
+		raw, err := registrySchema(env, subject, version)
+		if err != nil {
+			return err
+		}
+		rawSchema = raw
+
+	default:
+		return errors.New("-schema or -subject is required")
+	}
+
+	src, err := avrogen.Generate(cfg, rawSchema)
+	if err != nil {
+		return err
+	}
+
+	if out == "" {
+		_, err = os.Stdout.Write(src)
+		return err
+	}
+
+	return os.WriteFile(out, src, 0644)
+}
+
+func registrySchema(env config.Env, subject string, version int) (string, error) {
+	kafkaConfig := kafkalistener.ReadConfig(env)
+
+	tlsConfig, err := tlskit.GetTLSConf(kafkaConfig.TLS)
+	if err != nil {
+		return "", err
+	}
+
+	client, err := kafkalistener.NewRegistryClient(tlsConfig, kafkaConfig.SchemaReg, kafkaConfig.Registry)
+	if err != nil {
+		return "", err
+	}
+
+	var schema avro.Schema
+	if version > 0 {
+		schema, err = client.GetSchemaByVersion(subject, version)
+	} else {
+		schema, err = client.GetLatestSchema(subject)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := json.Marshal(schema)
+	return string(raw), err
+}
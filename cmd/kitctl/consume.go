@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/sanservices/kit/config"
+	"github.com/sanservices/kit/kafkalistener"
+)
+
+// record is a consumed message written as a JSON line.
+type record struct {
+	Partition int32                  `json:"partition"`
+	Offset    int64                  `json:"offset"`
+	Timestamp time.Time              `json:"timestamp"`
+	UUID      string                 `json:"uuid"`
+	Metadata  map[string]string      `json:"metadata,omitempty"`
+	Value     map[string]interface{} `json:"value"`
+}
+
+func consume(env config.Env, args []string) error {
+	var where multiFlag
+
+	fs := flag.NewFlagSet("consume", flag.ExitOnError)
+	topicName := fs.String("topic", "", "topic to consume")
+	group := fs.String("group", "kitctl-"+watermill.NewShortUUID(), "consumer group, a new one by default so the topic is read from the beginning")
+	limit := fs.Int("limit", 0, "stop after writing this many messages, 0 means no limit")
+	fs.Var(&where, "where", "only write messages whose field equals the value, as field=value or nested.field=value; can be repeated")
+	fs.Parse(args)
+
+	if *topicName == "" {
+		return errors.New("-topic is required")
+	}
+
+	filters := make(map[string]string, len(where))
+	for _, w := range where {
+		field, value, ok := strings.Cut(w, "=")
+		if !ok {
+			return fmt.Errorf("invalid -where %q, expected field=value", w)
+		}
+		filters[field] = value
+	}
+
+	kafkaConfig := kafkalistener.ReadConfig(env)
+	kafkaConfig.ConsumeOnly = true
+	kafkaConfig.ConsumerGroupID = *group
+	kafkaConfig.TransactionalID = ""
+
+	mb, err := kafkalistener.NewWithLogger(context.Background(), kafkaConfig, logger())
+	if err != nil {
+		return err
+	}
+
+	var mu sync.Mutex
+	written := 0
+	encoder := json.NewEncoder(os.Stdout)
+
+	handler := func(msg *message.Message) error {
+		schema, err := mb.ResolveSchema(msg.Payload)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "message %s: %v\n", msg.UUID, err)
+			return nil
+		}
+
+		value, err := kafkalistener.DecodeMap(&kafkalistener.Topic{Schema: schema}, msg.Payload)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "message %s: %v\n", msg.UUID, err)
+			return nil
+		}
+
+		if !matches(value, filters) {
+			return nil
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+
+		if *limit > 0 && written >= *limit {
+			return nil
+		}
+
+		r := record{UUID: msg.UUID, Metadata: msg.Metadata, Value: jsonValue(value).(map[string]interface{})}
+		r.Partition, _ = kafka.MessagePartitionFromCtx(msg.Context())
+		r.Offset, _ = kafka.MessagePartitionOffsetFromCtx(msg.Context())
+		r.Timestamp, _ = kafka.MessageTimestampFromCtx(msg.Context())
+
+		err = encoder.Encode(r)
+		if err != nil {
+			return err
+		}
+
+		written++
+		if *limit > 0 && written == *limit {
+			go mb.Stop()
+		}
+
+		return nil
+	}
+
+	return mb.Listen(context.Background(), []kafkalistener.RouteHandler{
+		{
+			Name:        "kitctl",
+			Topic:       &kafkalistener.Topic{Name: *topicName},
+			HandlerFunc: handler,
+		},
+	})
+}
+
+// matches checks every field=value filter against the decoded message.
+func matches(value map[string]interface{}, filters map[string]string) bool {
+	for path, expected := range filters {
+		var current interface{} = value
+		for _, field := range strings.Split(path, ".") {
+			obj, ok := current.(map[string]interface{})
+			if !ok {
+				return false
+			}
+			current = obj[field]
+		}
+
+		if fmt.Sprint(jsonValue(current)) != expected {
+			return false
+		}
+	}
+
+	return true
+}
+
+// jsonValue converts the decoded values without a useful JSON form.
+func jsonValue(v interface{}) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k := range value {
+			value[k] = jsonValue(value[k])
+		}
+		return value
+	case []interface{}:
+		for i := range value {
+			value[i] = jsonValue(value[i])
+		}
+		return value
+	case *big.Rat:
+		str := strings.TrimRight(value.FloatString(20), "0")
+		return json.Number(strings.TrimSuffix(str, "."))
+	case []byte:
+		return string(value)
+	case time.Duration:
+		return value.String()
+	}
+
+	return v
+}
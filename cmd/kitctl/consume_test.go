@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestMatches(t *testing.T) {
+	value := map[string]interface{}{
+		"id":     int64(7),
+		"status": "confirmed",
+		"guest":  map[string]interface{}{"email": "ana@test.com", "document": []byte("passport")},
+		"amount": big.NewRat(1050, 100),
+	}
+
+	testcases := []struct {
+		Name     string
+		Filters  map[string]string
+		Expected bool
+	}{
+		{Name: "Without filters", Expected: true},
+		{Name: "Matching field", Filters: map[string]string{"status": "confirmed"}, Expected: true},
+		{Name: "Different field", Filters: map[string]string{"status": "canceled"}},
+		{Name: "Number", Filters: map[string]string{"id": "7"}, Expected: true},
+		{Name: "Decimal", Filters: map[string]string{"amount": "10.5"}, Expected: true},
+		{Name: "Nested field", Filters: map[string]string{"guest.email": "ana@test.com"}, Expected: true},
+		{Name: "Nested bytes", Filters: map[string]string{"guest.document": "passport"}, Expected: true},
+		{Name: "Every filter", Filters: map[string]string{"status": "confirmed", "guest.email": "other@test.com"}},
+		{Name: "Path through a value", Filters: map[string]string{"status.code": "confirmed"}},
+		{Name: "Missing field", Filters: map[string]string{"room": "12"}},
+	}
+
+	for _, tc := range testcases {
+		if got := matches(value, tc.Filters); got != tc.Expected {
+			t.Errorf("%s: matches = %v, expected %v", tc.Name, got, tc.Expected)
+		}
+	}
+}
+
+func TestJSONValue(t *testing.T) {
+	testcases := []struct {
+		Name     string
+		Value    interface{}
+		Expected interface{}
+	}{
+		{Name: "String", Value: "gold", Expected: "gold"},
+		{Name: "Long", Value: int64(7), Expected: int64(7)},
+		{Name: "Decimal", Value: big.NewRat(-1050, 100), Expected: json.Number("-10.5")},
+		{Name: "Integer decimal", Value: big.NewRat(3, 1), Expected: json.Number("3")},
+		{Name: "Bytes", Value: []byte("passport"), Expected: "passport"},
+		{Name: "Duration", Value: 90 * time.Second, Expected: "1m30s"},
+		{
+			Name:     "Nested values",
+			Value:    map[string]interface{}{"stops": []interface{}{[]byte("a"), big.NewRat(1, 2)}},
+			Expected: map[string]interface{}{"stops": []interface{}{"a", json.Number("0.5")}},
+		},
+	}
+
+	for _, tc := range testcases {
+		got := jsonValue(tc.Value)
+		if fmt.Sprintf("%#v", got) != fmt.Sprintf("%#v", tc.Expected) {
+			t.Errorf("%s: value = %#v, expected %#v", tc.Name, got, tc.Expected)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+// kitctl produces and consumes avro messages using the kafkalistener package.
+//
+// The kafka configuration is read with the config package from the
+// "kafka" section of ./config/<env>.json.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/sanservices/kit/config"
+)
+
+const usage = `Usage: kitctl [-env dev] <command> [flags]
+
+Commands:
+  produce   publishes the JSON lines from stdin as avro messages
+  consume   decodes the messages of a topic as JSON lines
+  subjects  lists the subjects of the schema-registry
+  versions  lists the versions of a subject
+  schema    shows a schema by subject and version or by id
+
+Run kitctl <command> -h to see the flags of a command.
+`
+
+func main() {
+	env := flag.String("env", string(config.Dev), "configuration environment")
+	flag.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	commands := map[string]func(config.Env, []string) error{
+		"produce":  produce,
+		"consume":  consume,
+		"subjects": subjects,
+		"versions": versions,
+		"schema":   schema,
+	}
+
+	command, ok := commands[flag.Arg(0)]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", flag.Arg(0))
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	err := command(config.Env(*env), flag.Args()[1:])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "kitctl:", err)
+		os.Exit(1)
+	}
+}
+
+// multiFlag collects the values of a repeated flag.
+type multiFlag []string
+
+func (f *multiFlag) String() string {
+	return strings.Join(*f, ",")
+}
+
+func (f *multiFlag) Set(value string) error {
+	*f = append(*f, value)
+	return nil
+}
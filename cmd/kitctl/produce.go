@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/sanservices/kit/config"
+	"github.com/sanservices/kit/kafkalistener"
+)
+
+func produce(env config.Env, args []string) error {
+	fs := flag.NewFlagSet("produce", flag.ExitOnError)
+	topicName := fs.String("topic", "", "topic to publish to")
+	schemaFile := fs.String("schema", "", "avro schema file, registered when needed; the latest registered schema when empty")
+	fs.Parse(args)
+
+	if *topicName == "" {
+		return errors.New("-topic is required")
+	}
+
+	kafkaConfig := kafkalistener.ReadConfig(env)
+	kafkaConfig.ConsumeOnly = false
+	kafkaConfig.TransactionalID = ""
+
+	mb, err := kafkalistener.NewWithLogger(context.Background(), kafkaConfig, logger())
+	if err != nil {
+		return err
+	}
+
+	topic := &kafkalistener.Topic{Name: *topicName}
+	if *schemaFile != "" {
+		raw, err := os.ReadFile(*schemaFile)
+		if err != nil {
+			return err
+		}
+
+		topic.RawSchema = string(raw)
+		topic.RegisterSchema = true
+	}
+
+	err = mb.SetSchema(topic)
+	if err != nil {
+		return err
+	}
+
+	if topic.RawSchema == "" {
+		raw, err := json.Marshal(topic.Schema)
+		if err != nil {
+			return err
+		}
+		topic.RawSchema = string(raw)
+	}
+
+	decoder := json.NewDecoder(os.Stdin)
+	decoder.UseNumber()
+
+	published := 0
+	for {
+		var v interface{}
+		err := decoder.Decode(&v)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		data, err := kafkalistener.NativeFromJSON(topic.Schema, v)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", published+1, err)
+		}
+
+		err = mb.Publish(topic, data)
+		if err != nil {
+			return fmt.Errorf("record %d: %w", published+1, err)
+		}
+		published++
+	}
+
+	fmt.Fprintf(os.Stderr, "%d messages published to %s\n", published, topic.Name)
+	return nil
+}
+
+// logger keeps the watermill logs out of stdout.
+func logger() watermill.LoggerAdapter {
+	return watermill.NewStdLoggerWithOut(os.Stderr, false, false)
+}
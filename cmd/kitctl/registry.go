@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+	"github.com/sanservices/kit/config"
+	"github.com/sanservices/kit/kafkalistener"
+	tlskit "github.com/sanservices/kit/tls"
+)
+
+func registryClient(env config.Env) (*registry.Client, error) {
+	kafkaConfig := kafkalistener.ReadConfig(env)
+
+	tlsConfig, err := tlskit.GetTLSConf(kafkaConfig.TLS)
+	if err != nil {
+		return nil, err
+	}
+
+	return kafkalistener.NewRegistryClient(tlsConfig, kafkaConfig.SchemaReg, kafkaConfig.Registry)
+}
+
+func subjects(env config.Env, args []string) error {
+	fs := flag.NewFlagSet("subjects", flag.ExitOnError)
+	fs.Parse(args)
+
+	client, err := registryClient(env)
+	if err != nil {
+		return err
+	}
+
+	subjects, err := client.GetSubjects()
+	if err != nil {
+		return err
+	}
+
+	for _, subject := range subjects {
+		fmt.Println(subject)
+	}
+
+	return nil
+}
+
+func versions(env config.Env, args []string) error {
+	fs := flag.NewFlagSet("versions", flag.ExitOnError)
+	subject := fs.String("subject", "", "subject name, usually <topic>-value")
+	fs.Parse(args)
+
+	if *subject == "" {
+		return errors.New("-subject is required")
+	}
+
+	client, err := registryClient(env)
+	if err != nil {
+		return err
+	}
+
+	versions, err := client.GetVersions(*subject)
+	if err != nil {
+		return err
+	}
+
+	for _, version := range versions {
+		fmt.Println(version)
+	}
+
+	return nil
+}
+
+func schema(env config.Env, args []string) error {
+	fs := flag.NewFlagSet("schema", flag.ExitOnError)
+	subject := fs.String("subject", "", "subject name, usually <topic>-value")
+	version := fs.Int("version", 0, "version of the subject, the latest when 0")
+	id := fs.Int("id", 0, "schema id, instead of subject and version")
+	fs.Parse(args)
+
+	if *subject == "" && *id == 0 {
+		return errors.New("-subject or -id is required")
+	}
+
+	client, err := registryClient(env)
+	if err != nil {
+		return err
+	}
+
+	var sch avro.Schema
+	switch {
+	case *id > 0:
+		sch, err = client.GetSchema(*id)
+	case *version > 0:
+		sch, err = client.GetSchemaByVersion(*subject, *version)
+	default:
+		sch, err = client.GetLatestSchema(*subject)
+	}
+	if err != nil {
+		return err
+	}
+
+	out, err := json.MarshalIndent(sch, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintln(os.Stdout, string(out))
+	return err
+}
@@ -6,6 +6,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/mitchellh/mapstructure"
 	"github.com/spf13/viper"
 )
 
@@ -34,3 +35,13 @@ func Read(e Env) *General {
 
 	return &CFG
 }
+
+// ReadKey reads the given file and decodes the section at key into out,
+// its keys are the yaml names of the fields of out.
+func ReadKey(e Env, key string, out interface{}) error {
+	Read(e)
+
+	return viper.UnmarshalKey(key, out, func(dc *mapstructure.DecoderConfig) {
+		dc.TagName = "yaml"
+	})
+}
@@ -44,3 +44,36 @@ func TestRead(t *testing.T) {
 		recoverer(t, k, v)
 	}
 }
+
+func TestReadKey(t *testing.T) {
+	var kafkaConfig struct {
+		Enabled         bool     `yaml:"enabled"`
+		ConsumerGroupID string   `yaml:"consumer_group_id"`
+		Brokers         []string `yaml:"brokers"`
+		TLS             struct {
+			CACertPEM string `yaml:"ca_cert_pem"`
+		} `yaml:"TLS"`
+	}
+
+	err := config.ReadKey(config.Test, "kafka", &kafkaConfig)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		Name          string
+		Value         interface{}
+		ExpectedValue interface{}
+	}{
+		{Name: "enabled", Value: kafkaConfig.Enabled, ExpectedValue: true},
+		{Name: "consumer_group_id", Value: kafkaConfig.ConsumerGroupID, ExpectedValue: "consumer-test"},
+		{Name: "brokers", Value: len(kafkaConfig.Brokers), ExpectedValue: 1},
+		{Name: "TLS.ca_cert_pem", Value: kafkaConfig.TLS.CACertPEM, ExpectedValue: "./cacert.pem"},
+	}
+
+	for _, tc := range testcases {
+		if tc.Value != tc.ExpectedValue {
+			t.Errorf("%s: value = %v, expected %v", tc.Name, tc.Value, tc.ExpectedValue)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+package kafkalistener
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/IBM/sarama"
+)
+
+var ErrTopicNotFound error = errors.New("topic not found in the cluster metadata")
+
+// TopicChange is a setting of a topic that differs from its declaration.
+type TopicChange struct {
+	Setting  string
+	Current  string
+	Declared string
+	// Applied is set when EnsureTopics changed the setting,
+	// partitions can't be decreased and the replication factor isn't changed.
+	Applied bool
+}
+
+// TopicDiff is the drift between a declared topic and the cluster.
+type TopicDiff struct {
+	Topic   string
+	Missing bool
+	Created bool
+	Changes []TopicChange
+}
+
+func (d TopicDiff) String() string {
+	if d.Created {
+		return fmt.Sprintf("topic %s: created", d.Topic)
+	}
+	if d.Missing {
+		return fmt.Sprintf("topic %s: missing", d.Topic)
+	}
+
+	changes := make([]string, len(d.Changes))
+	for i, c := range d.Changes {
+		changes[i] = fmt.Sprintf("%s %s -> %s", c.Setting, c.Current, c.Declared)
+	}
+
+	return fmt.Sprintf("topic %s: %s", d.Topic, strings.Join(changes, ", "))
+}
+
+// EnsureTopics compares the declared partitions, replication factor and configs of
+// the topics with the cluster and returns the topics that drifted.
+//
+// With apply, missing topics are created, partitions are increased and configs are set.
+func (mb *MessageBroker) EnsureTopics(topics []*Topic, apply bool) ([]TopicDiff, error) {
+	if !mb.enabled {
+		return nil, ErrBrokerNotEnabled
+	}
+
+	if mb.localDir != "" {
+		return nil, ErrLocalMode
+	}
+
+	admin, err := sarama.NewClusterAdmin(mb.subscriberConfig.Brokers, mb.subscriberConfig.OverwriteSaramaConfig)
+	if err != nil {
+		return nil, err
+	}
+	defer admin.Close()
+
+	return ensureTopics(admin, topics, apply)
+}
+
+func ensureTopics(admin sarama.ClusterAdmin, topics []*Topic, apply bool) ([]TopicDiff, error) {
+	var diffs []TopicDiff
+	for _, topic := range topics {
+		diff, err := ensureTopic(admin, topic, apply)
+		if err != nil {
+			return diffs, fmt.Errorf("topic %s: %w", topic.Name, err)
+		}
+
+		if diff.Missing || len(diff.Changes) > 0 {
+			diffs = append(diffs, diff)
+		}
+	}
+
+	return diffs, nil
+}
+
+func ensureTopic(admin sarama.ClusterAdmin, topic *Topic, apply bool) (TopicDiff, error) {
+	diff := TopicDiff{Topic: topic.Name}
+
+	metadata, err := admin.DescribeTopics([]string{topic.Name})
+	if err != nil {
+		return diff, err
+	}
+	if len(metadata) == 0 {
+		return diff, ErrTopicNotFound
+	}
+
+	if errors.Is(metadata[0].Err, sarama.ErrUnknownTopicOrPartition) {
+		diff.Missing = true
+		if !apply {
+			return diff, nil
+		}
+
+		err = admin.CreateTopic(topic.Name, topicDetail(topic), false)
+		if err != nil {
+			return diff, err
+		}
+
+		diff.Created = true
+		return diff, nil
+	}
+	if metadata[0].Err != sarama.ErrNoError {
+		return diff, metadata[0].Err
+	}
+
+	partitions := int32(len(metadata[0].Partitions))
+	if topic.Partitions > 0 && topic.Partitions != partitions {
+		change := TopicChange{
+			Setting:  "partitions",
+			Current:  strconv.Itoa(int(partitions)),
+			Declared: strconv.Itoa(int(topic.Partitions)),
+		}
+
+		if apply && topic.Partitions > partitions {
+			err = admin.CreatePartitions(topic.Name, topic.Partitions, nil, false)
+			if err != nil {
+				return diff, err
+			}
+			change.Applied = true
+		}
+		diff.Changes = append(diff.Changes, change)
+	}
+
+	if topic.ReplicationFactor > 0 && len(metadata[0].Partitions) > 0 {
+		replicas := len(metadata[0].Partitions[0].Replicas)
+		if int(topic.ReplicationFactor) != replicas {
+			diff.Changes = append(diff.Changes, TopicChange{
+				Setting:  "replication.factor",
+				Current:  strconv.Itoa(replicas),
+				Declared: strconv.Itoa(int(topic.ReplicationFactor)),
+			})
+		}
+	}
+
+	if len(topic.Configs) == 0 {
+		return diff, nil
+	}
+
+	changes, err := configChanges(admin, topic)
+	if err != nil {
+		return diff, err
+	}
+
+	if apply && len(changes) > 0 {
+		entries := make(map[string]sarama.IncrementalAlterConfigsEntry, len(changes))
+		for _, c := range changes {
+			value := c.Declared
+			entries[c.Setting] = sarama.IncrementalAlterConfigsEntry{
+				Operation: sarama.IncrementalAlterConfigsOperationSet,
+				Value:     &value,
+			}
+		}
+
+		err = admin.IncrementalAlterConfig(sarama.TopicResource, topic.Name, entries, false)
+		if err != nil {
+			return diff, err
+		}
+
+		for i := range changes {
+			changes[i].Applied = true
+		}
+	}
+	diff.Changes = append(diff.Changes, changes...)
+
+	return diff, nil
+}
+
+// configChanges returns the declared configs that differ from the cluster, sorted by name.
+func configChanges(admin sarama.ClusterAdmin, topic *Topic) ([]TopicChange, error) {
+	names := make([]string, 0, len(topic.Configs))
+	for name := range topic.Configs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	entries, err := admin.DescribeConfig(sarama.ConfigResource{
+		Type:        sarama.TopicResource,
+		Name:        topic.Name,
+		ConfigNames: names,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	current := make(map[string]string, len(entries))
+	for _, entry := range entries {
+		current[entry.Name] = entry.Value
+	}
+
+	var changes []TopicChange
+	for _, name := range names {
+		if current[name] != topic.Configs[name] {
+			changes = append(changes, TopicChange{Setting: name, Current: current[name], Declared: topic.Configs[name]})
+		}
+	}
+
+	return changes, nil
+}
+
+// topicDetail uses the broker defaults for the settings that aren't declared.
+func topicDetail(topic *Topic) *sarama.TopicDetail {
+	detail := &sarama.TopicDetail{
+		NumPartitions:     -1,
+		ReplicationFactor: -1,
+		ConfigEntries:     make(map[string]*string, len(topic.Configs)),
+	}
+
+	if topic.Partitions > 0 {
+		detail.NumPartitions = topic.Partitions
+	}
+	if topic.ReplicationFactor > 0 {
+		detail.ReplicationFactor = topic.ReplicationFactor
+	}
+	for name, value := range topic.Configs {
+		value := value
+		detail.ConfigEntries[name] = &value
+	}
+
+	return detail
+}
@@ -0,0 +1,106 @@
+package kafkalistener
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+type testClusterAdmin struct {
+	sarama.ClusterAdmin
+	topics  map[string]*sarama.TopicMetadata
+	configs map[string]string
+	altered map[string]string
+	created []string
+}
+
+func (a *testClusterAdmin) DescribeTopics(topics []string) ([]*sarama.TopicMetadata, error) {
+	metadata, ok := a.topics[topics[0]]
+	if !ok {
+		return []*sarama.TopicMetadata{{Name: topics[0], Err: sarama.ErrUnknownTopicOrPartition}}, nil
+	}
+	return []*sarama.TopicMetadata{metadata}, nil
+}
+
+func (a *testClusterAdmin) CreateTopic(topic string, detail *sarama.TopicDetail, validateOnly bool) error {
+	a.created = append(a.created, topic)
+	return nil
+}
+
+func (a *testClusterAdmin) CreatePartitions(topic string, count int32, assignment [][]int32, validateOnly bool) error {
+	a.created = append(a.created, topic+" partitions")
+	return nil
+}
+
+func (a *testClusterAdmin) DescribeConfig(resource sarama.ConfigResource) ([]sarama.ConfigEntry, error) {
+	var entries []sarama.ConfigEntry
+	for _, name := range resource.ConfigNames {
+		entries = append(entries, sarama.ConfigEntry{Name: name, Value: a.configs[name]})
+	}
+	return entries, nil
+}
+
+func (a *testClusterAdmin) IncrementalAlterConfig(resourceType sarama.ConfigResourceType, name string, entries map[string]sarama.IncrementalAlterConfigsEntry, validateOnly bool) error {
+	for k, v := range entries {
+		a.altered[k] = *v.Value
+	}
+	return nil
+}
+
+func TestEnsureTopics(t *testing.T) {
+	partition := &sarama.PartitionMetadata{Replicas: []int32{1, 2}}
+	topics := []*Topic{
+		{Name: "reservations", Partitions: 6, ReplicationFactor: 3, Configs: map[string]string{"retention.ms": "604800000", "cleanup.policy": "delete"}},
+		{Name: "payments", Partitions: 3},
+		{Name: "guests", Partitions: 1},
+	}
+
+	testcases := []struct {
+		Name            string
+		Apply           bool
+		ExpectedDiffs   []string
+		ExpectedCreated []string
+		ExpectedAltered map[string]string
+	}{
+		{
+			Name:            "Report",
+			ExpectedDiffs:   []string{"topic reservations: partitions 3 -> 6, replication.factor 2 -> 3, retention.ms 86400000 -> 604800000", "topic guests: missing"},
+			ExpectedAltered: map[string]string{},
+		},
+		{
+			Name:            "Apply",
+			Apply:           true,
+			ExpectedDiffs:   []string{"topic reservations: partitions 3 -> 6, replication.factor 2 -> 3, retention.ms 86400000 -> 604800000", "topic guests: created"},
+			ExpectedCreated: []string{"reservations partitions", "guests"},
+			ExpectedAltered: map[string]string{"retention.ms": "604800000"},
+		},
+	}
+
+	for _, tc := range testcases {
+		admin := &testClusterAdmin{
+			topics: map[string]*sarama.TopicMetadata{
+				"reservations": {Name: "reservations", Partitions: []*sarama.PartitionMetadata{partition, partition, partition}},
+				"payments":     {Name: "payments", Partitions: []*sarama.PartitionMetadata{partition, partition, partition}},
+			},
+			configs: map[string]string{"retention.ms": "86400000", "cleanup.policy": "delete"},
+			altered: map[string]string{},
+		}
+
+		diffs, err := ensureTopics(admin, topics, tc.Apply)
+		if err != nil {
+			t.Fatalf("%s: error = %v", tc.Name, err)
+		}
+
+		got := make([]string, len(diffs))
+		for i, d := range diffs {
+			got[i] = d.String()
+		}
+		if !reflect.DeepEqual(got, tc.ExpectedDiffs) {
+			t.Errorf("%s: diffs = %v, expected %v", tc.Name, got, tc.ExpectedDiffs)
+		}
+		if !reflect.DeepEqual(admin.created, tc.ExpectedCreated) || !reflect.DeepEqual(admin.altered, tc.ExpectedAltered) {
+			t.Errorf("%s: created = %v, altered = %v", tc.Name, admin.created, admin.altered)
+		}
+	}
+}
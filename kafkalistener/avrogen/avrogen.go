@@ -0,0 +1,339 @@
+// Package avrogen generates go structs from avro schemas, with the avro tags
+// hamba/avro expects and a kafkalistener.Topic with the embedded schema.
+package avrogen
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"go/format"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/hamba/avro"
+)
+
+var (
+	errNoPackage  = errors.New("package name not provided")
+	errNotARecord = errors.New("avro schema is not a record")
+)
+
+// initialisms are written in upper case in the go names.
+var initialisms = map[string]bool{
+	"api": true, "http": true, "id": true, "ip": true, "json": true,
+	"sql": true, "uri": true, "url": true, "uuid": true, "xml": true,
+}
+
+// Config is the configuration of the generated file.
+type Config struct {
+	// Package is the package name of the generated file.
+	Package string
+	// Topic is the name of the kafka topic, a kafkalistener.Topic
+	// variable with the schema is generated when it's set.
+	Topic string
+}
+
+type generator struct {
+	// names maps the avro full names to their go names.
+	names   map[string]string
+	taken   map[string]bool
+	imports map[string]bool
+	decls   bytes.Buffer
+}
+
+// Generate returns the go source of the structs for an avro record schema.
+func Generate(cfg Config, rawSchema string) ([]byte, error) {
+	if cfg.Package == "" {
+		return nil, errNoPackage
+	}
+
+	schema, err := avro.ParseWithCache(rawSchema, "", &avro.SchemaCache{})
+	if err != nil {
+		return nil, err
+	}
+
+	record, ok := schema.(*avro.RecordSchema)
+	if !ok {
+		return nil, errNotARecord
+	}
+
+	g := &generator{
+		names:   make(map[string]string),
+		taken:   make(map[string]bool),
+		imports: make(map[string]bool),
+	}
+	name := g.record(record)
+
+	if cfg.Topic != "" {
+		g.imports["github.com/sanservices/kit/kafkalistener"] = true
+		g.topic(cfg.Topic, name, rawSchema)
+	}
+
+	var out bytes.Buffer
+	fmt.Fprintf(&out, "// Code generated by avrogen. DO NOT EDIT.\n\npackage %s\n\n", cfg.Package)
+
+	imports := make([]string, 0, len(g.imports))
+	for path := range g.imports {
+		imports = append(imports, path)
+	}
+	sort.Slice(imports, func(i, j int) bool {
+		iStd, jStd := !strings.Contains(imports[i], "."), !strings.Contains(imports[j], ".")
+		if iStd != jStd {
+			return iStd
+		}
+		return imports[i] < imports[j]
+	})
+
+	if len(imports) > 0 {
+		out.WriteString("import (\n")
+		for i, path := range imports {
+			// The standard library imports are sorted first.
+			if i > 0 && !strings.Contains(imports[i-1], ".") && strings.Contains(path, ".") {
+				out.WriteString("\n")
+			}
+			fmt.Fprintf(&out, "%q\n", path)
+		}
+		out.WriteString(")\n\n")
+	}
+	out.Write(g.decls.Bytes())
+
+	return format.Source(out.Bytes())
+}
+
+// record declares the struct of a record and the types of its fields.
+func (g *generator) record(schema *avro.RecordSchema) string {
+	if name, ok := g.names[schema.FullName()]; ok {
+		return name
+	}
+	name := g.typeName(schema.Name(), schema.FullName())
+
+	var decl bytes.Buffer
+	writeDoc(&decl, name+" is the "+schema.FullName()+" avro record.", schema.Doc())
+	fmt.Fprintf(&decl, "type %s struct {\n", name)
+	fields := make(map[string]bool)
+	for _, field := range schema.Fields() {
+		if field.Doc() != "" {
+			writeComment(&decl, field.Doc())
+		}
+		// Names like guest_name and guestName are the same go name.
+		goName := unique(fields, fieldName(field.Name()))
+		fmt.Fprintf(&decl, "%s %s `avro:%q`\n", goName, g.goType(field.Type()), field.Name())
+	}
+	decl.WriteString("}\n\n")
+
+	g.decls.Write(decl.Bytes())
+	return name
+}
+
+// enum declares a string type with a constant for each symbol.
+func (g *generator) enum(schema *avro.EnumSchema) string {
+	if name, ok := g.names[schema.FullName()]; ok {
+		return name
+	}
+	name := g.typeName(schema.Name(), schema.FullName())
+
+	writeComment(&g.decls, name+" is the "+schema.FullName()+" avro enum.")
+	fmt.Fprintf(&g.decls, "type %s string\n\n", name)
+
+	g.decls.WriteString("const (\n")
+	for _, symbol := range schema.Symbols() {
+		fmt.Fprintf(&g.decls, "%s %s = %q\n", unique(g.taken, name+fieldName(symbol)), name, symbol)
+	}
+	g.decls.WriteString(")\n\n")
+
+	return name
+}
+
+// topic declares the kafkalistener.Topic of the record.
+func (g *generator) topic(topic, record, rawSchema string) {
+	var schema bytes.Buffer
+	if err := json.Indent(&schema, []byte(strings.TrimSpace(rawSchema)), "", "  "); err != nil {
+		schema.Reset()
+		schema.WriteString(rawSchema)
+	}
+
+	literal := "`" + schema.String() + "`"
+	if strings.Contains(schema.String(), "`") {
+		literal = strconv.Quote(schema.String())
+	}
+
+	schemaName := unexport(record) + "Schema"
+	fmt.Fprintf(&g.decls, "// %sTopic is the %s topic of the %s messages.\n", record, topic, record)
+	fmt.Fprintf(&g.decls, "var %sTopic = &kafkalistener.Topic{\nName: %q,\nRawSchema: %s,\n}\n\n", record, topic, schemaName)
+	fmt.Fprintf(&g.decls, "const %s = %s\n", schemaName, literal)
+}
+
+func (g *generator) goType(schema avro.Schema) string {
+	switch s := schema.(type) {
+	case *avro.RefSchema:
+		return g.goType(s.Schema())
+
+	case *avro.RecordSchema:
+		return g.record(s)
+
+	case *avro.EnumSchema:
+		return g.enum(s)
+
+	case *avro.ArraySchema:
+		return "[]" + g.goType(s.Items())
+
+	case *avro.MapSchema:
+		return "map[string]" + g.goType(s.Values())
+
+	case *avro.UnionSchema:
+		// Only ["null", type] unions are pointers, the others are
+		// decoded as {"type": value} maps by hamba/avro.
+		if !s.Nullable() || len(s.Types()) != 2 {
+			return "map[string]interface{}"
+		}
+
+		_, typeIdx := s.Indices()
+		typ := g.goType(s.Types()[typeIdx])
+		if strings.HasPrefix(typ, "*") {
+			return typ
+		}
+		return "*" + typ
+
+	case *avro.FixedSchema:
+		// hamba/avro decodes fixed decimals into big.Rat but only encodes *big.Rat,
+		// so they are kept as bytes, see kafkalistener.DecimalFromBytes.
+		return fmt.Sprintf("[%d]byte", s.Size())
+
+	case *avro.PrimitiveSchema:
+		return g.primitive(s)
+	}
+
+	return "interface{}"
+}
+
+func (g *generator) primitive(schema *avro.PrimitiveSchema) string {
+	var logical avro.LogicalType
+	if ls := schema.Logical(); ls != nil {
+		logical = ls.Type()
+	}
+
+	switch schema.Type() {
+	case avro.Boolean:
+		return "bool"
+
+	case avro.Int:
+		switch logical {
+		case avro.Date:
+			g.imports["time"] = true
+			return "time.Time"
+		case avro.TimeMillis:
+			g.imports["time"] = true
+			return "time.Duration"
+		}
+		return "int32"
+
+	case avro.Long:
+		switch logical {
+		case avro.TimestampMillis, avro.TimestampMicros:
+			g.imports["time"] = true
+			return "time.Time"
+		case avro.TimeMicros:
+			g.imports["time"] = true
+			return "time.Duration"
+		}
+		return "int64"
+
+	case avro.Float:
+		return "float32"
+
+	case avro.Double:
+		return "float64"
+
+	case avro.String:
+		return "string"
+
+	case avro.Bytes:
+		if logical == avro.Decimal {
+			g.imports["math/big"] = true
+			return "*big.Rat"
+		}
+		return "[]byte"
+	}
+
+	return "interface{}"
+}
+
+// typeName returns a unique go name for an avro named type,
+// adding the namespace when the name is already taken.
+func (g *generator) typeName(name, fullName string) string {
+	goName := fieldName(name)
+	if g.taken[goName] {
+		goName = fieldName(fullName)
+	}
+
+	goName = unique(g.taken, goName)
+	g.names[fullName] = goName
+	return goName
+}
+
+// unique returns name, or name with the first number that's not taken, and marks it as taken.
+func unique(taken map[string]bool, name string) string {
+	goName := name
+	for i := 2; taken[goName]; i++ {
+		goName = fmt.Sprintf("%s%d", name, i)
+	}
+
+	taken[goName] = true
+	return goName
+}
+
+// fieldName converts an avro name like guest_name, GUEST_NAME
+// or guestName into an exported go name.
+func fieldName(name string) string {
+	parts := strings.FieldsFunc(name, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+
+	var b strings.Builder
+	for _, part := range parts {
+		if strings.ToUpper(part) == part {
+			part = strings.ToLower(part)
+		}
+		if initialisms[strings.ToLower(part)] {
+			b.WriteString(strings.ToUpper(part))
+			continue
+		}
+		b.WriteString(strings.ToUpper(part[:1]) + part[1:])
+	}
+
+	goName := b.String()
+	if goName == "" || unicode.IsDigit(rune(goName[0])) {
+		goName = "X" + goName
+	}
+	return goName
+}
+
+func unexport(name string) string {
+	for i, r := range name {
+		if !unicode.IsUpper(r) {
+			if i > 1 {
+				i--
+			}
+			return strings.ToLower(name[:i]) + name[i:]
+		}
+	}
+	return strings.ToLower(name)
+}
+
+// writeDoc writes the comment of a type followed by its avro doc.
+func writeDoc(b *bytes.Buffer, summary, doc string) {
+	writeComment(b, summary)
+	if doc != "" {
+		b.WriteString("//\n")
+		writeComment(b, doc)
+	}
+}
+
+func writeComment(b *bytes.Buffer, doc string) {
+	for _, line := range strings.Split(strings.TrimSpace(doc), "\n") {
+		fmt.Fprintf(b, "// %s\n", strings.TrimSpace(line))
+	}
+}
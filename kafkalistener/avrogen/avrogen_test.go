@@ -0,0 +1,256 @@
+package avrogen
+
+import (
+	"bytes"
+	"flag"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"go/types"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update the golden files")
+
+const testSchema = `{
+	"type": "record",
+	"name": "Reservation",
+	"namespace": "com.sanservices.booking",
+	"doc": "A booked stay.",
+	"fields": [
+		{"name": "reservation_id", "type": "long"},
+		{"name": "GUEST_NAME", "type": ["null", "string"], "default": null},
+		{"name": "tier", "type": {"type": "enum", "name": "Tier", "symbols": ["SILVER", "GOLD"]}},
+		{"name": "created", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "amount", "type": {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}},
+		{"name": "room", "type": ["null", {"type": "record", "name": "Room", "fields": [{"name": "number", "type": "int"}]}]},
+		{"name": "extra", "type": ["string", "long"]},
+		{"name": "tags", "type": {"type": "map", "values": {"type": "array", "items": "Tier"}}}
+	]
+}`
+
+func TestGenerate(t *testing.T) {
+	src, err := Generate(Config{Package: "events", Topic: "reservations"}, testSchema)
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	expected := []string{
+		"package events",
+		"// Reservation is the com.sanservices.booking.Reservation avro record.\n//\n// A booked stay.",
+		"ReservationID int64 `avro:\"reservation_id\"`",
+		"GuestName *string `avro:\"GUEST_NAME\"`",
+		"TierGold Tier = \"GOLD\"",
+		"Created time.Time `avro:\"created\"`",
+		"Amount *big.Rat `avro:\"amount\"`",
+		"Room *Room `avro:\"room\"`",
+		"Number int32 `avro:\"number\"`",
+		"Extra map[string]interface{} `avro:\"extra\"`",
+		"Tags map[string][]Tier `avro:\"tags\"`",
+		"var ReservationTopic = &kafkalistener.Topic{",
+		"Name: \"reservations\",",
+	}
+
+	// Compare without the alignment added by gofmt.
+	got := strings.Join(strings.Fields(string(src)), " ")
+	for _, e := range expected {
+		if !strings.Contains(got, strings.Join(strings.Fields(e), " ")) {
+			t.Errorf("missing %q in\n%s", e, src)
+		}
+	}
+}
+
+func TestGenerateGolden(t *testing.T) {
+	src, err := Generate(Config{Package: "events", Topic: "reservations"}, testSchema)
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	golden := filepath.Join("testdata", "reservation.golden")
+	if *update {
+		err = os.WriteFile(golden, src, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	expected, err := os.ReadFile(golden)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(src, expected) {
+		t.Errorf("generated code = \n%s\nexpected\n%s", src, expected)
+	}
+}
+
+// roundTripMain encodes and decodes a Reservation of the generated code with hamba/avro.
+const roundTripMain = `package main
+
+import (
+	"fmt"
+	"math/big"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/hamba/avro"
+)
+
+func main() {
+	guest := "ana"
+	in := Reservation{
+		ReservationID: 1 << 40,
+		GuestName:     &guest,
+		Tier:          TierGold,
+		Created:       time.UnixMilli(1646389800000).UTC(),
+		Amount:        big.NewRat(12050, 100),
+		Room:          &Room{Number: 101},
+		Extra:         map[string]interface{}{"long": int64(3)},
+		Tags:          map[string][]Tier{"vip": {TierGold, TierSilver}},
+	}
+
+	schema := avro.MustParse(ReservationTopic.RawSchema)
+	data, err := avro.Marshal(schema, in)
+	if err != nil {
+		fmt.Println("marshal error =", err)
+		os.Exit(1)
+	}
+
+	var out Reservation
+	err = avro.Unmarshal(schema, data, &out)
+	if err != nil {
+		fmt.Println("unmarshal error =", err)
+		os.Exit(1)
+	}
+
+	if out.Amount == nil || out.Amount.Cmp(in.Amount) != 0 {
+		fmt.Println("amount =", out.Amount)
+		os.Exit(1)
+	}
+	out.Amount = in.Amount
+
+	if !reflect.DeepEqual(in, out) {
+		fmt.Printf("out = %+v, expected %+v\n", out, in)
+		os.Exit(1)
+	}
+}
+`
+
+// TestGenerateRoundTrip builds the generated code and round-trips a record through hamba/avro with it.
+func TestGenerateRoundTrip(t *testing.T) {
+	if testing.Short() {
+		t.Skip("builds the generated code")
+	}
+
+	src, err := Generate(Config{Package: "main", Topic: "reservations"}, testSchema)
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	// The program is built inside the module, testdata is ignored by ./... patterns.
+	dir, err := os.MkdirTemp("testdata", "roundtrip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	err = os.WriteFile(filepath.Join(dir, "reservation.go"), src, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.WriteFile(filepath.Join(dir, "main.go"), []byte(roundTripMain), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := exec.Command("go", "run", "./"+dir).CombinedOutput()
+	if err != nil {
+		t.Errorf("round trip error = %v\n%s", err, out)
+	}
+}
+
+func TestGenerateErrors(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Config        Config
+		Schema        string
+		ExpectedError error
+	}{
+		{Name: "No package", Schema: testSchema, ExpectedError: errNoPackage},
+		{Name: "Not a record", Config: Config{Package: "events"}, Schema: `"string"`, ExpectedError: errNotARecord},
+	}
+
+	for _, tc := range testcases {
+		_, err := Generate(tc.Config, tc.Schema)
+		if err != tc.ExpectedError {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+	}
+}
+
+func TestGenerateDuplicatedNames(t *testing.T) {
+	schema := `{
+		"type": "record",
+		"name": "Guest",
+		"fields": [
+			{"name": "guest_name", "type": "string"},
+			{"name": "guestName", "type": "string"},
+			{"name": "GUEST_NAME", "type": "string"},
+			{"name": "status", "type": {"type": "enum", "name": "Status", "symbols": ["ON_HOLD", "OnHold"]}},
+			{"name": "hold", "type": {"type": "record", "name": "StatusOnHold", "fields": []}}
+		]
+	}`
+
+	src, err := Generate(Config{Package: "events"}, schema)
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	expected := []string{
+		"GuestName string `avro:\"guest_name\"`",
+		"GuestName2 string `avro:\"guestName\"`",
+		"GuestName3 string `avro:\"GUEST_NAME\"`",
+		"StatusOnHold Status = \"ON_HOLD\"",
+		"StatusOnHold2 Status = \"OnHold\"",
+		"Hold StatusOnHold3 `avro:\"hold\"`",
+	}
+
+	got := strings.Join(strings.Fields(string(src)), " ")
+	for _, e := range expected {
+		if !strings.Contains(got, strings.Join(strings.Fields(e), " ")) {
+			t.Errorf("missing %q in\n%s", e, src)
+		}
+	}
+
+	// The generated code compiles without duplicated declarations.
+	fset := token.NewFileSet()
+	file, err := parser.ParseFile(fset, "guest.go", src, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = (&types.Config{}).Check("events", fset, []*ast.File{file}, nil)
+	if err != nil {
+		t.Errorf("type check error = %v\n%s", err, src)
+	}
+}
+
+func TestFieldName(t *testing.T) {
+	names := map[string]string{
+		"guest_name":     "GuestName",
+		"GUEST_NAME":     "GuestName",
+		"guestName":      "GuestName",
+		"reservation_id": "ReservationID",
+		"uuid":           "UUID",
+		"2fa":            "X2fa",
+	}
+
+	for name, expected := range names {
+		if got := fieldName(name); got != expected {
+			t.Errorf("%s = %s, expected %s", name, got, expected)
+		}
+	}
+}
@@ -0,0 +1,353 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const (
+	// DefaultBatchSize is the MaxSize of the batches when it's not set.
+	DefaultBatchSize = 100
+	// DefaultBatchWait is the MaxWait of the batches when it's not set.
+	DefaultBatchWait = time.Second
+)
+
+// BatchHandlerFunc handles a batch of messages of a partition, in order.
+type BatchHandlerFunc func(msgs []*message.Message) error
+
+// BatchRouteHandler consumes a topic in batches of up to MaxSize messages,
+// a batch is handled after MaxWait even if it isn't full.
+//
+// The whole batch is acked when the handler returns nil, otherwise it's handled again.
+// Errors wrapping ErrPermanent drop the messages instead of retrying them, with SplitOnError
+// the batch is split in halves until the failing messages are isolated.
+// Invalid records are dropped before the handler is called, the rest of the batch is handled.
+type BatchRouteHandler struct {
+	Name         string
+	Topic        *Topic
+	HandlerFunc  BatchHandlerFunc
+	MaxSize      int
+	MaxWait      time.Duration
+	SplitOnError bool
+}
+
+// batchRoute is a registered batch handler, cancel and done are set once it's running.
+type batchRoute struct {
+	handler BatchRouteHandler
+	cancel  context.CancelFunc
+	done    chan struct{}
+}
+
+// HandleBatch decodes the batch into records of type T before calling fn.
+// Decoding errors are permanent, with SplitOnError the undecodable messages are isolated.
+func HandleBatch[T any](topic *Topic, fn func(msgs []*message.Message, records []T) error) BatchHandlerFunc {
+	return func(msgs []*message.Message) error {
+		records := make([]T, len(msgs))
+		for i, msg := range msgs {
+			err := DecodePayload(topic, msg.Payload, &records[i])
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrPermanent, err)
+			}
+		}
+
+		return fn(msgs, records)
+	}
+}
+
+// AddBatchHandler registers a batch handler, it starts consuming with Listen
+// or right away if the broker is already listening.
+//
+// Batch handlers have their own consumer group session, using the consumer group of the broker.
+func (mb *MessageBroker) AddBatchHandler(handler BatchRouteHandler) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if mb.localDir != "" {
+		return ErrLocalMode
+	}
+
+	if mb.consumerGroup == "" {
+		return ErrNoConsumerGroup
+	}
+
+	if handler.Name == "" {
+		handler.Name = handler.Topic.Name
+	}
+	if handler.MaxSize <= 0 {
+		handler.MaxSize = DefaultBatchSize
+	}
+	if handler.MaxWait <= 0 {
+		handler.MaxWait = DefaultBatchWait
+	}
+
+	err := mb.SetSchema(handler.Topic)
+	if err != nil {
+		return err
+	}
+
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	for _, r := range mb.batchRoutes {
+		if r.handler.Name == handler.Name {
+			return ErrHandlerExists
+		}
+	}
+	if _, ok := mb.routes[handler.Name]; ok {
+		return ErrHandlerExists
+	}
+
+	r := &batchRoute{handler: handler}
+	mb.batchRoutes = append(mb.batchRoutes, r)
+
+	if mb.listenCtx != nil {
+		mb.startBatchRoute(mb.listenCtx, r)
+	}
+
+	return nil
+}
+
+// startBatchRoute starts consuming a batch route, the caller must hold mb.mu.
+func (mb *MessageBroker) startBatchRoute(ctx context.Context, r *batchRoute) {
+	if r.done != nil {
+		return
+	}
+
+	ctx, r.cancel = context.WithCancel(ctx)
+	r.done = make(chan struct{})
+
+	go func() {
+		defer close(r.done)
+		mb.consumeBatches(ctx, r.handler)
+	}()
+}
+
+// stopBatchRoutes stops the batch routes and waits for their last batches.
+func (mb *MessageBroker) stopBatchRoutes() {
+	var running []*batchRoute
+
+	mb.mu.Lock()
+	for _, r := range mb.batchRoutes {
+		if r.done != nil {
+			r.cancel()
+			running = append(running, r)
+		}
+	}
+	mb.mu.Unlock()
+
+	for _, r := range running {
+		<-r.done
+	}
+}
+
+// consumeBatches runs the consumer group session of a batch route until the context is done.
+func (mb *MessageBroker) consumeBatches(ctx context.Context, handler BatchRouteHandler) {
+	fields := watermill.LogFields{"handler": handler.Name, "topic": handler.Topic.Name}
+
+	for ctx.Err() == nil {
+		group, err := sarama.NewConsumerGroup(
+			mb.subscriberConfig.Brokers,
+			mb.consumerGroup,
+			mb.committerSaramaConfig(),
+		)
+		if err != nil {
+			mb.logger.Error("Error creating batch consumer group", err, fields)
+			sleepContext(ctx, mb.subscriberConfig.ReconnectRetrySleep)
+			continue
+		}
+
+		groupHandler := rebalanceTracer{mb: mb, handler: handler.Name}.WrapConsumerGroupHandler(&batchGroupHandler{
+			handler:   handler,
+			prepare:   mb.prepareChain(handler.Topic),
+			unmarshal: mb.subscriberConfig.Unmarshaler,
+			nackSleep: mb.subscriberConfig.NackResendSleep,
+			logger:    mb.logger,
+		})
+
+		for ctx.Err() == nil {
+			err = group.Consume(ctx, []string{handler.Topic.Name}, groupHandler)
+			if err != nil {
+				mb.logger.Error("Error consuming batches", err, fields)
+				break
+			}
+		}
+
+		_ = group.Close()
+		if err != nil {
+			sleepContext(ctx, mb.subscriberConfig.ReconnectRetrySleep)
+		}
+	}
+}
+
+// prepareChain runs the claim-check, decryption and validation middlewares of the route handlers
+// on a message of a batch, it returns the message the handler gets.
+func (mb *MessageBroker) prepareChain(topic *Topic) message.HandlerFunc {
+	prepared := func(msg *message.Message) ([]*message.Message, error) {
+		return []*message.Message{msg}, nil
+	}
+
+	return chain(prepared, mb.routeMiddlewares(RouteHandler{Topic: topic}, nil))
+}
+
+// batchGroupHandler collects the messages of each claim into batches.
+type batchGroupHandler struct {
+	handler   BatchRouteHandler
+	prepare   message.HandlerFunc
+	unmarshal kafka.Unmarshaler
+	nackSleep time.Duration
+	logger    watermill.LoggerAdapter
+}
+
+func (h *batchGroupHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h *batchGroupHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func (h *batchGroupHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	for {
+		batch, open := collectBatch(session.Context(), claim.Messages(), h.handler.MaxSize, h.handler.MaxWait)
+		if len(batch) > 0 && !h.process(session, batch) {
+			return nil
+		}
+
+		if !open {
+			return nil
+		}
+	}
+}
+
+// collectBatch waits for the first message and then for up to size messages or until wait,
+// it returns false once the claim is closed or the session is done.
+func collectBatch(ctx context.Context, messages <-chan *sarama.ConsumerMessage, size int, wait time.Duration) ([]*sarama.ConsumerMessage, bool) {
+	var batch []*sarama.ConsumerMessage
+
+	select {
+	case msg, ok := <-messages:
+		if !ok {
+			return nil, false
+		}
+		batch = append(batch, msg)
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+
+	for len(batch) < size {
+		select {
+		case msg, ok := <-messages:
+			if !ok {
+				return batch, false
+			}
+			batch = append(batch, msg)
+		case <-timer.C:
+			return batch, true
+		case <-ctx.Done():
+			return batch, false
+		}
+	}
+
+	return batch, true
+}
+
+// process handles a batch until it succeeds or it's dropped, marking its messages as consumed.
+// It returns false when the session ends before.
+func (h *batchGroupHandler) process(session sarama.ConsumerGroupSession, batch []*sarama.ConsumerMessage) bool {
+	fields := watermill.LogFields{
+		"handler":      h.handler.Name,
+		"partition":    batch[0].Partition,
+		"first_offset": batch[0].Offset,
+		"size":         len(batch),
+	}
+
+	for {
+		err := h.handle(session.Context(), batch)
+		if err == nil {
+			h.mark(session, batch)
+			return true
+		}
+
+		if errors.Is(err, ErrPermanent) {
+			// Only permanent errors are split, a transient one fails the same way with fewer messages.
+			if h.handler.SplitOnError && len(batch) > 1 {
+				half := len(batch) / 2
+				return h.process(session, batch[:half]) && h.process(session, batch[half:])
+			}
+
+			h.logger.Error("Permanent error, dropping batch", err, fields)
+			h.mark(session, batch)
+			return true
+		}
+
+		h.logger.Error("Error handling batch, it will be handled again", err, fields)
+		if !sleepContext(session.Context(), h.nackSleep) {
+			return false
+		}
+	}
+}
+
+// handle unmarshals and prepares the messages before calling the batch handler.
+// The messages that can't be unmarshaled or fail the preparation with a permanent error,
+// like invalid records, are dropped and the rest of the batch is handled.
+func (h *batchGroupHandler) handle(ctx context.Context, batch []*sarama.ConsumerMessage) error {
+	msgs := make([]*message.Message, 0, len(batch))
+	for _, kafkaMsg := range batch {
+		var prepared []*message.Message
+
+		msg, err := h.unmarshal.Unmarshal(kafkaMsg)
+		if err != nil {
+			err = fmt.Errorf("%w: %w", ErrPermanent, err)
+		} else {
+			msg.SetContext(ctx)
+			prepared, err = h.prepare(msg)
+		}
+
+		if errors.Is(err, ErrPermanent) {
+			h.logger.Error("Permanent error, dropping message", err, watermill.LogFields{
+				"handler":   h.handler.Name,
+				"partition": kafkaMsg.Partition,
+				"offset":    kafkaMsg.Offset,
+			})
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		msgs = append(msgs, prepared...)
+	}
+
+	if len(msgs) == 0 {
+		return nil
+	}
+
+	return h.handler.HandlerFunc(msgs)
+}
+
+func (h *batchGroupHandler) mark(session sarama.ConsumerGroupSession, batch []*sarama.ConsumerMessage) {
+	for _, msg := range batch {
+		session.MarkMessage(msg, "")
+	}
+	session.Commit()
+}
+
+// sleepContext waits for d, it returns false when the context is done before.
+func sleepContext(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+
+	select {
+	case <-time.After(d):
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,278 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+func TestCollectBatch(t *testing.T) {
+	messages := make(chan *sarama.ConsumerMessage, 5)
+	for i := 0; i < 5; i++ {
+		messages <- &sarama.ConsumerMessage{Offset: int64(i)}
+	}
+
+	batch, open := collectBatch(context.Background(), messages, 3, time.Second)
+	if len(batch) != 3 || !open {
+		t.Fatalf("size = %d, open = %v, expected 3 true", len(batch), open)
+	}
+
+	start := time.Now()
+	batch, open = collectBatch(context.Background(), messages, 3, 50*time.Millisecond)
+	if len(batch) != 2 || !open {
+		t.Fatalf("size = %d, open = %v, expected 2 true", len(batch), open)
+	}
+	if elapsed := time.Since(start); elapsed < 50*time.Millisecond {
+		t.Errorf("elapsed = %s, expected the batch to wait 50ms", elapsed)
+	}
+
+	close(messages)
+	batch, open = collectBatch(context.Background(), messages, 3, time.Second)
+	if len(batch) != 0 || open {
+		t.Errorf("size = %d, open = %v, expected 0 false", len(batch), open)
+	}
+}
+
+func TestBatchProcess(t *testing.T) {
+	topic := &Topic{
+		Name:   "orders",
+		Schema: avro.MustParse(`{"type":"record","name":"Order","fields":[{"name":"id","type":"string"}]}`),
+	}
+
+	testcases := []struct {
+		Name         string
+		SplitOnError bool
+		Rules        []FieldRule
+		// Fail returns the error of a batch, calls counts the calls to the handler.
+		Fail              func(offsets []int64, calls int) error
+		ExpectedHandled   []int64
+		ExpectedCalls     int
+		ExpectedCommitted int64
+	}{
+		{
+			Name:              "Successful batch",
+			Fail:              func(offsets []int64, calls int) error { return nil },
+			ExpectedHandled:   []int64{0, 1, 2, 3},
+			ExpectedCalls:     1,
+			ExpectedCommitted: 4,
+		},
+		{
+			Name: "Transient error is retried",
+			Fail: func(offsets []int64, calls int) error {
+				if calls == 1 {
+					return errors.New("timeout")
+				}
+				return nil
+			},
+			ExpectedHandled:   []int64{0, 1, 2, 3},
+			ExpectedCalls:     2,
+			ExpectedCommitted: 4,
+		},
+		{
+			Name:         "Transient error with SplitOnError retries the whole batch",
+			SplitOnError: true,
+			Fail: func(offsets []int64, calls int) error {
+				if calls == 1 {
+					return errors.New("timeout")
+				}
+				return nil
+			},
+			ExpectedHandled:   []int64{0, 1, 2, 3},
+			ExpectedCalls:     2,
+			ExpectedCommitted: 4,
+		},
+		{
+			Name:              "Permanent error drops the batch",
+			Fail:              func(offsets []int64, calls int) error { return ErrPermanent },
+			ExpectedCalls:     1,
+			ExpectedCommitted: 4,
+		},
+		{
+			Name:         "Split isolates the failing message",
+			SplitOnError: true,
+			Fail: func(offsets []int64, calls int) error {
+				for _, offset := range offsets {
+					if offset == 2 {
+						return fmt.Errorf("%w: invalid order", ErrPermanent)
+					}
+				}
+				return nil
+			},
+			ExpectedHandled:   []int64{0, 1, 3},
+			ExpectedCalls:     5,
+			ExpectedCommitted: 4,
+		},
+		{
+			Name:              "One invalid record among valid ones",
+			Rules:             []FieldRule{{Field: "id", OneOf: []string{"0", "1", "3"}}},
+			Fail:              func(offsets []int64, calls int) error { return nil },
+			ExpectedHandled:   []int64{0, 1, 3},
+			ExpectedCalls:     1,
+			ExpectedCommitted: 4,
+		},
+	}
+
+	for _, tc := range testcases {
+		var handled []int64
+		var calls int
+
+		topic.Rules = tc.Rules
+		h := &batchGroupHandler{
+			handler: BatchRouteHandler{
+				Name:         "orders",
+				SplitOnError: tc.SplitOnError,
+				HandlerFunc: func(msgs []*message.Message) error {
+					calls++
+
+					offsets := make([]int64, len(msgs))
+					for i, msg := range msgs {
+						fmt.Sscan(msg.Metadata.Get("offset"), &offsets[i])
+					}
+
+					err := tc.Fail(offsets, calls)
+					if err == nil {
+						handled = append(handled, offsets...)
+					}
+					return err
+				},
+			},
+			prepare:   (&MessageBroker{}).prepareChain(topic),
+			unmarshal: kafka.DefaultMarshaler{},
+			logger:    watermill.NopLogger{},
+		}
+
+		batch := make([]*sarama.ConsumerMessage, 4)
+		for i := range batch {
+			data, err := avro.Marshal(topic.Schema, multiTypeOrder{ID: fmt.Sprint(i)})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			batch[i] = &sarama.ConsumerMessage{
+				Topic:  "orders",
+				Offset: int64(i),
+				Value:  append([]byte{0, 0, 0, 0, 1}, data...),
+				Headers: []*sarama.RecordHeader{
+					{Key: []byte(kafka.UUIDHeaderKey), Value: []byte(watermill.NewUUID())},
+					{Key: []byte("offset"), Value: []byte(fmt.Sprint(i))},
+				},
+			}
+		}
+
+		session := &commitSession{}
+		if !h.process(session, batch) {
+			t.Errorf("%s: processed = false, expected true", tc.Name)
+		}
+
+		if fmt.Sprint(handled) != fmt.Sprint(tc.ExpectedHandled) {
+			t.Errorf("%s: handled = %v, expected %v", tc.Name, handled, tc.ExpectedHandled)
+		}
+		if calls != tc.ExpectedCalls {
+			t.Errorf("%s: calls = %d, expected %d", tc.Name, calls, tc.ExpectedCalls)
+		}
+
+		committed, _ := session.state()
+		if committed != tc.ExpectedCommitted {
+			t.Errorf("%s: committed = %d, expected %d", tc.Name, committed, tc.ExpectedCommitted)
+		}
+	}
+}
+
+// TestBatchUndecodable checks an undecodable record is isolated from the rest of the batch instead of retried.
+func TestBatchUndecodable(t *testing.T) {
+	topic := &Topic{
+		Name:   "orders",
+		Schema: avro.MustParse(`{"type":"record","name":"Order","fields":[{"name":"id","type":"string"}]}`),
+	}
+
+	var ids []string
+	h := &batchGroupHandler{
+		handler: BatchRouteHandler{
+			Name:         "orders",
+			SplitOnError: true,
+			HandlerFunc: HandleBatch(topic, func(msgs []*message.Message, records []multiTypeOrder) error {
+				for _, record := range records {
+					ids = append(ids, record.ID)
+				}
+				return nil
+			}),
+		},
+		prepare:   (&MessageBroker{}).prepareChain(topic),
+		unmarshal: kafka.DefaultMarshaler{},
+		logger:    watermill.NopLogger{},
+	}
+
+	batch := make([]*sarama.ConsumerMessage, 4)
+	for i := range batch {
+		data, err := avro.Marshal(topic.Schema, multiTypeOrder{ID: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i == 2 {
+			// A negative string length.
+			data = []byte{0x01}
+		}
+
+		batch[i] = &sarama.ConsumerMessage{
+			Topic:   "orders",
+			Offset:  int64(i),
+			Value:   append([]byte{0, 0, 0, 0, 1}, data...),
+			Headers: []*sarama.RecordHeader{{Key: []byte(kafka.UUIDHeaderKey), Value: []byte(watermill.NewUUID())}},
+		}
+	}
+
+	// Without isolating the record the batch would be retried until the session ends.
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	session := &commitSession{ctx: ctx}
+
+	if !h.process(session, batch) {
+		t.Fatal("processed = false, expected true")
+	}
+
+	if fmt.Sprint(ids) != "[0 1 3]" {
+		t.Errorf("ids = %v, expected [0 1 3]", ids)
+	}
+	if committed, _ := session.state(); committed != 4 {
+		t.Errorf("committed = %d, expected 4", committed)
+	}
+}
+
+func TestHandleBatch(t *testing.T) {
+	topic := &Topic{
+		Name:   "orders",
+		Schema: avro.MustParse(`{"type":"record","name":"Order","fields":[{"name":"id","type":"string"}]}`),
+	}
+
+	msgs := make([]*message.Message, 2)
+	for i := range msgs {
+		data, err := avro.Marshal(topic.Schema, multiTypeOrder{ID: fmt.Sprint(i)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msgs[i] = message.NewMessage(watermill.NewUUID(), append([]byte{0, 0, 0, 0, 1}, data...))
+	}
+
+	var ids []string
+	err := HandleBatch(topic, func(msgs []*message.Message, records []multiTypeOrder) error {
+		for _, record := range records {
+			ids = append(ids, record.ID)
+		}
+		return nil
+	})(msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(ids) != "[0 1]" {
+		t.Errorf("ids = %v, expected [0 1]", ids)
+	}
+}
@@ -0,0 +1,225 @@
+package kafkalistener
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrBlobNotFound error = errors.New("claim-check blob not found")
+
+var (
+	errBlobKey   = errors.New("invalid claim-check key")
+	errTableName = errors.New("invalid table name")
+)
+
+// ClaimCheckKey is the metadata key with the blob store key of an oversized payload.
+const ClaimCheckKey = "claim_check"
+
+var (
+	blobKeyPattern   = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+	tableNamePattern = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+)
+
+// BlobStore keeps the payloads too big to be sent through kafka.
+// Blobs are never deleted by the broker, every consumer group reads them.
+type BlobStore interface {
+	Put(ctx context.Context, key string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+}
+
+// SetClaimCheck stores the payloads bigger than maxBytes in the blob store and publishes
+// a reference message instead, the handlers get the original payload back.
+//
+// It should be called before adding the handlers.
+func (mb *MessageBroker) SetClaimCheck(store BlobStore, maxBytes int) {
+	mb.blobStore = store
+	mb.claimCheckBytes = maxBytes
+}
+
+// claimCheck replaces an oversized payload with its key in the blob store,
+// the blob is stored with the context of the publish.
+func (mb *MessageBroker) claimCheck(ctx context.Context, msg *message.Message) error {
+	if mb.blobStore == nil || len(msg.Payload) <= mb.claimCheckBytes {
+		return nil
+	}
+
+	err := mb.blobStore.Put(ctx, msg.UUID, msg.Payload)
+	if err != nil {
+		return err
+	}
+
+	msg.Metadata.Set(ClaimCheckKey, msg.UUID)
+	msg.Payload = []byte(msg.UUID)
+
+	return nil
+}
+
+// ClaimCheckMiddleware restores the payloads stored in the blob store before the handler runs.
+//
+// It's added to every handler when the broker has a claim-check store.
+func ClaimCheckMiddleware(store BlobStore) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			key := msg.Metadata.Get(ClaimCheckKey)
+			if key == "" {
+				return h(msg)
+			}
+
+			payload, err := store.Get(msg.Context(), key)
+			if err != nil {
+				return nil, err
+			}
+
+			msg.Payload = payload
+			return h(msg)
+		}
+	}
+}
+
+// FileBlobStore keeps the blobs as files of a directory.
+type FileBlobStore struct {
+	dir string
+}
+
+// NewFileBlobStore creates the directory of the blobs if it doesn't exist.
+func NewFileBlobStore(dir string) (*FileBlobStore, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileBlobStore{dir: dir}, nil
+}
+
+func (s *FileBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	if !blobKeyPattern.MatchString(key) {
+		return errBlobKey
+	}
+
+	// Write to a temporary file so readers never see partial blobs.
+	tmp := filepath.Join(s.dir, "."+key+".tmp")
+	err := os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, filepath.Join(s.dir, key))
+}
+
+func (s *FileBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	if !blobKeyPattern.MatchString(key) {
+		return nil, errBlobKey
+	}
+
+	data, err := os.ReadFile(filepath.Join(s.dir, key))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+
+	return data, err
+}
+
+// SQLBlobStore keeps the blobs in a table of a database
+// created with the database package.
+type SQLBlobStore struct {
+	db      *sqlx.DB
+	queries sqlBlobQueries
+}
+
+// sqlBlobQueries are the statements of a SQLBlobStore in the dialect of the driver.
+type sqlBlobQueries struct {
+	// exists counts the tables named like the blobs table, create is empty when the table must exist.
+	exists string
+	create string
+	insert string
+	get    string
+}
+
+// blobQueries returns the statements of the blobs table for the drivers of the database package.
+func blobQueries(driver, table string) sqlBlobQueries {
+	switch driver {
+	case "oracle":
+		// Oracle has neither CREATE TABLE IF NOT EXISTS nor ? placeholders.
+		return sqlBlobQueries{
+			exists: fmt.Sprintf("SELECT COUNT(*) FROM user_tables WHERE table_name = '%s'", strings.ToUpper(table)),
+			create: fmt.Sprintf("CREATE TABLE %s (id VARCHAR2(64) PRIMARY KEY, data BLOB NOT NULL, created_at TIMESTAMP NOT NULL)", table),
+			insert: fmt.Sprintf("INSERT INTO %s (id, data, created_at) VALUES (:1, :2, CURRENT_TIMESTAMP)", table),
+			get:    fmt.Sprintf("SELECT data FROM %s WHERE id = :1", table),
+		}
+	case "mysql":
+		// BLOB holds up to 64KB in MySQL.
+		return sqlBlobQueries{
+			create: fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) PRIMARY KEY, data LONGBLOB NOT NULL, created_at TIMESTAMP NOT NULL)", table),
+			insert: fmt.Sprintf("INSERT INTO %s (id, data, created_at) VALUES (?, ?, CURRENT_TIMESTAMP)", table),
+			get:    fmt.Sprintf("SELECT data FROM %s WHERE id = ?", table),
+		}
+	case "sqlite3":
+		return sqlBlobQueries{
+			create: fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id VARCHAR(64) PRIMARY KEY, data BLOB NOT NULL, created_at TIMESTAMP NOT NULL)", table),
+			insert: fmt.Sprintf("INSERT INTO %s (id, data, created_at) VALUES (?, ?, CURRENT_TIMESTAMP)", table),
+			get:    fmt.Sprintf("SELECT data FROM %s WHERE id = ?", table),
+		}
+	}
+
+	return sqlBlobQueries{
+		insert: sqlx.Rebind(sqlx.BindType(driver), fmt.Sprintf("INSERT INTO %s (id, data, created_at) VALUES (?, ?, CURRENT_TIMESTAMP)", table)),
+		get:    sqlx.Rebind(sqlx.BindType(driver), fmt.Sprintf("SELECT data FROM %s WHERE id = ?", table)),
+	}
+}
+
+// NewSQLBlobStore creates the table of the blobs if it doesn't exist with the sqlite, mysql and
+// oracle drivers of the database package. With other drivers the table must exist, with the
+// id (up to 64 characters), data (binary) and created_at (timestamp) columns.
+//
+// Object storage like S3 isn't provided, it can be plugged in implementing BlobStore.
+func NewSQLBlobStore(ctx context.Context, db *sqlx.DB, table string) (*SQLBlobStore, error) {
+	if !tableNamePattern.MatchString(table) {
+		return nil, errTableName
+	}
+
+	queries := blobQueries(db.DriverName(), table)
+
+	create := queries.create != ""
+	if create && queries.exists != "" {
+		var count int
+		err := db.GetContext(ctx, &count, queries.exists)
+		if err != nil {
+			return nil, err
+		}
+		create = count == 0
+	}
+
+	if create {
+		_, err := db.ExecContext(ctx, queries.create)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &SQLBlobStore{db: db, queries: queries}, nil
+}
+
+func (s *SQLBlobStore) Put(ctx context.Context, key string, data []byte) error {
+	_, err := s.db.ExecContext(ctx, s.queries.insert, key, data)
+	return err
+}
+
+func (s *SQLBlobStore) Get(ctx context.Context, key string) ([]byte, error) {
+	var data []byte
+
+	err := s.db.GetContext(ctx, &data, s.queries.get, key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("%w: %s", ErrBlobNotFound, key)
+	}
+
+	return data, err
+}
@@ -0,0 +1,153 @@
+package kafkalistener
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/jmoiron/sqlx"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+func TestClaimCheck(t *testing.T) {
+	fileStore, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sqlStore, err := NewSQLBlobStore(context.Background(), db, "claim_checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		Name  string
+		Store BlobStore
+	}{
+		{Name: "File store", Store: fileStore},
+		{Name: "SQL store", Store: sqlStore},
+	}
+
+	for _, tc := range testcases {
+		mb := &MessageBroker{}
+		mb.SetClaimCheck(tc.Store, 8)
+
+		small := message.NewMessage("small", []byte("payload"))
+		big := message.NewMessage("big", bytes.Repeat([]byte("document"), 8))
+		original := append([]byte{}, big.Payload...)
+
+		for _, msg := range []*message.Message{small, big} {
+			if err := mb.claimCheck(context.Background(), msg); err != nil {
+				t.Fatalf("%s: error = %v", tc.Name, err)
+			}
+		}
+
+		if small.Metadata.Get(ClaimCheckKey) != "" || big.Metadata.Get(ClaimCheckKey) != "big" || string(big.Payload) != "big" {
+			t.Errorf("%s: small = %v, big = %v %q", tc.Name, small.Metadata, big.Metadata, big.Payload)
+		}
+
+		var received []byte
+		handler := ClaimCheckMiddleware(tc.Store)(func(msg *message.Message) ([]*message.Message, error) {
+			received = msg.Payload
+			return nil, nil
+		})
+
+		if _, err := handler(big); err != nil || !bytes.Equal(received, original) {
+			t.Errorf("%s: received = %q, error = %v", tc.Name, received, err)
+		}
+
+		_, err := tc.Store.Get(context.Background(), "missing")
+		if !errors.Is(err, ErrBlobNotFound) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, ErrBlobNotFound)
+		}
+	}
+}
+
+func TestClaimCheckContext(t *testing.T) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	store, err := NewSQLBlobStore(context.Background(), db, "claim_checks")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mb := &MessageBroker{}
+	mb.SetClaimCheck(store, 8)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	msg := message.NewMessage("big", bytes.Repeat([]byte("document"), 8))
+	err = mb.claimCheck(ctx, msg)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("error = %v, expected %v", err, context.Canceled)
+	}
+
+	_, err = store.Get(context.Background(), "big")
+	if !errors.Is(err, ErrBlobNotFound) {
+		t.Errorf("get error = %v, expected %v", err, ErrBlobNotFound)
+	}
+}
+
+func TestBlobQueries(t *testing.T) {
+	testcases := []struct {
+		Name   string
+		Driver string
+		// Expected are substrings of the create and insert statements.
+		ExpectedCreate string
+		ExpectedInsert string
+		ExpectedExists bool
+	}{
+		{
+			Name:           "Oracle",
+			Driver:         "oracle",
+			ExpectedCreate: "CREATE TABLE claim_checks (id VARCHAR2(64)",
+			ExpectedInsert: "VALUES (:1, :2,",
+			ExpectedExists: true,
+		},
+		{
+			Name:           "MySQL",
+			Driver:         "mysql",
+			ExpectedCreate: "data LONGBLOB",
+			ExpectedInsert: "VALUES (?, ?,",
+		},
+		{
+			Name:           "SQLite",
+			Driver:         "sqlite3",
+			ExpectedCreate: "CREATE TABLE IF NOT EXISTS claim_checks",
+			ExpectedInsert: "VALUES (?, ?,",
+		},
+		{
+			Name:           "Other drivers need the table",
+			Driver:         "postgres",
+			ExpectedInsert: "VALUES ($1, $2,",
+		},
+	}
+
+	for _, tc := range testcases {
+		queries := blobQueries(tc.Driver, "claim_checks")
+
+		if !strings.Contains(queries.create, tc.ExpectedCreate) || (queries.create == "") != (tc.ExpectedCreate == "") {
+			t.Errorf("%s: create = %s, expected %s", tc.Name, queries.create, tc.ExpectedCreate)
+		}
+		if !strings.Contains(queries.insert, tc.ExpectedInsert) {
+			t.Errorf("%s: insert = %s, expected %s", tc.Name, queries.insert, tc.ExpectedInsert)
+		}
+		if (queries.exists != "") != tc.ExpectedExists {
+			t.Errorf("%s: exists = %s, expected %v", tc.Name, queries.exists, tc.ExpectedExists)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+var ErrUnknownCluster error = errors.New("kafka cluster is not defined")
+
+// Clusters groups several named message brokers so a single service
+// can consume from and publish to more than one kafka cluster.
+type Clusters struct {
+	brokers map[string]*MessageBroker
+}
+
+// ClusterRouteHandler is a RouteHandler bound to a named cluster.
+type ClusterRouteHandler struct {
+	Cluster string
+	RouteHandler
+}
+
+// NewClusters creates a message broker for every cluster configuration,
+// each one keeps its own TLS, schema-registry and consumer group.
+// The brokers are created in the order of their names, when one fails the ones
+// already created are closed.
+func NewClusters(
+	ctx context.Context,
+	configs map[string]*KafkaConfig,
+	debug bool,
+) (*Clusters, error) {
+	clusters := &Clusters{brokers: make(map[string]*MessageBroker, len(configs))}
+
+	names := make([]string, 0, len(configs))
+	for name, config := range configs {
+		if config == nil {
+			return nil, fmt.Errorf("cluster %s: nil config", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		mb, err := New(ctx, configs[name], debug)
+		if err != nil {
+			return nil, errors.Join(fmt.Errorf("cluster %s: %w", name, err), clusters.close())
+		}
+
+		clusters.brokers[name] = mb
+	}
+
+	return clusters, nil
+}
+
+// close closes the router and the producers of every cluster.
+func (c *Clusters) close() error {
+	var errs []error
+	for name, mb := range c.brokers {
+		err := mb.close()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Broker returns the message broker of the given cluster.
+func (c *Clusters) Broker(cluster string) (*MessageBroker, error) {
+	mb, ok := c.brokers[cluster]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownCluster, cluster)
+	}
+
+	return mb, nil
+}
+
+// Names returns the sorted names of the clusters.
+func (c *Clusters) Names() []string {
+	names := make([]string, 0, len(c.brokers))
+	for name := range c.brokers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Publish publishes the data into a topic of the given cluster.
+func (c *Clusters) Publish(cluster string, topic *Topic, data interface{}) error {
+	mb, err := c.Broker(cluster)
+	if err != nil {
+		return err
+	}
+
+	return mb.Publish(topic, data)
+}
+
+// PublishContext publishes the data into a topic of the given cluster until the context is done,
+// like the PublishContext of the message broker.
+func (c *Clusters) PublishContext(ctx context.Context, cluster string, topic *Topic, data interface{}) error {
+	mb, err := c.Broker(cluster)
+	if err != nil {
+		return err
+	}
+
+	return mb.PublishContext(ctx, topic, data)
+}
+
+// SetRetry sets the same retry policy on the router of every cluster.
+func (c *Clusters) SetRetry(retry *Retry) {
+	for _, mb := range c.brokers {
+		mb.SetRetry(retry)
+	}
+}
+
+// Listen starts the router of every cluster that has handlers. This call is blocking
+// while the routers are running, when one of them stops the others are stopped too.
+//
+// To stop Listen() you should call Stop().
+func (c *Clusters) Listen(ctx context.Context, handlers []ClusterRouteHandler) error {
+	routes := make(map[string][]RouteHandler)
+	for _, h := range handlers {
+		if _, ok := c.brokers[h.Cluster]; !ok {
+			return fmt.Errorf("%w: %s", ErrUnknownCluster, h.Cluster)
+		}
+
+		routes[h.Cluster] = append(routes[h.Cluster], h.RouteHandler)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, len(routes))
+
+	for cluster, clusterHandlers := range routes {
+		wg.Add(1)
+		go func(cluster string, mb *MessageBroker, clusterHandlers []RouteHandler) {
+			defer wg.Done()
+
+			err := mb.Listen(ctx, clusterHandlers)
+			if err != nil {
+				err = fmt.Errorf("cluster %s: %w", cluster, err)
+			}
+
+			errs <- err
+		}(cluster, c.brokers[cluster], clusterHandlers)
+	}
+
+	// The first router to return takes down the rest of them.
+	var err error
+	if len(routes) > 0 {
+		err = <-errs
+		stopErr := c.Stop()
+		if err == nil {
+			err = stopErr
+		}
+	}
+
+	wg.Wait()
+
+	return err
+}
+
+// Stop gracefully closes the routers of every cluster.
+func (c *Clusters) Stop() error {
+	var errs []error
+	for name, mb := range c.brokers {
+		err := mb.Stop()
+		if err != nil {
+			errs = append(errs, fmt.Errorf("cluster %s: %w", name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,247 @@
+package kafkalistener
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+var ErrNotAssigned error = errors.New("partition is not assigned to this instance, the offset can't be committed")
+
+// CommitMode is how the offsets of the consumed messages are committed.
+//
+// Every mode is at-least-once: only the offsets of acked messages are committed,
+// the messages acked after the last commit are consumed again after a restart or a rebalance.
+type CommitMode string
+
+const (
+	// CommitAuto commits the acked messages every AutoCommit.Interval of sarama, one second by default.
+	CommitAuto CommitMode = "auto"
+	// CommitAck commits every message as soon as it's acked.
+	CommitAck CommitMode = "ack"
+	// CommitBatch commits after Every acked messages or after Interval, whatever happens first.
+	// Without any of them it commits like CommitAuto.
+	CommitBatch CommitMode = "batch"
+	// CommitManual only commits the offsets committed by the handlers with CommitMessage.
+	CommitManual CommitMode = "manual"
+	// CommitTransactional only commits the offsets marked in the transactions of PublishTx with MarkConsumed,
+	// the acks don't commit anything so the offsets are never committed outside a transaction.
+	CommitTransactional CommitMode = "transactional"
+)
+
+// CommitPolicy sets the commit mode of the consumer groups, an empty mode is CommitAuto.
+type CommitPolicy struct {
+	Mode     CommitMode    `yaml:"mode"`
+	Every    int           `yaml:"every"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// CommitMessage commits the offset of a message consumed by a handler with CommitManual,
+// the offsets of the previous messages of the partition are committed too.
+func (mb *MessageBroker) CommitMessage(msg *message.Message) error {
+	handler := message.HandlerNameFromCtx(msg.Context())
+	topic := message.SubscribeTopicFromCtx(msg.Context())
+	partition, okPartition := kafka.MessagePartitionFromCtx(msg.Context())
+	offset, okOffset := kafka.MessagePartitionOffsetFromCtx(msg.Context())
+	if !okPartition || !okOffset {
+		return errMissingOffset
+	}
+
+	return mb.commitOffset(handler, topic, partition, offset)
+}
+
+// commitOffset commits an offset in the group session of the handler.
+func (mb *MessageBroker) commitOffset(handler, topic string, partition int32, offset int64) error {
+	c := mb.committer(handler)
+	if c == nil || c.Context().Err() != nil {
+		return ErrNotAssigned
+	}
+
+	c.ConsumerGroupSession.MarkOffset(topic, partition, offset+1, "")
+	c.ConsumerGroupSession.Commit()
+	return nil
+}
+
+// commitPolicy returns the policy of the route handler, or the default one.
+func (mb *MessageBroker) commitPolicy(handler string) CommitPolicy {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	if r, ok := mb.routes[handler]; ok && r.handler.Commit != nil {
+		return *r.handler.Commit
+	}
+
+	return mb.commit
+}
+
+// startCommitter creates the committer of the group session of a handler with its policy.
+func (mb *MessageBroker) startCommitter(handler string, session sarama.ConsumerGroupSession) {
+	if len(session.Claims()) == 0 {
+		return
+	}
+
+	autoInterval := time.Second
+	if mb.subscriberConfig.OverwriteSaramaConfig != nil {
+		autoInterval = mb.subscriberConfig.OverwriteSaramaConfig.Consumer.Offsets.AutoCommit.Interval
+	}
+
+	c := newCommitter(session, mb.commitPolicy(handler), autoInterval)
+
+	mb.assignmentMu.Lock()
+	defer mb.assignmentMu.Unlock()
+
+	if mb.committers == nil {
+		mb.committers = make(map[string]*committer)
+	}
+	mb.committers[handler] = c
+}
+
+// committerSaramaConfig returns the sarama config of the consumer groups whose sessions get a committer,
+// with the auto commit of sarama disabled. The other subscribers keep committing with it.
+func (mb *MessageBroker) committerSaramaConfig() *sarama.Config {
+	saramaConfig := kafka.DefaultSaramaSubscriberConfig()
+	if mb.subscriberConfig.OverwriteSaramaConfig != nil {
+		config := *mb.subscriberConfig.OverwriteSaramaConfig
+		saramaConfig = &config
+	}
+	saramaConfig.Consumer.Offsets.AutoCommit.Enable = false
+
+	return saramaConfig
+}
+
+// committer returns the committer of the current session of a handler.
+func (mb *MessageBroker) committer(handler string) *committer {
+	mb.assignmentMu.Lock()
+	defer mb.assignmentMu.Unlock()
+
+	return mb.committers[handler]
+}
+
+// stopCommitter commits the pending offsets of the session of a handler before its partitions are revoked.
+func (mb *MessageBroker) stopCommitter(handler string) {
+	mb.assignmentMu.Lock()
+	c := mb.committers[handler]
+	delete(mb.committers, handler)
+	mb.assignmentMu.Unlock()
+
+	if c != nil {
+		c.close()
+	}
+}
+
+// committer is the group session seen by the watermill subscriber, which marks
+// every acked message and calls Commit right after because sarama's auto commit is disabled.
+// It decides when the marked offsets are really committed.
+type committer struct {
+	sarama.ConsumerGroupSession
+	policy       CommitPolicy
+	autoInterval time.Duration
+
+	mu      sync.Mutex
+	pending int
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCommitter(session sarama.ConsumerGroupSession, policy CommitPolicy, autoInterval time.Duration) *committer {
+	c := &committer{
+		ConsumerGroupSession: session,
+		policy:               policy,
+		autoInterval:         autoInterval,
+		stop:                 make(chan struct{}),
+		done:                 make(chan struct{}),
+	}
+
+	interval := c.interval()
+	if interval <= 0 {
+		close(c.done)
+		return c
+	}
+
+	// The ticker commits the marked offsets when no more messages arrive.
+	go func() {
+		defer close(c.done)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				c.commit()
+			case <-c.stop:
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+func (c *committer) interval() time.Duration {
+	switch c.policy.Mode {
+	case CommitAuto, "":
+		return c.autoInterval
+	case CommitBatch:
+		if c.policy.Every <= 0 && c.policy.Interval <= 0 {
+			return c.autoInterval
+		}
+		return c.policy.Interval
+	}
+
+	return 0
+}
+
+func (c *committer) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	if c.policy.Mode == CommitManual || c.policy.Mode == CommitTransactional {
+		return
+	}
+
+	c.ConsumerGroupSession.MarkMessage(msg, metadata)
+
+	c.mu.Lock()
+	c.pending++
+	c.mu.Unlock()
+}
+
+func (c *committer) Commit() {
+	c.mu.Lock()
+	var due bool
+	switch c.policy.Mode {
+	case CommitAck:
+		due = true
+	case CommitBatch:
+		due = c.policy.Every > 0 && c.pending >= c.policy.Every
+	}
+	c.mu.Unlock()
+
+	if due {
+		c.commit()
+	}
+}
+
+// commit commits the marked offsets, if any.
+func (c *committer) commit() {
+	c.mu.Lock()
+	if c.pending == 0 {
+		c.mu.Unlock()
+		return
+	}
+	c.pending = 0
+	c.mu.Unlock()
+
+	c.ConsumerGroupSession.Commit()
+}
+
+// close stops the ticker and commits the offsets marked since the last commit.
+func (c *committer) close() {
+	close(c.stop)
+	<-c.done
+
+	c.commit()
+}
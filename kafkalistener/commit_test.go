@@ -0,0 +1,204 @@
+package kafkalistener
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// commitSession records the offsets marked and committed, like the offset manager of sarama.
+type commitSession struct {
+	sarama.ConsumerGroupSession
+	// ctx ends the session, it's context.Background when it's nil.
+	ctx context.Context
+
+	mu        sync.Mutex
+	marked    int64
+	committed int64
+	commits   int
+}
+
+func (s *commitSession) Claims() map[string][]int32 {
+	return map[string][]int32{"orders": {0}}
+}
+
+func (s *commitSession) Context() context.Context {
+	if s.ctx != nil {
+		return s.ctx
+	}
+	return context.Background()
+}
+
+func (s *commitSession) MarkMessage(msg *sarama.ConsumerMessage, metadata string) {
+	s.MarkOffset(msg.Topic, msg.Partition, msg.Offset+1, metadata)
+}
+
+func (s *commitSession) MarkOffset(topic string, partition int32, offset int64, metadata string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if offset > s.marked {
+		s.marked = offset
+	}
+}
+
+func (s *commitSession) Commit() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.committed = s.marked
+	s.commits++
+}
+
+func (s *commitSession) state() (int64, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.committed, s.commits
+}
+
+// TestCommitter acks messages the way the watermill subscriber does: every acked message
+// is marked and Commit is called right after. The committed offset never passes the acked messages.
+func TestCommitter(t *testing.T) {
+	testcases := []struct {
+		Name              string
+		Policy            CommitPolicy
+		Acked             int
+		ExpectedCommitted int64
+		ExpectedCommits   int
+		// ExpectedAfterClose is the offset committed before the partitions are revoked.
+		ExpectedAfterClose int64
+	}{
+		{
+			Name:               "Commit on ack",
+			Policy:             CommitPolicy{Mode: CommitAck},
+			Acked:              3,
+			ExpectedCommitted:  3,
+			ExpectedCommits:    3,
+			ExpectedAfterClose: 3,
+		},
+		{
+			Name:               "Commit every 2 messages",
+			Policy:             CommitPolicy{Mode: CommitBatch, Every: 2},
+			Acked:              5,
+			ExpectedCommitted:  4,
+			ExpectedCommits:    2,
+			ExpectedAfterClose: 5,
+		},
+		{
+			Name:               "Auto commit",
+			Policy:             CommitPolicy{},
+			Acked:              3,
+			ExpectedAfterClose: 3,
+		},
+		{
+			Name:   "Manual commit ignores the acks",
+			Policy: CommitPolicy{Mode: CommitManual},
+			Acked:  3,
+		},
+		{
+			Name:   "Transactional commit ignores the acks",
+			Policy: CommitPolicy{Mode: CommitTransactional},
+			Acked:  3,
+		},
+	}
+
+	for _, tc := range testcases {
+		session := &commitSession{}
+		c := newCommitter(session, tc.Policy, time.Hour)
+
+		for offset := 0; offset < tc.Acked; offset++ {
+			c.MarkMessage(&sarama.ConsumerMessage{Topic: "orders", Offset: int64(offset)}, "")
+			c.Commit()
+		}
+
+		committed, commits := session.state()
+		if committed != tc.ExpectedCommitted || commits != tc.ExpectedCommits {
+			t.Errorf("%s: committed = %d in %d commits, expected %d in %d", tc.Name, committed, commits, tc.ExpectedCommitted, tc.ExpectedCommits)
+		}
+
+		c.close()
+		committed, _ = session.state()
+		if committed != tc.ExpectedAfterClose {
+			t.Errorf("%s: committed after close = %d, expected %d", tc.Name, committed, tc.ExpectedAfterClose)
+		}
+	}
+}
+
+func TestCommitterInterval(t *testing.T) {
+	session := &commitSession{}
+	c := newCommitter(session, CommitPolicy{Mode: CommitBatch, Every: 100, Interval: 10 * time.Millisecond}, time.Hour)
+	defer c.close()
+
+	c.MarkMessage(&sarama.ConsumerMessage{Topic: "orders", Offset: 0}, "")
+	c.Commit()
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		committed, _ := session.state()
+		if committed == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("offset not committed after the interval")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestCommitMessage(t *testing.T) {
+	mb := &MessageBroker{commit: CommitPolicy{Mode: CommitManual}}
+	session := &commitSession{}
+
+	msg := message.NewMessage("1", nil)
+	err := mb.CommitMessage(msg)
+	if err != errMissingOffset {
+		t.Errorf("error = %v, expected %v", err, errMissingOffset)
+	}
+
+	handler := rebalanceTracer{mb: mb, handler: "orders-billing"}.WrapConsumerGroupHandler(testGroupHandler{})
+	_ = handler.Setup(session)
+
+	// Another handler of the topic has its own session.
+	other := rebalanceTracer{mb: mb, handler: "orders-emails"}.WrapConsumerGroupHandler(testGroupHandler{})
+	_ = other.Setup(&commitSession{})
+	_ = other.Cleanup(&commitSession{})
+
+	// The router and the subscriber set the handler, topic, partition and offset in the context of the messages.
+	err = mb.commitOffset("orders-billing", "orders", 0, 41)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if committed, _ := session.state(); committed != 42 {
+		t.Errorf("committed = %d, expected 42", committed)
+	}
+
+	_ = handler.Cleanup(session)
+	err = mb.commitOffset("orders-billing", "orders", 0, 41)
+	if err != ErrNotAssigned {
+		t.Errorf("error = %v, expected %v", err, ErrNotAssigned)
+	}
+}
+
+func TestCommitterSaramaConfig(t *testing.T) {
+	saramaConfig := sarama.NewConfig()
+	mb := &MessageBroker{subscriberConfig: kafka.SubscriberConfig{OverwriteSaramaConfig: saramaConfig}}
+
+	// The handlers with a committer commit through it, the other subscribers auto commit.
+	if config := mb.committerSaramaConfig(); config.Consumer.Offsets.AutoCommit.Enable {
+		t.Error("auto commit enabled, expected it disabled for the committers")
+	}
+	if !saramaConfig.Consumer.Offsets.AutoCommit.Enable {
+		t.Error("auto commit disabled, expected it enabled for the other subscribers")
+	}
+
+	mb = &MessageBroker{}
+	if config := mb.committerSaramaConfig(); config.Consumer.Offsets.AutoCommit.Enable {
+		t.Error("auto commit enabled without sarama config, expected it disabled")
+	}
+}
@@ -0,0 +1,19 @@
+package kafkalistener
+
+import (
+	"fmt"
+
+	"github.com/sanservices/kit/config"
+)
+
+// ReadConfig reads the "kafka" section of the config file of the environment,
+// its keys are the yaml names of KafkaConfig.
+func ReadConfig(e config.Env) *KafkaConfig {
+	kafkaConfig := &KafkaConfig{}
+	err := config.ReadKey(e, "kafka", kafkaConfig)
+	if err != nil {
+		panic(fmt.Errorf("fatal error kafka config: %w", err))
+	}
+
+	return kafkaConfig
+}
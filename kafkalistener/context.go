@@ -0,0 +1,88 @@
+package kafkalistener
+
+import (
+	"context"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+type correlationIDKey struct{}
+
+// ContextWithCorrelationID returns a context carrying the correlation id of the messages published with it.
+func ContextWithCorrelationID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, correlationIDKey{}, id)
+}
+
+// CorrelationIDFromContext returns the correlation id set by ContextWithCorrelationID.
+func CorrelationIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(correlationIDKey{}).(string)
+	return id
+}
+
+// PublishContext is Publish returning when the context is done while the schema
+// is looked up or the message is sent.
+//
+// The context bounds how long PublishContext waits, it doesn't cancel the requests already
+// running: the registry lookup and the send of the producer, with its retries, go on in the
+// background. Steps not started yet are skipped, so a message isn't sent after a registry lookup
+// that outlived the context, but a message already handed to the producer may be delivered
+// after PublishContext returned the context error. Callers retrying after a timeout may publish
+// duplicates.
+//
+// The correlation id of the context and its trace, propagated with the global
+// opentelemetry propagator, are set in the message metadata.
+func (mb *MessageBroker) PublishContext(ctx context.Context, topic *Topic, data interface{}) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if mb.publisher == nil {
+		return ErrPublishOnConsumeOnly
+	}
+
+	err := ctx.Err()
+	if err != nil {
+		return err
+	}
+
+	msg, err := mb.newMessage(ctx, topic, data)
+	if err != nil {
+		return err
+	}
+
+	return mb.publishChain(mb.publish)(topic, msg)
+}
+
+// setMessageContext attaches the context to the message with its correlation id and trace.
+func setMessageContext(ctx context.Context, msg *message.Message) {
+	msg.SetContext(ctx)
+
+	if id := CorrelationIDFromContext(ctx); id != "" {
+		middleware.SetCorrelationID(id, msg)
+	}
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.MapCarrier(msg.Metadata))
+}
+
+// runContext runs fn until the context is done. fn can't be interrupted, it keeps running
+// in the background after it, so it should check the context before the steps it can skip.
+func runContext(ctx context.Context, fn func() error) error {
+	if ctx.Done() == nil {
+		return fn()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
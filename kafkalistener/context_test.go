@@ -0,0 +1,152 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestRunContext(t *testing.T) {
+	errSend := errors.New("send failed")
+
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	live, cancelLive := context.WithTimeout(context.Background(), time.Minute)
+	defer cancelLive()
+
+	testcases := []struct {
+		Name          string
+		Ctx           context.Context
+		Fn            func() error
+		ExpectedError error
+	}{
+		{
+			Name: "Without deadline",
+			Ctx:  context.Background(),
+			Fn:   func() error { return errSend },
+
+			ExpectedError: errSend,
+		},
+		{
+			Name: "Finished before the deadline",
+			Ctx:  live,
+			Fn:   func() error { return nil },
+		},
+		{
+			Name: "Canceled",
+			Ctx:  canceled,
+			Fn: func() error {
+				time.Sleep(time.Second)
+				return nil
+			},
+
+			ExpectedError: context.Canceled,
+		},
+	}
+
+	for _, tc := range testcases {
+		err := runContext(tc.Ctx, tc.Fn)
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+	}
+}
+
+func TestSetMessageContext(t *testing.T) {
+	previous := otel.GetTextMapPropagator()
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	defer otel.SetTextMapPropagator(previous)
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	spanCtx := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+	})
+
+	ctx := trace.ContextWithSpanContext(context.Background(), spanCtx)
+	ctx = ContextWithCorrelationID(ctx, "correlation")
+
+	msg := message.NewMessage("uuid", nil)
+	setMessageContext(ctx, msg)
+
+	if msg.Context() != ctx {
+		t.Error("message context not set")
+	}
+
+	if id := middleware.MessageCorrelationID(msg); id != "correlation" {
+		t.Errorf("correlation id = %s, expected correlation", id)
+	}
+
+	expected := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	if traceparent := msg.Metadata.Get("traceparent"); traceparent != expected {
+		t.Errorf("traceparent = %s, expected %s", traceparent, expected)
+	}
+}
+
+// slowRegistry answers after the delay, like a registry during an outage.
+type slowRegistry struct {
+	registry.Registry
+	delay   time.Duration
+	created atomic.Int32
+}
+
+func (r *slowRegistry) IsRegistered(subject, schema string) (int, avro.Schema, error) {
+	time.Sleep(r.delay)
+	return 0, nil, registry.Error{StatusCode: 404}
+}
+
+func (r *slowRegistry) CreateSchema(subject, schema string, references ...registry.SchemaReference) (int, avro.Schema, error) {
+	r.created.Add(1)
+	return 1, nil, nil
+}
+
+// countingPublisher counts the published messages.
+type countingPublisher struct {
+	message.Publisher
+	published atomic.Int32
+}
+
+func (p *countingPublisher) Publish(topic string, messages ...*message.Message) error {
+	p.published.Add(int32(len(messages)))
+	return nil
+}
+
+// TestPublishContextDeadline checks the steps not started when the context is done are skipped,
+// the message isn't sent after a registry lookup that outlived the deadline.
+func TestPublishContextDeadline(t *testing.T) {
+	reg := &slowRegistry{delay: 100 * time.Millisecond}
+	publisher := &countingPublisher{}
+	mb := &MessageBroker{enabled: true, registryClient: reg, publisher: publisher}
+
+	topic := &Topic{
+		Name:      "orders",
+		RawSchema: `{"type":"record","name":"Order","fields":[{"name":"id","type":"string"}]}`,
+	}
+	topic.Schema = avro.MustParse(topic.RawSchema)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err := mb.PublishContext(ctx, topic, map[string]interface{}{"id": "1"})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("error = %v, expected %v", err, context.DeadlineExceeded)
+	}
+
+	time.Sleep(2 * reg.delay)
+	if created, published := reg.created.Load(), publisher.published.Load(); created != 0 || published != 0 {
+		t.Errorf("created = %d, published = %d, expected 0 0", created, published)
+	}
+}
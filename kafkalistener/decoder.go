@@ -1,6 +1,7 @@
 package kafkalistener
 
 import (
+	"encoding/binary"
 	"errors"
 	"time"
 
@@ -11,6 +12,9 @@ import (
 var (
 	errParseDate        = errors.New("unable to parse date")
 	errNoSchemaProvided = errors.New("avro schema not provided")
+	errNotARecord       = errors.New("avro schema is not a record")
+	errShortPayload     = errors.New("payload is shorter than the schema id header")
+	errMagicByte        = errors.New("payload does not start with the magic byte")
 )
 
 const SimpleDateLayout string = "2006-01-02"
@@ -41,3 +45,65 @@ func DecodePayload(topic *Topic, payload message.Payload, v interface{}) error {
 	// that corresponds to the kafka schema Id.
 	return avro.Unmarshal(topic.Schema, payload[5:], v)
 }
+
+// DecodeMap decodes a message payload into a generic map.
+//
+// Logical types, including the kafka connect ones, are converted into time.Time,
+// time.Duration and *big.Rat values, and unions hold the value of their branch.
+func DecodeMap(topic *Topic, payload message.Payload) (map[string]interface{}, error) {
+	if topic.Schema == nil {
+		return nil, errNoSchemaProvided
+	}
+
+	if len(payload) < 5 {
+		return nil, errShortPayload
+	}
+
+	return decodeMap(topic, payload[5:])
+}
+
+func decodeMap(topic *Topic, data []byte) (map[string]interface{}, error) {
+	var v interface{}
+	err := avro.Unmarshal(topic.Schema, data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	record, ok := nativeValue(topic.Schema, v, localTimestamps(topic)).(map[string]interface{})
+	if !ok {
+		return nil, errNotARecord
+	}
+
+	return record, nil
+}
+
+// SchemaID returns the schema-registry id a payload was written with.
+func SchemaID(payload message.Payload) (int, error) {
+	if len(payload) < 5 {
+		return 0, errShortPayload
+	}
+
+	if payload[0] != 0 {
+		return 0, errMagicByte
+	}
+
+	return int(binary.BigEndian.Uint32(payload[1:5])), nil
+}
+
+// ResolveSchema returns the schema a payload was written with, looking up its id in the schema-registry.
+func (mb *MessageBroker) ResolveSchema(payload message.Payload) (avro.Schema, error) {
+	if !mb.enabled {
+		return nil, ErrBrokerNotEnabled
+	}
+
+	if mb.localDir != "" {
+		return nil, ErrLocalMode
+	}
+
+	id, err := SchemaID(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	return mb.registryClient.GetSchema(id)
+}
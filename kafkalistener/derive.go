@@ -0,0 +1,340 @@
+package kafkalistener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hamba/avro"
+)
+
+var (
+	errNotAStruct      = errors.New("value is not a struct")
+	errUnsupportedType = errors.New("go type is not supported in avro schemas")
+	errDecimalTag      = errors.New(`decimal fields need a decimal:"precision,scale" tag`)
+)
+
+var (
+	timeType     = reflect.TypeOf(time.Time{})
+	durationType = reflect.TypeOf(time.Duration(0))
+	ratType      = reflect.TypeOf(big.Rat{})
+)
+
+// fieldTags are the struct tags read when deriving a schema.
+type fieldTags struct {
+	doc     string
+	dflt    string
+	hasDflt bool
+	enum    []string
+	decimal string
+}
+
+type schemaDeriver struct {
+	namespace string
+	// defined has the records already written, they are referenced by name afterwards.
+	defined map[reflect.Type]bool
+	// named has the enums and fixed already written.
+	named map[string]bool
+}
+
+// DeriveSchema returns the avro schema of a struct, using the same field names
+// hamba/avro uses to encode it: the avro tag or the go field name.
+//
+// int is an avro int, the only type hamba/avro encodes it into, and int64 a long.
+// Pointers are nullable unions with a null default, time.Time is a timestamp-millis,
+// time.Duration a time-micros and big.Rat a decimal. The doc, default, enum
+// ("A,B,C" symbols of a string field) and decimal ("precision,scale") struct tags
+// complete the fields, and fields tagged with avro:"-" are skipped.
+func DeriveSchema(v interface{}, namespace string) (string, error) {
+	typ := reflect.TypeOf(v)
+	for typ != nil && typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+
+	if typ == nil || typ.Kind() != reflect.Struct || typ == timeType || typ == ratType {
+		return "", errNotAStruct
+	}
+
+	d := &schemaDeriver{namespace: namespace, defined: make(map[reflect.Type]bool), named: make(map[string]bool)}
+	schema, err := d.record(typ, typ.Name())
+	if err != nil {
+		return "", err
+	}
+
+	raw, err := json.Marshal(schema)
+	if err != nil {
+		return "", err
+	}
+
+	// Parse the schema to validate the names and defaults.
+	_, err = avro.ParseWithCache(string(raw), "", &avro.SchemaCache{})
+	if err != nil {
+		return "", err
+	}
+
+	return string(raw), nil
+}
+
+// DeriveTopic returns a topic with the schema derived from a struct,
+// ready to be registered by SetSchema.
+func DeriveTopic(name string, v interface{}, namespace string) (*Topic, error) {
+	schema, err := DeriveSchema(v, namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Topic{Name: name, RawSchema: schema, RegisterSchema: true}, nil
+}
+
+func (d *schemaDeriver) record(typ reflect.Type, name string) (interface{}, error) {
+	if d.defined[typ] {
+		return d.fullName(name), nil
+	}
+	d.defined[typ] = true
+
+	fields, err := d.fields(typ)
+	if err != nil {
+		return nil, err
+	}
+
+	record := map[string]interface{}{
+		"type":   "record",
+		"name":   name,
+		"fields": fields,
+	}
+	if d.namespace != "" {
+		record["namespace"] = d.namespace
+	}
+
+	return record, nil
+}
+
+func (d *schemaDeriver) fields(typ reflect.Type) ([]interface{}, error) {
+	fields := []interface{}{}
+	for i := 0; i < typ.NumField(); i++ {
+		sf := typ.Field(i)
+
+		// Embedded structs are flattened like hamba/avro does.
+		if sf.Anonymous {
+			embedded := sf.Type
+			if embedded.Kind() == reflect.Ptr {
+				embedded = embedded.Elem()
+			}
+			if embedded.Kind() != reflect.Struct {
+				continue
+			}
+
+			nested, err := d.fields(embedded)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, nested...)
+			continue
+		}
+
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		name := sf.Name
+		if tag, ok := sf.Tag.Lookup("avro"); ok {
+			name = tag
+		}
+		if name == "-" {
+			continue
+		}
+
+		tags := fieldTags{doc: sf.Tag.Get("doc"), decimal: sf.Tag.Get("decimal")}
+		tags.dflt, tags.hasDflt = sf.Tag.Lookup("default")
+		if enum := sf.Tag.Get("enum"); enum != "" {
+			tags.enum = strings.Split(enum, ",")
+		}
+
+		field, err := d.field(sf, name, tags)
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s: %w", typ.Name(), sf.Name, err)
+		}
+		fields = append(fields, field)
+	}
+
+	return fields, nil
+}
+
+func (d *schemaDeriver) field(sf reflect.StructField, name string, tags fieldTags) (map[string]interface{}, error) {
+	field := map[string]interface{}{"name": name}
+	if tags.doc != "" {
+		field["doc"] = tags.doc
+	}
+
+	typ := sf.Type
+	if typ.Kind() != reflect.Ptr {
+		schema, err := d.schemaOf(typ, sf.Name, tags)
+		if err != nil {
+			return nil, err
+		}
+		field["type"] = schema
+
+		if tags.hasDflt {
+			dflt, err := defaultValue(typ, tags.dflt)
+			if err != nil {
+				return nil, err
+			}
+			field["default"] = dflt
+		}
+
+		return field, nil
+	}
+
+	schema, err := d.schemaOf(typ.Elem(), sf.Name, tags)
+	if err != nil {
+		return nil, err
+	}
+
+	// The default of a union has to be of its first type.
+	if !tags.hasDflt || tags.dflt == "null" {
+		field["type"] = []interface{}{"null", schema}
+		field["default"] = nil
+		return field, nil
+	}
+
+	dflt, err := defaultValue(typ.Elem(), tags.dflt)
+	if err != nil {
+		return nil, err
+	}
+	field["type"] = []interface{}{schema, "null"}
+	field["default"] = dflt
+
+	return field, nil
+}
+
+// schemaOf returns the avro schema of a go type, name is used for the anonymous records.
+func (d *schemaDeriver) schemaOf(typ reflect.Type, name string, tags fieldTags) (interface{}, error) {
+	switch typ {
+	case timeType:
+		return map[string]interface{}{"type": "long", "logicalType": "timestamp-millis"}, nil
+	case durationType:
+		return map[string]interface{}{"type": "long", "logicalType": "time-micros"}, nil
+	case ratType:
+		precision, scale, err := decimalTag(tags.decimal)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "bytes", "logicalType": "decimal", "precision": precision, "scale": scale}, nil
+	}
+
+	switch typ.Kind() {
+	case reflect.Bool:
+		return "boolean", nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32:
+		return "int", nil
+	case reflect.Int64:
+		return "long", nil
+	case reflect.Float32:
+		return "float", nil
+	case reflect.Float64:
+		return "double", nil
+
+	case reflect.String:
+		if len(tags.enum) == 0 {
+			return "string", nil
+		}
+
+		enumName := typ.Name()
+		if enumName == "" || enumName == "string" {
+			enumName = name
+		}
+		if d.named[enumName] {
+			return d.fullName(enumName), nil
+		}
+		d.named[enumName] = true
+		return map[string]interface{}{"type": "enum", "name": enumName, "symbols": tags.enum}, nil
+
+	case reflect.Slice:
+		if typ.Elem().Kind() == reflect.Uint8 {
+			return "bytes", nil
+		}
+
+		items, err := d.schemaOf(typ.Elem(), name, tags)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "array", "items": items}, nil
+
+	case reflect.Array:
+		if typ.Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		if d.named[name] {
+			return d.fullName(name), nil
+		}
+		d.named[name] = true
+		return map[string]interface{}{"type": "fixed", "name": name, "size": typ.Len()}, nil
+
+	case reflect.Map:
+		if typ.Key().Kind() != reflect.String {
+			break
+		}
+
+		values, err := d.schemaOf(typ.Elem(), name, tags)
+		if err != nil {
+			return nil, err
+		}
+		return map[string]interface{}{"type": "map", "values": values}, nil
+
+	case reflect.Struct:
+		recordName := typ.Name()
+		if recordName == "" {
+			recordName = name
+		}
+		return d.record(typ, recordName)
+	}
+
+	return nil, fmt.Errorf("%w: %s", errUnsupportedType, typ)
+}
+
+func (d *schemaDeriver) fullName(name string) string {
+	if d.namespace == "" {
+		return name
+	}
+	return d.namespace + "." + name
+}
+
+// defaultValue converts a default tag into the json value of the field type.
+func defaultValue(typ reflect.Type, dflt string) (interface{}, error) {
+	switch {
+	case typ.Kind() == reflect.String, typ.Kind() == reflect.Slice && typ.Elem().Kind() == reflect.Uint8:
+		return dflt, nil
+	case typ == ratType:
+		return nil, fmt.Errorf("%w: decimals have no default", errUnsupportedType)
+	}
+
+	var v interface{}
+	err := json.Unmarshal([]byte(dflt), &v)
+	if err != nil {
+		return nil, fmt.Errorf("invalid default %q: %w", dflt, err)
+	}
+	return v, nil
+}
+
+func decimalTag(tag string) (int, int, error) {
+	precisionTag, scaleTag, ok := strings.Cut(tag, ",")
+	if !ok {
+		return 0, 0, errDecimalTag
+	}
+
+	precision, err := strconv.Atoi(strings.TrimSpace(precisionTag))
+	if err != nil {
+		return 0, 0, errDecimalTag
+	}
+	scale, err := strconv.Atoi(strings.TrimSpace(scaleTag))
+	if err != nil {
+		return 0, 0, errDecimalTag
+	}
+
+	return precision, scale, nil
+}
@@ -0,0 +1,124 @@
+package kafkalistener
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro"
+)
+
+type derivedRoom struct {
+	Number int32  `avro:"number"`
+	View   string `avro:"view" enum:"SEA,GARDEN"`
+}
+
+type derivedAudit struct {
+	CreatedBy string `avro:"created_by"`
+}
+
+type derivedStay struct {
+	Nights int `avro:"nights"`
+}
+
+type derivedReservation struct {
+	derivedAudit
+	ID        int64         `avro:"id" doc:"Reservation number."`
+	Guest     *string       `avro:"guest"`
+	Nights    int           `avro:"nights" default:"1"`
+	Channel   *string       `avro:"channel" default:"web"`
+	Created   time.Time     `avro:"created"`
+	Duration  time.Duration `avro:"duration"`
+	Amount    *big.Rat      `avro:"amount" decimal:"10,2"`
+	Rooms     []derivedRoom `avro:"rooms"`
+	Extras    map[string]float64
+	Signature [4]byte `avro:"signature"`
+	Internal  string  `avro:"-"`
+	private   string
+}
+
+func TestDeriveSchema(t *testing.T) {
+	raw, err := DeriveSchema(&derivedReservation{}, "com.sanservices.test")
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	schema := avro.MustParse(raw).(*avro.RecordSchema)
+	if schema.FullName() != "com.sanservices.test.derivedReservation" {
+		t.Errorf("name = %s", schema.FullName())
+	}
+
+	fields := map[string]*avro.Field{}
+	for _, f := range schema.Fields() {
+		fields[f.Name()] = f
+	}
+	if len(fields) != 11 || fields["Internal"] != nil || fields["private"] != nil {
+		t.Errorf("fields = %s", raw)
+	}
+	if fields["id"].Doc() != "Reservation number." || fields["nights"].Default() != 1 {
+		t.Errorf("id = %s, nights = %v", fields["id"].Doc(), fields["nights"].Default())
+	}
+	if fields["guest"].Type().Type() != avro.Union || !fields["guest"].HasDefault() || fields["guest"].Default() != nil {
+		t.Errorf("guest = %s", fields["guest"].Type())
+	}
+	if fields["channel"].Default() != "web" {
+		t.Errorf("channel default = %v", fields["channel"].Default())
+	}
+
+	// hamba/avro encodes int fields into avro ints only.
+	raw, err = DeriveSchema(&derivedStay{}, "com.sanservices.test")
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+	if nights := avro.MustParse(raw).(*avro.RecordSchema).Fields()[0].Type().Type(); nights != avro.Int {
+		t.Errorf("nights type = %s, expected %s", nights, avro.Int)
+	}
+
+	// The derived schema encodes and decodes the struct.
+	guest, amount := "ana", big.NewRat(12050, 100)
+	in := derivedReservation{
+		derivedAudit: derivedAudit{CreatedBy: "test"},
+		ID:           7,
+		Guest:        &guest,
+		Nights:       3,
+		Created:      time.UnixMilli(1646389800000).UTC(),
+		Duration:     time.Hour,
+		Amount:       amount,
+		Rooms:        []derivedRoom{{Number: 101, View: "SEA"}},
+		Extras:       map[string]float64{"late_checkout": 20},
+	}
+
+	data, err := avro.Marshal(schema, in)
+	if err != nil {
+		t.Fatalf("marshal error = %v", err)
+	}
+
+	var out derivedReservation
+	err = avro.Unmarshal(schema, data, &out)
+	if err != nil {
+		t.Fatalf("unmarshal error = %v", err)
+	}
+	if out.CreatedBy != "test" || *out.Guest != guest || out.Nights != in.Nights || !out.Created.Equal(in.Created) || out.Amount.Cmp(amount) != 0 || out.Rooms[0].View != "SEA" {
+		t.Errorf("out = %+v", out)
+	}
+}
+
+func TestDeriveSchemaErrors(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Value         interface{}
+		ExpectedError error
+	}{
+		{Name: "Not a struct", Value: "test", ExpectedError: errNotAStruct},
+		{Name: "Unsupported type", Value: struct{ Any interface{} }{}, ExpectedError: errUnsupportedType},
+		{Name: "Decimal without tag", Value: struct{ Amount *big.Rat }{}, ExpectedError: errDecimalTag},
+	}
+
+	for _, tc := range testcases {
+		_, err := DeriveSchema(tc.Value, "")
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+	}
+}
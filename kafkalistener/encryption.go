@@ -0,0 +1,306 @@
+package kafkalistener
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+var ErrNoKeyProvider error = errors.New("topic has encrypted fields but there's no key provider")
+var ErrMissingKeyID error = errors.New("encrypted message has no key id")
+var ErrUnknownKey error = errors.New("encryption key not found")
+
+var (
+	errEncryptedFieldType = errors.New("encrypted fields must be strings or bytes")
+	errCiphertext         = errors.New("ciphertext is too short")
+)
+
+// EncryptionKeyIDKey is the metadata key with the id of the key used to encrypt the message.
+const EncryptionKeyIDKey = "encryption_key_id"
+
+// KeyProvider returns the AES keys (16, 24 or 32 bytes) to encrypt and decrypt fields.
+type KeyProvider interface {
+	// CurrentKey returns the key to encrypt new messages.
+	CurrentKey() (id string, key []byte, err error)
+	// Key returns a key by id to decrypt messages, old keys are kept to rotate them.
+	Key(id string) ([]byte, error)
+}
+
+// Keyring is a KeyProvider read from a JSON file, meant for development and tests:
+//
+//	{"current": "2022-03", "keys": {"2022-01": "<base64 key>", "2022-03": "<base64 key>"}}
+type Keyring struct {
+	Current string            `json:"current"`
+	Keys    map[string][]byte `json:"keys"`
+}
+
+// NewFileKeyring reads a keyring from a JSON file.
+func NewFileKeyring(path string) (*Keyring, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	keyring := &Keyring{}
+	err = json.Unmarshal(data, keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	return keyring, nil
+}
+
+func (k *Keyring) CurrentKey() (string, []byte, error) {
+	key, err := k.Key(k.Current)
+	return k.Current, key, err
+}
+
+func (k *Keyring) Key(id string) ([]byte, error) {
+	key, ok := k.Keys[id]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownKey, id)
+	}
+
+	return key, nil
+}
+
+// SetKeyProvider sets the keys used for the EncryptedFields of the topics,
+// it should be called before adding the handlers.
+func (mb *MessageBroker) SetKeyProvider(keys KeyProvider) {
+	mb.keyProvider = keys
+}
+
+// encryptMessage encrypts the fields of the payload and sets the key id in the metadata.
+func (mb *MessageBroker) encryptMessage(topic *Topic, msg *message.Message) error {
+	if len(topic.EncryptedFields) == 0 {
+		return nil
+	}
+
+	if mb.keyProvider == nil {
+		return ErrNoKeyProvider
+	}
+
+	keyID, key, err := mb.keyProvider.CurrentKey()
+	if err != nil {
+		return err
+	}
+
+	msg.Payload, err = transformFields(topic, msg.Payload, key, true)
+	if err != nil {
+		return err
+	}
+
+	msg.Metadata.Set(EncryptionKeyIDKey, keyID)
+	return nil
+}
+
+// DecryptionMiddleware decrypts the EncryptedFields of the consumed messages
+// so the handlers decode them as plain values.
+//
+// It's added to the handlers of topics with encrypted fields. The messages without key id,
+// with an unknown key or that can't be decrypted fail with ErrPermanent, retrying them won't help.
+func DecryptionMiddleware(topic *Topic, keys KeyProvider) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			keyID := msg.Metadata.Get(EncryptionKeyIDKey)
+			if keyID == "" {
+				return nil, fmt.Errorf("%w: %w", ErrPermanent, ErrMissingKeyID)
+			}
+
+			if keys == nil {
+				return nil, ErrNoKeyProvider
+			}
+
+			// Other errors of the provider, like an unreachable KMS, are retried.
+			key, err := keys.Key(keyID)
+			if errors.Is(err, ErrUnknownKey) {
+				return nil, fmt.Errorf("%w: %w", ErrPermanent, err)
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			payload, err := transformFields(topic, msg.Payload, key, false)
+			if err != nil {
+				return nil, fmt.Errorf("%w: %w", ErrPermanent, err)
+			}
+
+			// The handler gets a copy, the consumed message keeps the encrypted payload
+			// for the retries and the redeliveries.
+			decrypted := msg.Copy()
+			decrypted.Payload = payload
+			decrypted.SetContext(msg.Context())
+
+			return h(decrypted)
+		}
+	}
+}
+
+// transformFields decodes the payload, encrypts or decrypts the encrypted fields
+// and encodes it again keeping the schema id header.
+func transformFields(topic *Topic, payload []byte, key []byte, encrypt bool) ([]byte, error) {
+	if topic.Schema == nil {
+		return nil, errNoSchemaProvided
+	}
+
+	if len(payload) < 5 {
+		return nil, errShortPayload
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	var record interface{}
+	err = avro.Unmarshal(topic.Schema, payload[5:], &record)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, field := range topic.EncryptedFields {
+		c := fieldCipher{gcm: gcm, field: field, encrypt: encrypt}
+		record, err = transformField(topic.Schema, record, strings.Split(field, "."), c.value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", field, err)
+		}
+	}
+
+	data, err := avro.Marshal(topic.Schema, record)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(append([]byte{}, payload[:5]...), data...), nil
+}
+
+// transformField follows the path through the records and unions of the generic value.
+func transformField(schema avro.Schema, value interface{}, path []string, fn func(avro.Schema, interface{}) (interface{}, error)) (interface{}, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	switch s := schema.(type) {
+	case *avro.RefSchema:
+		return transformField(s.Schema(), value, path, fn)
+
+	case *avro.UnionSchema:
+		branch, ok := value.(map[string]interface{})
+		if !ok {
+			return nil, errEncryptedFieldType
+		}
+		for name, v := range branch {
+			typ, _ := s.Types().Get(name)
+			if typ == nil {
+				return nil, errEncryptedFieldType
+			}
+
+			transformed, err := transformField(typ, v, path, fn)
+			if err != nil {
+				return nil, err
+			}
+			branch[name] = transformed
+		}
+		return branch, nil
+	}
+
+	if len(path) == 0 {
+		return fn(schema, value)
+	}
+
+	record, ok := schema.(*avro.RecordSchema)
+	obj, isMap := value.(map[string]interface{})
+	if !ok || !isMap {
+		return nil, errEncryptedFieldType
+	}
+
+	for _, field := range record.Fields() {
+		if field.Name() != path[0] {
+			continue
+		}
+
+		transformed, err := transformField(field.Type(), obj[field.Name()], path[1:], fn)
+		if err != nil {
+			return nil, err
+		}
+		obj[field.Name()] = transformed
+		return obj, nil
+	}
+
+	return nil, fmt.Errorf("%w: field %s not found", errEncryptedFieldType, path[0])
+}
+
+// fieldCipher encrypts or decrypts the value of a field with AES-GCM,
+// the field name is authenticated so values can't be moved between fields.
+type fieldCipher struct {
+	gcm     cipher.AEAD
+	field   string
+	encrypt bool
+}
+
+// value transforms a string or bytes value, strings hold the base64 of the ciphertext.
+func (c fieldCipher) value(schema avro.Schema, v interface{}) (interface{}, error) {
+	switch schema.Type() {
+	case avro.Bytes:
+		b, ok := v.([]byte)
+		if !ok {
+			return nil, errEncryptedFieldType
+		}
+		if c.encrypt {
+			return c.seal(b)
+		}
+		return c.open(b)
+
+	case avro.String:
+		str, ok := v.(string)
+		if !ok {
+			return nil, errEncryptedFieldType
+		}
+		if c.encrypt {
+			ciphertext, err := c.seal([]byte(str))
+			return base64.StdEncoding.EncodeToString(ciphertext), err
+		}
+
+		ciphertext, err := base64.StdEncoding.DecodeString(str)
+		if err != nil {
+			return nil, err
+		}
+		plaintext, err := c.open(ciphertext)
+		return string(plaintext), err
+	}
+
+	return nil, errEncryptedFieldType
+}
+
+// seal returns the nonce followed by the ciphertext.
+func (c fieldCipher) seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, c.gcm.NonceSize(), c.gcm.NonceSize()+len(plaintext)+c.gcm.Overhead())
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return nil, err
+	}
+
+	return c.gcm.Seal(nonce, nonce, plaintext, []byte(c.field)), nil
+}
+
+func (c fieldCipher) open(ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < c.gcm.NonceSize() {
+		return nil, errCiphertext
+	}
+
+	nonce, ciphertext := ciphertext[:c.gcm.NonceSize()], ciphertext[c.gcm.NonceSize():]
+	return c.gcm.Open(nil, nonce, ciphertext, []byte(c.field))
+}
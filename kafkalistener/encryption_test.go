@@ -0,0 +1,135 @@
+package kafkalistener
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+func TestFieldEncryption(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	err := os.WriteFile(path, []byte(`{
+		"current": "k2",
+		"keys": {
+			"k1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY=",
+			"k2": "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+		}
+	}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyring, err := NewFileKeyring(path)
+	if err != nil {
+		t.Fatalf("keyring error = %v", err)
+	}
+
+	topic := &Topic{
+		Name: "guests",
+		Schema: avro.MustParse(`{"type": "record", "name": "Guest", "fields": [
+			{"name": "id", "type": "long"},
+			{"name": "email", "type": "string"},
+			{"name": "document", "type": ["null", "bytes"]},
+			{"name": "address", "type": {"type": "record", "name": "Address", "fields": [{"name": "street", "type": ["null", "string"]}]}}
+		]}`),
+		EncryptedFields: []string{"email", "document", "address.street"},
+	}
+
+	mb := &MessageBroker{}
+	mb.SetKeyProvider(keyring)
+
+	data, err := avro.Marshal(topic.Schema, map[string]interface{}{
+		"id":       int64(1),
+		"email":    "ana@test.com",
+		"document": map[string]interface{}{"bytes": []byte("passport")},
+		"address":  map[string]interface{}{"street": nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg := message.NewMessage("1", append([]byte{0, 0, 0, 0, 1}, data...))
+	err = mb.encryptMessage(topic, msg)
+	if err != nil {
+		t.Fatalf("encrypt error = %v", err)
+	}
+
+	if msg.Metadata.Get(EncryptionKeyIDKey) != "k2" || bytes.Contains(msg.Payload, []byte("ana@test.com")) || bytes.Contains(msg.Payload, []byte("passport")) {
+		t.Fatalf("payload was not encrypted: %q", msg.Payload)
+	}
+
+	var decrypted map[string]interface{}
+	handler := DecryptionMiddleware(topic, keyring)(func(msg *message.Message) ([]*message.Message, error) {
+		decrypted, err = DecodeMap(topic, msg.Payload)
+		return nil, err
+	})
+
+	_, err = handler(msg)
+	if err != nil {
+		t.Fatalf("decrypt error = %v", err)
+	}
+	if decrypted["email"] != "ana@test.com" || string(decrypted["document"].([]byte)) != "passport" {
+		t.Errorf("decrypted = %v", decrypted)
+	}
+
+	// Retries and redeliveries decrypt the same consumed message again.
+	encrypted := append([]byte{}, msg.Payload...)
+	decrypted = nil
+	_, err = handler(msg)
+	if err != nil {
+		t.Fatalf("decrypt again error = %v", err)
+	}
+	if decrypted["email"] != "ana@test.com" || !bytes.Equal(msg.Payload, encrypted) {
+		t.Errorf("decrypted again = %v, payload changed = %v", decrypted, !bytes.Equal(msg.Payload, encrypted))
+	}
+
+	// Unknown keys, messages without key id and tampered ciphertexts are rejected as permanent.
+	testcases := []struct {
+		Name          string
+		KeyID         string
+		Payload       []byte
+		ExpectedError error
+	}{
+		{Name: "Unknown key", KeyID: "k3", Payload: encrypted, ExpectedError: ErrUnknownKey},
+		{Name: "Missing key id", KeyID: "", Payload: encrypted, ExpectedError: ErrMissingKeyID},
+		{Name: "Wrong key", KeyID: "k1", Payload: encrypted},
+		{Name: "Short ciphertext", KeyID: "k2", Payload: encryptedEmail(t, topic, []byte("short")), ExpectedError: errCiphertext},
+		{Name: "Tampered ciphertext", KeyID: "k2", Payload: encryptedEmail(t, topic, bytes.Repeat([]byte{1}, 40))},
+	}
+
+	for _, tc := range testcases {
+		tampered := message.NewMessage("1", tc.Payload)
+		tampered.Metadata.Set(EncryptionKeyIDKey, tc.KeyID)
+
+		_, err = handler(tampered)
+		if !errors.Is(err, ErrPermanent) || (tc.ExpectedError != nil && !errors.Is(err, tc.ExpectedError)) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+	}
+
+	mb.SetKeyProvider(nil)
+	if err = mb.encryptMessage(topic, msg); err != ErrNoKeyProvider {
+		t.Errorf("error = %v, expected %v", err, ErrNoKeyProvider)
+	}
+}
+
+// encryptedEmail returns a payload of the topic with ciphertext as the encrypted email.
+func encryptedEmail(t *testing.T, topic *Topic, ciphertext []byte) []byte {
+	data, err := avro.Marshal(topic.Schema, map[string]interface{}{
+		"id":       int64(1),
+		"email":    base64.StdEncoding.EncodeToString(ciphertext),
+		"document": nil,
+		"address":  map[string]interface{}{"street": nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return append([]byte{0, 0, 0, 0, 1}, data...)
+}
@@ -1,6 +1,10 @@
 package kafkalistener
 
 import (
+	"context"
+	"sync"
+
+	"github.com/IBM/sarama"
 	"github.com/ThreeDotsLabs/watermill"
 	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
 	"github.com/ThreeDotsLabs/watermill/message"
@@ -18,15 +22,64 @@ type KafkaConfig struct {
 	SchemaReg       string   `yaml:"schema_registration"`
 	Brokers         []string `yaml:"brokers"`
 	TLS             tls.TLS  `yaml:"TLS"`
+	// Registry sets the authentication and failover of the schema registry.
+	Registry RegistryConfig `yaml:"registry"`
+	// TransactionalID enables the transactional producer used by PublishTx.
+	TransactionalID string `yaml:"transactional_id"`
+	// ReadCommitted makes the consumers skip messages from aborted transactions.
+	ReadCommitted bool `yaml:"read_committed"`
+	// Commit is the commit mode of the handlers, RouteHandler.Commit overrides it.
+	Commit CommitPolicy `yaml:"commit"`
+	// LocalDir runs the broker without kafka nor schema registry, meant for development.
+	// Topics are JSON lines files in the directory and schemas are parsed from the topics.
+	// It takes precedence over Enabled.
+	LocalDir string `yaml:"local_dir"`
 }
 
 type MessageBroker struct {
 	enabled          bool
-	publisher        *kafka.Publisher
+	publisher        message.Publisher
+	txProducer       sarama.SyncProducer
+	txLock           sync.Mutex
+	consumerGroup    string
 	subscriberConfig kafka.SubscriberConfig
-	registryClient   *registry.Client
+	subscriber       message.Subscriber
+	registryClient   registry.Registry
 	logger           watermill.LoggerAdapter
 	router           *message.Router
+	// mu guards the registered routes and the listen context.
+	mu          sync.Mutex
+	routes      map[string]*route
+	batchRoutes []*batchRoute
+	listenCtx   context.Context
+	// publisherMiddlewares and encoderMiddlewares are guarded by mu too.
+	publisherMiddlewares []PublisherMiddleware
+	encoderMiddlewares   []EncoderMiddleware
+	// assignmentMu guards the partition assignment and the rebalance hooks.
+	assignmentMu   sync.Mutex
+	assignment     map[string]map[string][]int32
+	rebalanceHooks RebalanceHooks
+	// committers are the committers of the current group sessions by handler.
+	committers  map[string]*committer
+	commit      CommitPolicy
+	keyProvider KeyProvider
+	// blobStore keeps the payloads bigger than claimCheckBytes.
+	blobStore       BlobStore
+	claimCheckBytes int
+	// recorder archives the messages consumed by the route handlers.
+	recorder *Recorder
+	// replyMu guards the subscribers of the reply topics.
+	replyMu        sync.Mutex
+	replyListeners map[string]*replyListener
+	// schemaIDsMu guards the registry ids of the published schemas.
+	schemaIDsMu sync.Mutex
+	schemaIDs   map[string]int
+	// schemaRefs are the references of the subjects, guarded by schemaIDsMu too.
+	schemaRefs map[string][]registry.SchemaReference
+	// schemaCache is set when the registry falls back to a cache file.
+	schemaCache *SchemaCache
+	// localDir is set when the broker runs in local mode.
+	localDir string
 }
 
 type Topic struct {
@@ -41,4 +94,17 @@ type Topic struct {
 	// RegisterSchema indicates if the rawSchema should be registered
 	// in the kafka's schema registry.
 	RegisterSchema bool
+	// Rules are validated before publishing and when consuming.
+	Rules []FieldRule
+	// Partitions, ReplicationFactor and Configs are the settings checked by EnsureTopics,
+	// zero values are left to the broker defaults.
+	Partitions        int32
+	ReplicationFactor int16
+	Configs           map[string]string
+	// EncryptedFields are the string or bytes fields encrypted with the
+	// key provider of the broker, nested fields are separated by dots.
+	EncryptedFields []string
+	// References are the schemas referenced by RawSchema, they are
+	// registered and parsed before it by SetSchema.
+	References []SchemaReference
 }
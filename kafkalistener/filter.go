@@ -0,0 +1,114 @@
+package kafkalistener
+
+import (
+	"fmt"
+	"regexp"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Filter tells if a message should be handled, it runs before the payload is decoded.
+// The skipped messages are acked and counted in the Skipped of the HandlerInfo.
+type Filter func(msg *message.Message) bool
+
+// RecordFilter tells if a decoded record should be handled.
+type RecordFilter func(record map[string]interface{}) bool
+
+// HeaderEquals keeps the messages with the header set to value.
+func HeaderEquals(key, value string) Filter {
+	return func(msg *message.Message) bool {
+		return msg.Metadata.Get(key) == value
+	}
+}
+
+// HeaderMatches keeps the messages with the header matching the pattern.
+func HeaderMatches(key string, pattern *regexp.Regexp) Filter {
+	return func(msg *message.Message) bool {
+		return pattern.MatchString(msg.Metadata.Get(key))
+	}
+}
+
+// KeyMatches keeps the messages with the kafka key matching the pattern.
+func KeyMatches(pattern *regexp.Regexp) Filter {
+	return func(msg *message.Message) bool {
+		return pattern.MatchString(messageKey(msg))
+	}
+}
+
+// MaxAge drops the messages older than age, by their kafka timestamp.
+// Messages without timestamp are kept.
+func MaxAge(age time.Duration) Filter {
+	return func(msg *message.Message) bool {
+		timestamp, ok := messageTimestamp(msg)
+		return !ok || time.Since(timestamp) <= age
+	}
+}
+
+// messageKey returns the kafka key, or the key set by PublishWithKey in local mode.
+func messageKey(msg *message.Message) string {
+	if key, ok := kafka.MessageKeyFromCtx(msg.Context()); ok {
+		return string(key)
+	}
+
+	return msg.Metadata.Get(PartitionKeyKey)
+}
+
+// messageTimestamp returns the kafka timestamp, or the one set by PublishTimestamp.
+func messageTimestamp(msg *message.Message) (time.Time, bool) {
+	if timestamp, ok := kafka.MessageTimestampFromCtx(msg.Context()); ok && !timestamp.IsZero() {
+		return timestamp, true
+	}
+
+	timestamp, err := time.Parse(time.RFC3339Nano, msg.Metadata.Get(PublishedAtKey))
+	return timestamp, err == nil
+}
+
+// filterMiddleware acks the messages rejected by any of the filters without calling the handler.
+func filterMiddleware(filters []Filter, skipped *atomic.Uint64, logger watermill.LoggerAdapter) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			for _, keep := range filters {
+				if !keep(msg) {
+					skip(msg, skipped, logger)
+					return nil, nil
+				}
+			}
+
+			return h(msg)
+		}
+	}
+}
+
+// recordFilterMiddleware decodes the payload and acks the records rejected by any of the filters.
+func recordFilterMiddleware(topic *Topic, filters []RecordFilter, skipped *atomic.Uint64, logger watermill.LoggerAdapter) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			record, err := DecodeMap(topic, msg.Payload)
+			if err != nil {
+				// The payload fails the same way on every delivery.
+				return nil, fmt.Errorf("%w: %w", ErrPermanent, err)
+			}
+
+			for _, keep := range filters {
+				if !keep(record) {
+					skip(msg, skipped, logger)
+					return nil, nil
+				}
+			}
+
+			return h(msg)
+		}
+	}
+}
+
+func skip(msg *message.Message, skipped *atomic.Uint64, logger watermill.LoggerAdapter) {
+	skipped.Add(1)
+
+	if logger != nil {
+		logger.Trace("Message skipped by filter", watermill.LogFields{"uuid": msg.UUID})
+	}
+}
@@ -0,0 +1,122 @@
+package kafkalistener
+
+import (
+	"errors"
+	"regexp"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+func TestFilterMiddleware(t *testing.T) {
+	topic := &Topic{
+		Name:   "orders",
+		Schema: avro.MustParse(`{"type":"record","name":"Order","fields":[{"name":"status","type":"string"}]}`),
+	}
+
+	newMessage := func(metadata map[string]string, status string) *message.Message {
+		data, err := avro.Marshal(topic.Schema, map[string]interface{}{"status": status})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := message.NewMessage("1", append([]byte{0, 0, 0, 0, 1}, data...))
+		for k, v := range metadata {
+			msg.Metadata.Set(k, v)
+		}
+		return msg
+	}
+
+	filters := []Filter{
+		HeaderEquals("source", "web"),
+		KeyMatches(regexp.MustCompile(`^order-`)),
+		MaxAge(time.Hour),
+	}
+	recordFilters := []RecordFilter{
+		func(record map[string]interface{}) bool { return record["status"] == "PAID" },
+	}
+
+	recent := time.Now().Add(-time.Minute).Format(time.RFC3339Nano)
+	old := time.Now().Add(-2 * time.Hour).Format(time.RFC3339Nano)
+
+	testcases := []struct {
+		Name            string
+		Message         *message.Message
+		ExpectedHandled bool
+	}{
+		{
+			Name:            "Every filter passes",
+			Message:         newMessage(map[string]string{"source": "web", PartitionKeyKey: "order-1", PublishedAtKey: recent}, "PAID"),
+			ExpectedHandled: true,
+		},
+		{
+			Name:            "Without timestamp",
+			Message:         newMessage(map[string]string{"source": "web", PartitionKeyKey: "order-1"}, "PAID"),
+			ExpectedHandled: true,
+		},
+		{
+			Name:    "Other header",
+			Message: newMessage(map[string]string{"source": "app", PartitionKeyKey: "order-1", PublishedAtKey: recent}, "PAID"),
+		},
+		{
+			Name:    "Other key",
+			Message: newMessage(map[string]string{"source": "web", PartitionKeyKey: "refund-1", PublishedAtKey: recent}, "PAID"),
+		},
+		{
+			Name:    "Stale message",
+			Message: newMessage(map[string]string{"source": "web", PartitionKeyKey: "order-1", PublishedAtKey: old}, "PAID"),
+		},
+		{
+			Name:    "Field predicate",
+			Message: newMessage(map[string]string{"source": "web", PartitionKeyKey: "order-1", PublishedAtKey: recent}, "CREATED"),
+		},
+	}
+
+	for _, tc := range testcases {
+		var skipped atomic.Uint64
+		handled := false
+
+		h := func(msg *message.Message) ([]*message.Message, error) {
+			handled = true
+			return nil, nil
+		}
+		h = recordFilterMiddleware(topic, recordFilters, &skipped, nil)(h)
+		h = filterMiddleware(filters, &skipped, nil)(h)
+
+		_, err := h(tc.Message)
+		if err != nil {
+			t.Errorf("%s: error = %v", tc.Name, err)
+		}
+
+		if handled != tc.ExpectedHandled {
+			t.Errorf("%s: handled = %v, expected %v", tc.Name, handled, tc.ExpectedHandled)
+		}
+		if expected := map[bool]uint64{true: 0, false: 1}[tc.ExpectedHandled]; skipped.Load() != expected {
+			t.Errorf("%s: skipped = %d, expected %d", tc.Name, skipped.Load(), expected)
+		}
+	}
+}
+
+func TestRecordFilterUndecodable(t *testing.T) {
+	topic := &Topic{
+		Name:   "orders",
+		Schema: avro.MustParse(`{"type":"record","name":"Order","fields":[{"name":"status","type":"string"}]}`),
+	}
+
+	var skipped atomic.Uint64
+	h := recordFilterMiddleware(topic, []RecordFilter{func(record map[string]interface{}) bool { return true }}, &skipped, nil)(
+		func(msg *message.Message) ([]*message.Message, error) {
+			t.Error("undecodable message handled")
+			return nil, nil
+		},
+	)
+
+	// A negative string length.
+	_, err := h(message.NewMessage("1", []byte{0, 0, 0, 0, 1, 0x01}))
+	if !errors.Is(err, ErrPermanent) {
+		t.Errorf("error = %v, expected %v", err, ErrPermanent)
+	}
+}
@@ -0,0 +1,322 @@
+package kafkalistener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"math/big"
+	"reflect"
+	"strconv"
+	"time"
+
+	"github.com/hamba/avro"
+)
+
+var errJSONType = errors.New("json value does not match the avro schema")
+
+// NativeFromJSON converts a value decoded from JSON into the go values hamba/avro
+// expects for the schema, so it can be published with Publish.
+//
+// Numbers should be decoded as json.Number to keep the precision of longs. Timestamps and dates
+// can be RFC3339 and 2006-01-02 strings, decimals can be numbers or strings and unions can be
+// written either as their plain value or as {"type": value}.
+func NativeFromJSON(schema avro.Schema, v interface{}) (interface{}, error) {
+	switch s := schema.(type) {
+	case *avro.RefSchema:
+		return NativeFromJSON(s.Schema(), v)
+
+	case *avro.NullSchema:
+		if v != nil {
+			return nil, jsonTypeError(schema, v)
+		}
+		return nil, nil
+
+	case *avro.RecordSchema:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, jsonTypeError(schema, v)
+		}
+
+		record := make(map[string]interface{}, len(s.Fields()))
+		for _, field := range s.Fields() {
+			value, ok := obj[field.Name()]
+			if !ok {
+				if !field.HasDefault() {
+					return nil, fmt.Errorf("%w: missing field %s", errJSONType, field.Name())
+				}
+				value = field.Default()
+			}
+
+			native, err := NativeFromJSON(field.Type(), value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", field.Name(), err)
+			}
+			record[field.Name()] = native
+		}
+		return record, nil
+
+	case *avro.UnionSchema:
+		return unionFromJSON(s, v)
+
+	case *avro.ArraySchema:
+		items, ok := v.([]interface{})
+		if !ok {
+			return nil, jsonTypeError(schema, v)
+		}
+
+		array := make([]interface{}, len(items))
+		for i, item := range items {
+			native, err := NativeFromJSON(s.Items(), item)
+			if err != nil {
+				return nil, fmt.Errorf("[%d]: %w", i, err)
+			}
+			array[i] = native
+		}
+		return array, nil
+
+	case *avro.MapSchema:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, jsonTypeError(schema, v)
+		}
+
+		values := make(map[string]interface{}, len(obj))
+		for k, value := range obj {
+			native, err := NativeFromJSON(s.Values(), value)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %w", k, err)
+			}
+			values[k] = native
+		}
+		return values, nil
+
+	case *avro.EnumSchema:
+		symbol, ok := v.(string)
+		if !ok {
+			return nil, jsonTypeError(schema, v)
+		}
+		for _, sym := range s.Symbols() {
+			if sym == symbol {
+				return symbol, nil
+			}
+		}
+		return nil, fmt.Errorf("%w: unknown symbol %s of %s", errJSONType, symbol, s.FullName())
+
+	case *avro.FixedSchema:
+		return fixedFromJSON(s, v)
+
+	case *avro.PrimitiveSchema:
+		return primitiveFromJSON(s, v)
+	}
+
+	return nil, jsonTypeError(schema, v)
+}
+
+// unionFromJSON returns the map form of the union branch that accepts the value.
+func unionFromJSON(schema *avro.UnionSchema, v interface{}) (interface{}, error) {
+	if v == nil {
+		if !schema.Nullable() {
+			return nil, jsonTypeError(schema, v)
+		}
+		return nil, nil
+	}
+
+	if obj, ok := v.(map[string]interface{}); ok && len(obj) == 1 {
+		for name, value := range obj {
+			typ, _ := schema.Types().Get(name)
+			if typ == nil {
+				break
+			}
+
+			native, err := NativeFromJSON(typ, value)
+			if err != nil {
+				return nil, err
+			}
+			return map[string]interface{}{name: native}, nil
+		}
+	}
+
+	for _, typ := range schema.Types() {
+		if typ.Type() == avro.Null {
+			continue
+		}
+
+		native, err := NativeFromJSON(typ, v)
+		if err == nil {
+			return map[string]interface{}{typeName(typ): native}, nil
+		}
+	}
+
+	return nil, jsonTypeError(schema, v)
+}
+
+func fixedFromJSON(schema *avro.FixedSchema, v interface{}) (interface{}, error) {
+	if ls := schema.Logical(); ls != nil && ls.Type() == avro.Decimal {
+		return decimalFromJSON(v)
+	}
+
+	str, ok := v.(string)
+	if !ok || len(str) != schema.Size() {
+		return nil, jsonTypeError(schema, v)
+	}
+
+	fixed := reflect.New(reflect.ArrayOf(schema.Size(), reflect.TypeOf(byte(0)))).Elem()
+	reflect.Copy(fixed, reflect.ValueOf([]byte(str)))
+
+	return fixed.Interface(), nil
+}
+
+func primitiveFromJSON(schema *avro.PrimitiveSchema, v interface{}) (interface{}, error) {
+	var logical avro.LogicalType
+	if ls := schema.Logical(); ls != nil {
+		logical = ls.Type()
+	}
+	connectName, _ := schema.Prop("connect.name").(string)
+
+	switch schema.Type() {
+	case avro.Boolean:
+		if b, ok := v.(bool); ok {
+			return b, nil
+		}
+
+	case avro.Int:
+		if str, ok := v.(string); ok && (logical == avro.Date || connectName == ConnectDate) {
+			date, err := time.Parse(SimpleDateLayout, str)
+			if err != nil {
+				return nil, err
+			}
+			if logical == avro.Date {
+				return date, nil
+			}
+			return int(DaysFromDate(date)), nil
+		}
+
+		n, err := jsonInt(v, math.MinInt32, math.MaxInt32)
+		if err != nil {
+			return nil, jsonTypeError(schema, v)
+		}
+		switch logical {
+		case avro.Date:
+			return DateFromDays(int32(n)), nil
+		case avro.TimeMillis:
+			return TimeFromMillis(int32(n)), nil
+		}
+		return int(n), nil
+
+	case avro.Long:
+		if str, ok := v.(string); ok && (logical == avro.TimestampMillis || logical == avro.TimestampMicros || connectName == ConnectTimestamp) {
+			ts, err := time.Parse(time.RFC3339Nano, str)
+			if err != nil {
+				return nil, err
+			}
+			if logical == "" {
+				return ts.UnixMilli(), nil
+			}
+			return ts, nil
+		}
+
+		n, err := jsonInt(v, math.MinInt64, math.MaxInt64)
+		if err != nil {
+			return nil, jsonTypeError(schema, v)
+		}
+		switch logical {
+		case avro.TimestampMillis:
+			return TimestampFromMillis(n), nil
+		case avro.TimestampMicros:
+			return TimestampFromMicros(n), nil
+		case avro.TimeMicros:
+			return TimeFromMicros(n), nil
+		}
+		return n, nil
+
+	case avro.Float:
+		f, err := jsonFloat(v)
+		if err == nil {
+			return float32(f), nil
+		}
+
+	case avro.Double:
+		f, err := jsonFloat(v)
+		if err == nil {
+			return f, nil
+		}
+
+	case avro.String:
+		if str, ok := v.(string); ok {
+			return str, nil
+		}
+
+	case avro.Bytes:
+		if logical == avro.Decimal {
+			return decimalFromJSON(v)
+		}
+		if connectName == ConnectDecimal {
+			r, err := decimalFromJSON(v)
+			if err != nil {
+				return nil, err
+			}
+			return DecimalToBytes(r, connectScale(schema))
+		}
+		if str, ok := v.(string); ok {
+			return []byte(str), nil
+		}
+	}
+
+	return nil, jsonTypeError(schema, v)
+}
+
+func decimalFromJSON(v interface{}) (*big.Rat, error) {
+	var str string
+	switch value := v.(type) {
+	case json.Number:
+		str = value.String()
+	case string:
+		str = value
+	case float64:
+		str = strconv.FormatFloat(value, 'f', -1, 64)
+	default:
+		return nil, fmt.Errorf("%w: %v is not a decimal", errJSONType, v)
+	}
+
+	r, ok := new(big.Rat).SetString(str)
+	if !ok {
+		return nil, fmt.Errorf("%w: %v is not a decimal", errJSONType, v)
+	}
+	return r, nil
+}
+
+func jsonInt(v interface{}, min, max int64) (int64, error) {
+	var n int64
+	var err error
+	switch value := v.(type) {
+	case json.Number:
+		n, err = value.Int64()
+	case float64:
+		n = int64(value)
+		if float64(n) != value {
+			err = errJSONType
+		}
+	default:
+		err = errJSONType
+	}
+
+	if err == nil && (n < min || n > max) {
+		err = errJSONType
+	}
+	return n, err
+}
+
+func jsonFloat(v interface{}) (float64, error) {
+	switch value := v.(type) {
+	case json.Number:
+		return value.Float64()
+	case float64:
+		return value, nil
+	}
+	return 0, errJSONType
+}
+
+func jsonTypeError(schema avro.Schema, v interface{}) error {
+	return fmt.Errorf("%w: %v is not a valid %s", errJSONType, v, typeName(schema))
+}
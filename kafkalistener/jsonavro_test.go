@@ -0,0 +1,94 @@
+package kafkalistener
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro"
+)
+
+func TestNativeFromJSON(t *testing.T) {
+	schema := avro.MustParse(`{
+		"type": "record",
+		"name": "Reservation",
+		"fields": [
+			{"name": "id", "type": "long"},
+			{"name": "guest", "type": ["null", "string"], "default": null},
+			{"name": "tier", "type": {"type": "enum", "name": "Tier", "symbols": ["SILVER", "GOLD"]}},
+			{"name": "created", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+			{"name": "arrival", "type": {"type": "int", "logicalType": "date"}},
+			{"name": "amount", "type": {"type": "bytes", "logicalType": "decimal", "precision": 10, "scale": 2}},
+			{"name": "nights", "type": {"type": "array", "items": "int"}, "default": []}
+		]
+	}`)
+
+	testcases := []struct {
+		Name          string
+		JSON          string
+		ExpectedError error
+	}{
+		{
+			Name: "Plain union and defaults",
+			JSON: `{"id": 9007199254740993, "guest": "ana", "tier": "GOLD", "created": "2022-03-04T10:30:00Z", "arrival": "2022-03-10", "amount": "120.50"}`,
+		},
+		{
+			Name: "Typed union and raw logical values",
+			JSON: `{"id": 9007199254740993, "guest": {"string": "ana"}, "tier": "GOLD", "created": 1646389800000, "arrival": 19061, "amount": 120.5, "nights": [1, 2]}`,
+		},
+		{
+			Name:          "Missing field",
+			JSON:          `{"guest": "ana"}`,
+			ExpectedError: errJSONType,
+		},
+		{
+			Name:          "Unknown symbol",
+			JSON:          `{"id": 1, "tier": "BRONZE", "created": 0, "arrival": 0, "amount": 1}`,
+			ExpectedError: errJSONType,
+		},
+	}
+
+	for _, tc := range testcases {
+		decoder := json.NewDecoder(strings.NewReader(tc.JSON))
+		decoder.UseNumber()
+
+		var v interface{}
+		if err := decoder.Decode(&v); err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+
+		native, err := NativeFromJSON(schema, v)
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+			continue
+		}
+		if err != nil {
+			continue
+		}
+
+		data, err := avro.Marshal(schema, native)
+		if err != nil {
+			t.Errorf("%s: marshal error = %v", tc.Name, err)
+			continue
+		}
+
+		record, err := DecodeMap(&Topic{Schema: schema}, append([]byte{0, 0, 0, 0, 1}, data...))
+		if err != nil {
+			t.Errorf("%s: decode error = %v", tc.Name, err)
+			continue
+		}
+
+		if record["id"] != int64(9007199254740993) || record["guest"] != "ana" || record["tier"] != "GOLD" {
+			t.Errorf("%s: record = %v", tc.Name, record)
+		}
+		if record["created"] != time.Date(2022, 3, 4, 10, 30, 0, 0, time.UTC) || record["arrival"] != time.Date(2022, 3, 10, 0, 0, 0, 0, time.UTC) {
+			t.Errorf("%s: dates = %v, %v", tc.Name, record["created"], record["arrival"])
+		}
+		if r, ok := record["amount"].(*big.Rat); !ok || r.Cmp(big.NewRat(12050, 100)) != 0 {
+			t.Errorf("%s: amount = %v", tc.Name, record["amount"])
+		}
+	}
+}
@@ -28,13 +28,26 @@ func New(
 	config *KafkaConfig,
 	debug bool,
 ) (*MessageBroker, error) {
+	return NewWithLogger(ctx, config, watermill.NewStdLoggerWithOut(os.Stdout, debug, debug))
+}
+
+// NewWithLogger creates the message broker with a custom watermill logger.
+func NewWithLogger(
+	ctx context.Context,
+	config *KafkaConfig,
+	watermillLogger watermill.LoggerAdapter,
+) (*MessageBroker, error) {
 
 	log.Println("Creating message broker...")
+	if config.LocalDir != "" {
+		return newLocal(config, watermillLogger)
+	}
+
 	if !config.Enabled {
 		return &MessageBroker{enabled: false}, nil
 	}
 
-	var publisher *kafka.Publisher
+	var publisher message.Publisher
 
 	tlsConfig, err := tlskit.GetTLSConf(config.TLS)
 	if err != nil {
@@ -43,15 +56,22 @@ func New(
 	}
 
 	saramaConfig := setSaramaConfig(tlsConfig)
-	watermillLogger := watermill.NewStdLoggerWithOut(os.Stdout, debug, debug)
-
+	if config.ReadCommitted {
+		saramaConfig.Consumer.IsolationLevel = sarama.ReadCommitted
+	}
 	publisher, err = configurePublisher(config, saramaConfig, watermillLogger)
 	if err != nil {
 		log.Println("Error creating publisher: ", err)
 		return nil, err
 	}
 
-	registryClient, err := GetRegistryClient(tlsConfig, config.SchemaReg)
+	txProducer, err := configureTxProducer(config, tlsConfig)
+	if err != nil {
+		log.Println("Error creating transactional producer: ", err)
+		return nil, err
+	}
+
+	registryClient, err := NewRegistryClient(tlsConfig, config.SchemaReg, config.Registry)
 	if err != nil {
 		log.Println("Error creating registry client: ", err)
 		return nil, err
@@ -73,14 +93,20 @@ func New(
 		return nil, err
 	}
 
-	return &MessageBroker{
+	mb := &MessageBroker{
 		enabled:          true,
 		subscriberConfig: subscriberConfig,
 		publisher:        publisher,
+		txProducer:       txProducer,
+		consumerGroup:    config.ConsumerGroupID,
 		registryClient:   registryClient,
 		logger:           watermillLogger,
 		router:           router,
-	}, nil
+		routes:           make(map[string]*route),
+		commit:           config.Commit,
+	}
+
+	return mb, nil
 }
 
 // SetSchema Gets the schema from the schema-registry,
@@ -91,11 +117,22 @@ func (mb *MessageBroker) SetSchema(topic *Topic) error {
 		return ErrBrokerNotEnabled
 	}
 
+	if mb.localDir != "" {
+		return setLocalSchema(topic)
+	}
+
 	subject := topic.Name + "-value"
 	var err error
 	var schemaInfo registry.SchemaInfo
 	var schemaID int
 
+	// the referenced schemas are parsed before the schema referencing them.
+	references, err := mb.resolveReferences(topic.References, make(map[string]registry.SchemaReference))
+	if err != nil {
+		return err
+	}
+	mb.setReferences(subject, references)
+
 	// if the topic wont register the definition,
 	// just grab the schema from the registry.
 	if !topic.RegisterSchema {
@@ -117,56 +154,133 @@ func (mb *MessageBroker) SetSchema(topic *Topic) error {
 	}
 
 	// Attempt to register the schema in the registry.
-	_, topic.Schema, err = mb.registryClient.CreateSchema(subject, topic.RawSchema)
+	_, topic.Schema, err = mb.registryClient.CreateSchema(subject, topic.RawSchema, references...)
 	return err
 }
 
 func (mb *MessageBroker) Publish(topic *Topic, data interface{}) error {
-	var payload []byte
-	var id int
-	var err error
+	return mb.PublishContext(context.Background(), topic, data)
+}
 
-	if !mb.enabled {
-		return ErrBrokerNotEnabled
+// newMessage encodes the data into a message ready to be published, through the encoder middlewares.
+func (mb *MessageBroker) newMessage(ctx context.Context, topic *Topic, data interface{}) (*message.Message, error) {
+	return mb.encodeChain(mb.encodeMessage)(ctx, topic, data)
+}
+
+// encodeMessage encodes the data into a message ready to be published.
+func (mb *MessageBroker) encodeMessage(ctx context.Context, topic *Topic, data interface{}) (*message.Message, error) {
+	payload, err := mb.encodePayload(ctx, topic, data)
+	if err != nil {
+		return nil, err
 	}
 
-	if mb.publisher == nil {
-		return ErrPublishOnConsumeOnly
+	msg := message.NewMessage(watermill.NewUUID(), payload)
+	setMessageContext(ctx, msg)
+
+	err = mb.encryptMessage(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	err = mb.claimCheck(ctx, msg)
+	if err != nil {
+		return nil, err
 	}
+
+	return msg, nil
+}
+
+// publish sends the message until the context of the message is done.
+func (mb *MessageBroker) publish(topic *Topic, msg *message.Message) error {
+	ctx := msg.Context()
+	return runContext(ctx, func() error {
+		// The message isn't sent once the caller has given up on it.
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		return mb.publisher.Publish(topic.Name, msg)
+	})
+}
+
+// encodePayload serializes the data with the topic schema and prefixes it
+// with the magic byte and the schema id from the schema-registry.
+func (mb *MessageBroker) encodePayload(ctx context.Context, topic *Topic, data interface{}) ([]byte, error) {
+	var payload []byte
+	var id int
+	var err error
+
 	schemaIdBytes := make([]byte, 4)
 
 	compactSchema, err := compactSchema(topic.RawSchema)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	id, _, err = mb.registryClient.IsRegistered(topic.Name+"-value", compactSchema)
+	id, err = mb.schemaID(ctx, topic.Name+"-value", compactSchema)
 	if err != nil {
-		id, _, err = mb.registryClient.CreateSchema(topic.Name+"-value", compactSchema)
-		if err != nil {
-			return err
-		}
+		return nil, err
 	}
 
 	binary.BigEndian.PutUint32(schemaIdBytes, uint32(id))
 
 	messageToSend, err := avro.Marshal(topic.Schema, data)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	err = validatePayload(topic, messageToSend)
+	if err != nil {
+		return nil, err
 	}
 
 	payload = append(payload, byte(0))
 	payload = append(payload, schemaIdBytes...) //Magic number
 	payload = append(payload, messageToSend...)
 
-	msg := message.NewMessage(watermill.NewUUID(), payload)
-	return mb.publisher.Publish(topic.Name, msg)
+	return payload, nil
 }
 
-func GetRegistryClient(tlsConfig *tls.Config, schemaReg string) (*registry.Client, error) {
-	httpsClient := tlskit.GetHTTPSClient(tlsConfig)
+// schemaID returns the registry id of the schema, registering it if needed.
+// The ids are cached, a schema id never changes once it's registered.
+func (mb *MessageBroker) schemaID(ctx context.Context, subject, schema string) (int, error) {
+	if mb.localDir != "" {
+		return 0, nil
+	}
 
-	return registry.NewClient(schemaReg, registry.WithHTTPClient(httpsClient))
+	key := subject + "\x00" + schema
+
+	mb.schemaIDsMu.Lock()
+	id, ok := mb.schemaIDs[key]
+	mb.schemaIDsMu.Unlock()
+	if ok {
+		return id, nil
+	}
+
+	err := runContext(ctx, func() error {
+		var err error
+		id, _, err = mb.registryClient.IsRegistered(subject, schema)
+		if err == nil {
+			return nil
+		}
+
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		id, _, err = mb.registryClient.CreateSchema(subject, schema, mb.references(subject)...)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	mb.schemaIDsMu.Lock()
+	if mb.schemaIDs == nil {
+		mb.schemaIDs = make(map[string]int)
+	}
+	mb.schemaIDs[key] = id
+	mb.schemaIDsMu.Unlock()
+
+	return id, nil
 }
 
 func setSaramaConfig(tlsConfig *tls.Config) *sarama.Config {
@@ -208,20 +322,33 @@ func configurePublisher(
 	config *KafkaConfig,
 	saramaConfig *sarama.Config,
 	logger watermill.LoggerAdapter,
-) (*kafka.Publisher, error) {
+) (message.Publisher, error) {
 	if config.ConsumeOnly {
 		return nil, nil
 	}
 
 	publisherConfig := kafka.PublisherConfig{
 		Brokers:               config.Brokers,
-		Marshaler:             kafka.DefaultMarshaler{},
+		Marshaler:             keyMarshaler{},
 		OverwriteSaramaConfig: saramaConfig,
 	}
 
 	return kafka.NewPublisher(publisherConfig, logger)
 }
 
+// configureTxProducer creates the transactional producer used by PublishTx,
+// it returns nil when no transactional id is configured.
+func configureTxProducer(config *KafkaConfig, tlsConfig *tls.Config) (sarama.SyncProducer, error) {
+	if config.ConsumeOnly || config.TransactionalID == "" {
+		return nil, nil
+	}
+
+	saramaConfig := setSaramaConfig(tlsConfig)
+	saramaConfig.Producer.Transaction.ID = config.TransactionalID
+
+	return sarama.NewSyncProducer(config.Brokers, saramaConfig)
+}
+
 func compactSchema(schema string) (string, error) {
 	var err error
 	var str string
@@ -1,7 +1,14 @@
 package kafkalistener
 
 import (
+	"context"
+	"errors"
 	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
 )
 
 func TestCompactSchema(t *testing.T) {
@@ -62,3 +69,191 @@ func TestCompactSchema(t *testing.T) {
 	}
 
 }
+
+func TestPublishTxNotEnabled(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Broker        *MessageBroker
+		ExpectedError error
+	}{
+		{
+			Name:          "Should fail when the broker is disabled",
+			Broker:        &MessageBroker{enabled: false},
+			ExpectedError: ErrBrokerNotEnabled,
+		},
+		{
+			Name:          "Should fail without a transactional id",
+			Broker:        &MessageBroker{enabled: true},
+			ExpectedError: ErrTransactionsNotEnabled,
+		},
+	}
+
+	for _, tc := range testcases {
+		err := tc.Broker.PublishTx(context.Background(), func(tx *Tx) error {
+			t.Errorf("%s: callback should not run", tc.Name)
+			return nil
+		})
+		if err != tc.ExpectedError {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+	}
+}
+
+func TestClusters(t *testing.T) {
+	ctx := context.Background()
+	clusters, err := NewClusters(ctx, map[string]*KafkaConfig{
+		"regional": {Enabled: false},
+		"central":  {Enabled: false},
+	}, false)
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	names := clusters.Names()
+	if len(names) != 2 || names[0] != "central" || names[1] != "regional" {
+		t.Errorf("names = %v", names)
+	}
+
+	_, err = clusters.Broker("unknown")
+	if !errors.Is(err, ErrUnknownCluster) {
+		t.Errorf("error = %v, expected %v", err, ErrUnknownCluster)
+	}
+
+	err = clusters.Publish("central", &Topic{Name: "test"}, nil)
+	if err != ErrBrokerNotEnabled {
+		t.Errorf("error = %v, expected %v", err, ErrBrokerNotEnabled)
+	}
+
+	err = clusters.PublishContext(ctx, "central", &Topic{Name: "test"}, nil)
+	if err != ErrBrokerNotEnabled {
+		t.Errorf("error = %v, expected %v", err, ErrBrokerNotEnabled)
+	}
+
+	err = clusters.PublishContext(ctx, "unknown", &Topic{Name: "test"}, nil)
+	if !errors.Is(err, ErrUnknownCluster) {
+		t.Errorf("error = %v, expected %v", err, ErrUnknownCluster)
+	}
+
+	err = clusters.Listen(ctx, []ClusterRouteHandler{{Cluster: "unknown"}})
+	if !errors.Is(err, ErrUnknownCluster) {
+		t.Errorf("error = %v, expected %v", err, ErrUnknownCluster)
+	}
+
+	err = clusters.Listen(ctx, []ClusterRouteHandler{{Cluster: "regional"}})
+	if !errors.Is(err, ErrBrokerNotEnabled) {
+		t.Errorf("error = %v, expected %v", err, ErrBrokerNotEnabled)
+	}
+
+	// The regional cluster fails on its TLS files, after the central one was created.
+	_, err = NewClusters(ctx, map[string]*KafkaConfig{
+		"central":  {LocalDir: t.TempDir()},
+		"regional": {Enabled: true},
+	}, false)
+	if err == nil {
+		t.Error("error = nil, expected the error of the regional cluster")
+	}
+
+	_, err = NewClusters(ctx, map[string]*KafkaConfig{"central": nil}, false)
+	if err == nil || err.Error() != "cluster central: nil config" {
+		t.Errorf("error = %v, expected cluster central: nil config", err)
+	}
+}
+
+// closePublisher counts the times it's closed.
+type closePublisher struct {
+	message.Publisher
+	closed int
+}
+
+func (p *closePublisher) Close() error {
+	p.closed++
+	return nil
+}
+
+func TestClustersClose(t *testing.T) {
+	publisher := &closePublisher{}
+	clusters := &Clusters{brokers: map[string]*MessageBroker{
+		"central":  {publisher: publisher},
+		"regional": {enabled: false},
+	}}
+
+	err := clusters.close()
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+	if publisher.closed != 1 {
+		t.Errorf("closed = %d, expected 1", publisher.closed)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	mb := &MessageBroker{
+		enabled: true,
+		routes: map[string]*route{
+			"b": {handler: RouteHandler{Name: "b", Topic: &Topic{Name: "topic-b"}}},
+			"a": {handler: RouteHandler{Name: "a", Topic: &Topic{Name: "topic-a"}}},
+		},
+	}
+
+	infos := mb.Handlers()
+	if len(infos) != 2 || infos[0].Name != "a" || infos[1].Topic != "topic-b" {
+		t.Errorf("handlers = %+v", infos)
+	}
+
+	status, err := mb.HandlerStatus("a")
+	if err != nil || status != HandlerPending {
+		t.Errorf("status = %v, error = %v", status, err)
+	}
+
+	_, err = mb.HandlerStatus("c")
+	if err != ErrHandlerNotFound {
+		t.Errorf("error = %v, expected %v", err, ErrHandlerNotFound)
+	}
+
+	err = mb.RemoveHandler("a")
+	if err != nil {
+		t.Errorf("error = %v", err)
+	}
+
+	err = mb.RemoveHandler("a")
+	if err != ErrHandlerNotFound {
+		t.Errorf("error = %v, expected %v", err, ErrHandlerNotFound)
+	}
+}
+
+// TestRemoveHandlerNotRunning checks a handler of a router that never ran is kept instead of blocking.
+func TestRemoveHandlerNotRunning(t *testing.T) {
+	router, err := message.NewRouter(message.RouterConfig{}, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	subscriber := gochannel.NewGoChannel(gochannel.Config{}, watermill.NopLogger{})
+	defer subscriber.Close()
+
+	wmHandler := router.AddNoPublisherHandler("a", "topic-a", subscriber, func(msg *message.Message) error { return nil })
+	mb := &MessageBroker{
+		enabled: true,
+		router:  router,
+		routes: map[string]*route{
+			"a": {handler: RouteHandler{Name: "a", Topic: &Topic{Name: "topic-a"}}, wmHandler: wmHandler},
+		},
+	}
+
+	removed := make(chan error, 1)
+	go func() { removed <- mb.RemoveHandler("a") }()
+
+	select {
+	case err = <-removed:
+	case <-time.After(time.Second):
+		t.Fatal("remove handler blocked")
+	}
+	if err != ErrRouterNotRunning {
+		t.Errorf("error = %v, expected %v", err, ErrRouterNotRunning)
+	}
+
+	status, err := mb.HandlerStatus("a")
+	if err != nil || status != HandlerPending {
+		t.Errorf("status = %v, error = %v, expected %v", status, err, HandlerPending)
+	}
+}
@@ -0,0 +1,359 @@
+package kafkalistener
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+var ErrLocalMode error = errors.New("not supported by the local message broker")
+
+var (
+	errTopicName        = errors.New("invalid topic name")
+	errSubscriberClosed = errors.New("local subscriber is closed")
+)
+
+var topicNamePattern = regexp.MustCompile(`^[A-Za-z0-9._-]+$`)
+
+const (
+	// localPollInterval is how often the local subscribers look for new lines.
+	localPollInterval = 100 * time.Millisecond
+	// localNackSleep is how long a nacked message waits before it's sent again.
+	localNackSleep = time.Second
+)
+
+// localRecord is a line of a local topic file.
+type localRecord struct {
+	UUID     string            `json:"uuid"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Payload  []byte            `json:"payload"`
+}
+
+// newLocal creates a message broker that keeps the topics as JSON lines files of a directory,
+// the schemas are read from the topics instead of the schema registry.
+func newLocal(config *KafkaConfig, watermillLogger watermill.LoggerAdapter) (*MessageBroker, error) {
+	log.Println("Using local message broker in", config.LocalDir)
+
+	err := os.MkdirAll(config.LocalDir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	router, err := message.NewRouter(message.RouterConfig{}, watermillLogger)
+	if err != nil {
+		log.Println("Error creating router: ", err)
+		return nil, err
+	}
+
+	mb := &MessageBroker{
+		enabled:       true,
+		localDir:      config.LocalDir,
+		consumerGroup: config.ConsumerGroupID,
+		logger:        watermillLogger,
+		router:        router,
+		routes:        make(map[string]*route),
+	}
+
+	if !config.ConsumeOnly {
+		mb.publisher = &localPublisher{dir: config.LocalDir}
+	}
+
+	return mb, nil
+}
+
+// setLocalSchema parses the schema of the topic in local mode.
+func setLocalSchema(topic *Topic) error {
+	if topic.RawSchema == "" {
+		return errNoSchemaProvided
+	}
+
+	err := parseLocalReferences(topic.References)
+	if err != nil {
+		return err
+	}
+
+	schema, err := avro.Parse(topic.RawSchema)
+	if err != nil {
+		return err
+	}
+
+	topic.Schema = schema
+	return nil
+}
+
+func localTopicPath(dir, topic string) (string, error) {
+	if !topicNamePattern.MatchString(topic) || topic == "." || topic == ".." {
+		return "", fmt.Errorf("%w: %s", errTopicName, topic)
+	}
+
+	return filepath.Join(dir, topic+".jsonl"), nil
+}
+
+// localPublisher appends the messages to the topic files.
+type localPublisher struct {
+	dir string
+	mu  sync.Mutex
+}
+
+func (p *localPublisher) Publish(topic string, messages ...*message.Message) error {
+	path, err := localTopicPath(p.dir, topic)
+	if err != nil {
+		return err
+	}
+
+	var lines []byte
+	for _, msg := range messages {
+		line, err := json.Marshal(localRecord{
+			UUID:     msg.UUID,
+			Metadata: msg.Metadata,
+			Payload:  msg.Payload,
+		})
+		if err != nil {
+			return err
+		}
+		lines = append(append(lines, line...), '\n')
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(lines)
+	return errors.Join(err, f.Close())
+}
+
+func (p *localPublisher) Close() error {
+	return nil
+}
+
+// localSubscriber tails the topic files. With a consumer group the offset
+// of the acked messages is kept in a file next to the topic, without it
+// the topic is read from the beginning or, with fromNewest, from its end.
+type localSubscriber struct {
+	dir        string
+	group      string
+	fromNewest bool
+	logger     watermill.LoggerAdapter
+
+	closing   chan struct{}
+	closeOnce sync.Once
+	wg        sync.WaitGroup
+}
+
+func newLocalSubscriber(dir, group string, fromNewest bool, logger watermill.LoggerAdapter) *localSubscriber {
+	return &localSubscriber{
+		dir:        dir,
+		group:      group,
+		fromNewest: fromNewest,
+		logger:     logger,
+		closing:    make(chan struct{}),
+	}
+}
+
+func (s *localSubscriber) Subscribe(ctx context.Context, topic string) (<-chan *message.Message, error) {
+	select {
+	case <-s.closing:
+		return nil, errSubscriberClosed
+	default:
+	}
+
+	path, err := localTopicPath(s.dir, topic)
+	if err != nil {
+		return nil, err
+	}
+
+	offset, err := s.startOffset(path)
+	if err != nil {
+		return nil, err
+	}
+
+	output := make(chan *message.Message)
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer close(output)
+
+		err := s.tail(ctx, path, offset, output)
+		if err != nil {
+			s.logger.Error("Error reading local topic", err, watermill.LogFields{"topic": topic})
+		}
+	}()
+
+	return output, nil
+}
+
+func (s *localSubscriber) Close() error {
+	s.closeOnce.Do(func() { close(s.closing) })
+	s.wg.Wait()
+	return nil
+}
+
+func (s *localSubscriber) offsetPath(path string) string {
+	return path + "." + s.group + ".offset"
+}
+
+// startOffset returns the byte offset of the first line to read.
+func (s *localSubscriber) startOffset(path string) (int64, error) {
+	if s.group != "" {
+		data, err := os.ReadFile(s.offsetPath(path))
+		if err == nil {
+			return strconv.ParseInt(string(data), 10, 64)
+		}
+		if !errors.Is(err, os.ErrNotExist) {
+			return 0, err
+		}
+	}
+
+	if !s.fromNewest {
+		return 0, nil
+	}
+
+	info, err := os.Stat(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+
+	return info.Size(), nil
+}
+
+// tail sends the complete lines after the offset, one at a time
+// waiting for the message to be acked before moving to the next one.
+func (s *localSubscriber) tail(ctx context.Context, path string, offset int64, output chan<- *message.Message) error {
+	for {
+		lines, err := readLines(path, offset)
+		if err != nil {
+			return err
+		}
+
+		for _, line := range lines {
+			for {
+				acked, err := s.send(ctx, line, output)
+				if err != nil {
+					return err
+				}
+				if acked {
+					break
+				}
+
+				if !s.sleep(ctx, localNackSleep) {
+					return nil
+				}
+			}
+
+			offset += int64(len(line))
+			if s.group != "" {
+				err := os.WriteFile(s.offsetPath(path), []byte(strconv.FormatInt(offset, 10)), 0644)
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		if !s.sleep(ctx, localPollInterval) {
+			return nil
+		}
+	}
+}
+
+// send delivers a line as a message and waits for it,
+// it returns false when the message is nacked or the subscription is over.
+func (s *localSubscriber) send(ctx context.Context, line []byte, output chan<- *message.Message) (bool, error) {
+	var record localRecord
+	err := json.Unmarshal(line, &record)
+	if err != nil {
+		return false, err
+	}
+
+	msg := message.NewMessage(record.UUID, record.Payload)
+	for k, v := range record.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	msgCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	msg.SetContext(msgCtx)
+
+	select {
+	case output <- msg:
+	case <-s.closing:
+		return false, nil
+	case <-ctx.Done():
+		return false, nil
+	}
+
+	select {
+	case <-msg.Acked():
+		return true, nil
+	case <-msg.Nacked():
+		return false, nil
+	case <-s.closing:
+		return false, nil
+	case <-ctx.Done():
+		return false, nil
+	}
+}
+
+// sleep waits for d, it returns false when the subscription is over.
+func (s *localSubscriber) sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-time.After(d):
+		return true
+	case <-s.closing:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// readLines returns the complete lines of the file after the offset,
+// a line still being written is left for the next read.
+func readLines(path string, offset int64) ([][]byte, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	_, err = f.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var lines [][]byte
+	reader := bufio.NewReader(f)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if errors.Is(err, io.EOF) {
+			return lines, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		lines = append(lines, line)
+	}
+}
@@ -0,0 +1,167 @@
+package kafkalistener
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+const localTestSchema = `{"type": "record", "name": "Order", "fields": [{"name": "id", "type": "string"}]}`
+
+type localTestOrder struct {
+	ID string `avro:"id"`
+}
+
+func TestLocalBroker(t *testing.T) {
+	config := &KafkaConfig{LocalDir: t.TempDir(), ConsumerGroupID: "orders-service"}
+
+	received := make(chan string, 10)
+	listen := func(publish ...string) {
+		mb, err := NewWithLogger(context.Background(), config, watermill.NopLogger{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		topic := &Topic{Name: "orders", RawSchema: localTestSchema}
+		err = mb.SetSchema(topic)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, id := range publish {
+			err := mb.Publish(topic, localTestOrder{ID: id})
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		done := make(chan error)
+		go func() {
+			done <- mb.Listen(context.Background(), []RouteHandler{{
+				Topic: topic,
+				HandlerFunc: func(msg *message.Message) error {
+					var order localTestOrder
+					err := DecodePayload(topic, msg.Payload, &order)
+					if err != nil {
+						return err
+					}
+					received <- order.ID
+					return nil
+				},
+			}})
+		}()
+
+		for _, id := range publish {
+			select {
+			case got := <-received:
+				if got != id {
+					t.Errorf("received %s, expected %s", got, id)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatalf("order %s not received", id)
+			}
+		}
+
+		err = mb.Stop()
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-done
+	}
+
+	listen("1", "2")
+	// The consumer group resumes after the acked messages.
+	listen("3")
+
+	select {
+	case id := <-received:
+		t.Errorf("order %s received twice", id)
+	default:
+	}
+}
+
+// TestPermanentErrorWithoutRetry checks a message failing with a permanent error is acked
+// without Retry, instead of being redelivered before the next messages.
+func TestPermanentErrorWithoutRetry(t *testing.T) {
+	config := &KafkaConfig{LocalDir: t.TempDir(), ConsumerGroupID: "orders-service"}
+	mb, err := NewWithLogger(context.Background(), config, watermill.NopLogger{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := &Topic{Name: "orders", RawSchema: localTestSchema}
+	err = mb.SetSchema(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, id := range []string{"invalid", "1"} {
+		err := mb.Publish(topic, localTestOrder{ID: id})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	received := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- mb.Listen(context.Background(), []RouteHandler{{
+			Topic: topic,
+			HandlerFunc: func(msg *message.Message) error {
+				var order localTestOrder
+				err := DecodePayload(topic, msg.Payload, &order)
+				if err != nil {
+					return err
+				}
+				received <- order.ID
+				if order.ID == "invalid" {
+					return fmt.Errorf("%w: invalid order", ErrPermanent)
+				}
+				return nil
+			},
+		}})
+	}()
+
+	var ids []string
+	for len(ids) < 2 {
+		select {
+		case id := <-received:
+			ids = append(ids, id)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("received = %v, expected [invalid 1]", ids)
+		}
+	}
+	if fmt.Sprint(ids) != "[invalid 1]" {
+		t.Errorf("received = %v, expected [invalid 1]", ids)
+	}
+
+	err = mb.Stop()
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-done
+}
+
+func TestLocalTopicPath(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Topic         string
+		ExpectedError bool
+	}{
+		{Name: "Valid topic", Topic: "orders.v1-created_at"},
+		{Name: "Path traversal", Topic: "../orders", ExpectedError: true},
+		{Name: "Parent directory", Topic: "..", ExpectedError: true},
+		{Name: "Empty topic", Topic: "", ExpectedError: true},
+	}
+
+	for _, tc := range testcases {
+		_, err := localTopicPath("topics", tc.Topic)
+		if (err != nil) != tc.ExpectedError {
+			t.Errorf("%s: error = %v, expected error %v", tc.Name, err, tc.ExpectedError)
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package kafkalistener
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro"
+)
+
+var (
+	errInvalidUUID    = errors.New("invalid uuid")
+	errInvalidDecimal = errors.New("decimal does not fit in the given scale")
+)
+
+// Kafka Connect names of its logical types,
+// connect sets them in the "connect.name" property of the avro schema.
+const (
+	ConnectTimestamp string = "org.apache.kafka.connect.data.Timestamp"
+	ConnectDate      string = "org.apache.kafka.connect.data.Date"
+	ConnectTime      string = "org.apache.kafka.connect.data.Time"
+	ConnectDecimal   string = "org.apache.kafka.connect.data.Decimal"
+)
+
+// The local timestamps aren't known by hamba/avro, their logicalType is dropped when the schema is parsed.
+const (
+	localTimestampMillis string = "local-timestamp-millis"
+	localTimestampMicros string = "local-timestamp-micros"
+)
+
+const day = 24 * time.Hour
+
+// localTimestampsCache holds the local timestamps of the last parsed schema of each raw schema,
+// keyed by the sha256 of the raw schema so it doesn't grow when a schema is parsed again.
+var localTimestampsCache sync.Map
+
+// parsedLocalTimestamps are the local timestamps of a parsed schema.
+type parsedLocalTimestamps struct {
+	schema avro.Schema
+	local  map[*avro.PrimitiveSchema]string
+}
+
+// LocalTimestampMillis is an avro local-timestamp-millis,
+// the milliseconds of a wall clock time that has no timezone.
+type LocalTimestampMillis int64
+
+// NewLocalTimestampMillis takes the wall clock of t, ignoring its location.
+func NewLocalTimestampMillis(t time.Time) LocalTimestampMillis {
+	return LocalTimestampMillis(wallClock(t).UnixMilli())
+}
+
+// In returns the wall clock time in the given location.
+func (ts LocalTimestampMillis) In(loc *time.Location) time.Time {
+	return inLocation(time.UnixMilli(int64(ts)).UTC(), loc)
+}
+
+// LocalTimestampMicros is an avro local-timestamp-micros,
+// the microseconds of a wall clock time that has no timezone.
+type LocalTimestampMicros int64
+
+// NewLocalTimestampMicros takes the wall clock of t, ignoring its location.
+func NewLocalTimestampMicros(t time.Time) LocalTimestampMicros {
+	return LocalTimestampMicros(wallClock(t).UnixMicro())
+}
+
+// In returns the wall clock time in the given location.
+func (ts LocalTimestampMicros) In(loc *time.Location) time.Time {
+	return inLocation(time.UnixMicro(int64(ts)).UTC(), loc)
+}
+
+// DateFromDays converts an avro date, the days since the unix epoch, into a time.Time.
+func DateFromDays(days int32) time.Time {
+	return time.Unix(int64(days)*int64(day/time.Second), 0).UTC()
+}
+
+// DaysFromDate converts a time.Time into an avro date, the days before the epoch are negative.
+func DaysFromDate(t time.Time) int32 {
+	seconds, perDay := wallClock(t).Unix(), int64(day/time.Second)
+
+	days := seconds / perDay
+	if seconds%perDay < 0 {
+		days--
+	}
+	return int32(days)
+}
+
+// TimestampFromMillis converts an avro timestamp-millis into a time.Time.
+func TimestampFromMillis(ms int64) time.Time {
+	return time.UnixMilli(ms).UTC()
+}
+
+// TimestampFromMicros converts an avro timestamp-micros into a time.Time.
+func TimestampFromMicros(us int64) time.Time {
+	return time.UnixMicro(us).UTC()
+}
+
+// TimeFromMillis converts an avro time-millis, the milliseconds after midnight, into a time.Duration.
+func TimeFromMillis(ms int32) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+// TimeFromMicros converts an avro time-micros, the microseconds after midnight, into a time.Duration.
+func TimeFromMicros(us int64) time.Duration {
+	return time.Duration(us) * time.Microsecond
+}
+
+// DecimalFromBytes converts the two's-complement big-endian bytes of an avro decimal into a big.Rat.
+func DecimalFromBytes(b []byte, scale int) *big.Rat {
+	num := new(big.Int).SetBytes(b)
+	if len(b) > 0 && b[0]&0x80 != 0 {
+		num.Sub(num, new(big.Int).Lsh(big.NewInt(1), uint(len(b))*8))
+	}
+
+	denom := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil)
+	return new(big.Rat).SetFrac(num, denom)
+}
+
+// DecimalToBytes converts a big.Rat into the two's-complement big-endian bytes of an avro decimal,
+// it fails when the value has more decimal places than the scale.
+func DecimalToBytes(r *big.Rat, scale int) ([]byte, error) {
+	num := new(big.Int).Mul(r.Num(), new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(scale)), nil))
+	unscaled, rem := new(big.Int).QuoRem(num, r.Denom(), new(big.Int))
+	if rem.Sign() != 0 {
+		return nil, errInvalidDecimal
+	}
+
+	if unscaled.Sign() >= 0 {
+		b := unscaled.Bytes()
+		if len(b) == 0 || b[0]&0x80 != 0 {
+			b = append([]byte{0}, b...)
+		}
+		return b, nil
+	}
+
+	size := len(unscaled.Bytes())
+	for {
+		b := new(big.Int).Add(new(big.Int).Lsh(big.NewInt(1), uint(size)*8), unscaled).Bytes()
+		if len(b) == size && b[0]&0x80 != 0 {
+			return b, nil
+		}
+		size++
+	}
+}
+
+// ParseUUID validates an avro uuid and returns it in its canonical lowercase form.
+func ParseUUID(s string) (string, error) {
+	if len(s) != 36 {
+		return "", errInvalidUUID
+	}
+
+	for i, c := range s {
+		switch {
+		case i == 8 || i == 13 || i == 18 || i == 23:
+			if c != '-' {
+				return "", errInvalidUUID
+			}
+		case (c < '0' || c > '9') && (c < 'a' || c > 'f') && (c < 'A' || c > 'F'):
+			return "", errInvalidUUID
+		}
+	}
+
+	return strings.ToLower(s), nil
+}
+
+// nativeValue converts a generically decoded avro value into its go representation,
+// applying the kafka connect logical types and flattening the unions.
+// local holds the schemas of the local timestamps, which are converted to LocalTimestampMillis/Micros.
+func nativeValue(schema avro.Schema, v interface{}, local map[*avro.PrimitiveSchema]string) interface{} {
+	if v == nil {
+		return nil
+	}
+
+	switch s := schema.(type) {
+	case *avro.RefSchema:
+		return nativeValue(s.Schema(), v, local)
+
+	case *avro.RecordSchema:
+		record, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for _, field := range s.Fields() {
+			record[field.Name()] = nativeValue(field.Type(), record[field.Name()], local)
+		}
+		return record
+
+	case *avro.UnionSchema:
+		branch, ok := v.(map[string]interface{})
+		if !ok || len(branch) != 1 {
+			return v
+		}
+		for name, value := range branch {
+			for _, typ := range s.Types() {
+				if typeName(typ) == name {
+					return nativeValue(typ, value, local)
+				}
+			}
+			return value
+		}
+
+	case *avro.ArraySchema:
+		items, ok := v.([]interface{})
+		if !ok {
+			return v
+		}
+		for i := range items {
+			items[i] = nativeValue(s.Items(), items[i], local)
+		}
+		return items
+
+	case *avro.MapSchema:
+		values, ok := v.(map[string]interface{})
+		if !ok {
+			return v
+		}
+		for k := range values {
+			values[k] = nativeValue(s.Values(), values[k], local)
+		}
+		return values
+
+	case *avro.PrimitiveSchema:
+		if value, ok := v.(int64); ok {
+			switch local[s] {
+			case localTimestampMillis:
+				return LocalTimestampMillis(value)
+			case localTimestampMicros:
+				return LocalTimestampMicros(value)
+			}
+		}
+		return connectValue(s, v)
+	}
+
+	return v
+}
+
+// localTimestamps finds the local timestamps of the topic schema in its RawSchema,
+// without it they can't be told apart from plain longs.
+func localTimestamps(topic *Topic) map[*avro.PrimitiveSchema]string {
+	if topic.RawSchema == "" {
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(topic.RawSchema))
+	if cached, ok := localTimestampsCache.Load(key); ok && cached.(parsedLocalTimestamps).schema == topic.Schema {
+		return cached.(parsedLocalTimestamps).local
+	}
+
+	var raw interface{}
+	local := map[*avro.PrimitiveSchema]string{}
+	if json.Unmarshal([]byte(topic.RawSchema), &raw) == nil {
+		findLocalTimestamps(topic.Schema, raw, local)
+	}
+
+	localTimestampsCache.Store(key, parsedLocalTimestamps{schema: topic.Schema, local: local})
+	return local
+}
+
+// findLocalTimestamps walks the raw json of a schema along with the parsed schema.
+func findLocalTimestamps(schema avro.Schema, raw interface{}, local map[*avro.PrimitiveSchema]string) {
+	switch r := raw.(type) {
+	case []interface{}:
+		union, ok := schema.(*avro.UnionSchema)
+		if !ok || len(union.Types()) != len(r) {
+			return
+		}
+		for i, typ := range union.Types() {
+			findLocalTimestamps(typ, r[i], local)
+		}
+
+	case map[string]interface{}:
+		if _, ok := r["type"].(string); !ok {
+			findLocalTimestamps(schema, r["type"], local)
+			return
+		}
+
+		switch s := schema.(type) {
+		case *avro.RecordSchema:
+			fields, _ := r["fields"].([]interface{})
+			if len(fields) != len(s.Fields()) {
+				return
+			}
+			for i, field := range s.Fields() {
+				if f, ok := fields[i].(map[string]interface{}); ok {
+					findLocalTimestamps(field.Type(), f["type"], local)
+				}
+			}
+		case *avro.ArraySchema:
+			findLocalTimestamps(s.Items(), r["items"], local)
+		case *avro.MapSchema:
+			findLocalTimestamps(s.Values(), r["values"], local)
+		case *avro.PrimitiveSchema:
+			switch logical := r["logicalType"]; logical {
+			case localTimestampMillis, localTimestampMicros:
+				if s.Type() == avro.Long {
+					local[s] = logical.(string)
+				}
+			}
+		}
+	}
+}
+
+// connectValue converts the kafka connect logical types
+// that were not already converted by their avro logicalType.
+func connectValue(schema *avro.PrimitiveSchema, v interface{}) interface{} {
+	name, _ := schema.Prop("connect.name").(string)
+
+	switch value := v.(type) {
+	case int64:
+		switch name {
+		case ConnectTimestamp:
+			return TimestampFromMillis(value)
+		}
+	case int:
+		switch name {
+		case ConnectDate:
+			return DateFromDays(int32(value))
+		case ConnectTime:
+			return TimeFromMillis(int32(value))
+		}
+	case []byte:
+		if name == ConnectDecimal {
+			return DecimalFromBytes(value, connectScale(schema))
+		}
+	}
+
+	return v
+}
+
+// connectScale reads the scale kafka connect sets in the "connect.parameters" property.
+func connectScale(schema *avro.PrimitiveSchema) int {
+	params, _ := schema.Prop("connect.parameters").(map[string]interface{})
+	scale, _ := params["scale"].(string)
+
+	n, _ := strconv.Atoi(scale)
+	return n
+}
+
+// typeName is the name hamba/avro uses for the branches of a generically decoded union.
+func typeName(schema avro.Schema) string {
+	if ref, ok := schema.(*avro.RefSchema); ok {
+		schema = ref.Schema()
+	}
+
+	if named, ok := schema.(avro.NamedSchema); ok {
+		return named.FullName()
+	}
+
+	name := string(schema.Type())
+	if lts, ok := schema.(avro.LogicalTypeSchema); ok && lts.Logical() != nil {
+		name += "." + string(lts.Logical().Type())
+	}
+
+	return name
+}
+
+func wallClock(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), time.UTC)
+}
+
+func inLocation(t time.Time, loc *time.Location) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), loc)
+}
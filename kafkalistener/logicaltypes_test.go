@@ -0,0 +1,212 @@
+package kafkalistener
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro"
+)
+
+func TestDecimalBytes(t *testing.T) {
+	testcases := []struct {
+		Value string
+		Scale int
+	}{
+		{Value: "0", Scale: 2},
+		{Value: "12.34", Scale: 2},
+		{Value: "-1.28", Scale: 2},
+		{Value: "-1.29", Scale: 2},
+		{Value: "1.28", Scale: 2},
+		{Value: "-123456789.123", Scale: 4},
+	}
+
+	for _, tc := range testcases {
+		r, _ := new(big.Rat).SetString(tc.Value)
+
+		b, err := DecimalToBytes(r, tc.Scale)
+		if err != nil {
+			t.Errorf("%s: error = %v", tc.Value, err)
+			continue
+		}
+
+		got := DecimalFromBytes(b, tc.Scale)
+		if got.Cmp(r) != 0 {
+			t.Errorf("%s: got %s", tc.Value, got.FloatString(tc.Scale))
+		}
+	}
+
+	_, err := DecimalToBytes(big.NewRat(1, 3), 2)
+	if err != errInvalidDecimal {
+		t.Errorf("error = %v, expected %v", err, errInvalidDecimal)
+	}
+}
+
+func TestParseUUID(t *testing.T) {
+	uuid, err := ParseUUID("3F2504E0-4F89-11D3-9A0C-0305E82C3301")
+	if err != nil || uuid != "3f2504e0-4f89-11d3-9a0c-0305e82c3301" {
+		t.Errorf("uuid = %v, error = %v", uuid, err)
+	}
+
+	for _, invalid := range []string{"", "3f2504e0-4f89-11d3-9a0c-0305e82c330", "3f2504e0x4f89-11d3-9a0c-0305e82c3301", "zf2504e0-4f89-11d3-9a0c-0305e82c3301"} {
+		_, err := ParseUUID(invalid)
+		if err != errInvalidUUID {
+			t.Errorf("%q: error = %v, expected %v", invalid, err, errInvalidUUID)
+		}
+	}
+}
+
+func TestLocalTimestamp(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	wall := time.Date(2022, 3, 4, 10, 30, 0, 0, loc)
+
+	ts := NewLocalTimestampMillis(wall)
+	if !ts.In(loc).Equal(wall) {
+		t.Errorf("millis = %v, expected %v", ts.In(loc), wall)
+	}
+
+	us := NewLocalTimestampMicros(wall)
+	if !us.In(loc).Equal(wall) {
+		t.Errorf("micros = %v, expected %v", us.In(loc), wall)
+	}
+
+	if DateFromDays(DaysFromDate(wall)) != time.Date(2022, 3, 4, 0, 0, 0, 0, time.UTC) {
+		t.Errorf("date = %v", DateFromDays(DaysFromDate(wall)))
+	}
+}
+
+func TestDaysFromDate(t *testing.T) {
+	testcases := []struct {
+		Name         string
+		Date         time.Time
+		ExpectedDays int32
+	}{
+		{Name: "Epoch", Date: time.Date(1970, 1, 1, 0, 0, 0, 0, time.UTC), ExpectedDays: 0},
+		{Name: "Noon of the epoch", Date: time.Date(1970, 1, 1, 12, 0, 0, 0, time.UTC), ExpectedDays: 0},
+		{Name: "After the epoch", Date: time.Date(2022, 3, 4, 10, 30, 0, 0, time.UTC), ExpectedDays: 19055},
+		{Name: "Midnight before the epoch", Date: time.Date(1969, 12, 31, 0, 0, 0, 0, time.UTC), ExpectedDays: -1},
+		{Name: "Noon before the epoch", Date: time.Date(1969, 12, 31, 12, 0, 0, 0, time.UTC), ExpectedDays: -1},
+		{Name: "Last second before the epoch", Date: time.Date(1969, 12, 31, 23, 59, 59, 0, time.UTC), ExpectedDays: -1},
+		{Name: "Years before the epoch", Date: time.Date(1950, 6, 15, 8, 0, 0, 0, time.UTC), ExpectedDays: -7140},
+	}
+
+	for _, tc := range testcases {
+		days := DaysFromDate(tc.Date)
+		if days != tc.ExpectedDays {
+			t.Errorf("%s: days = %d, expected %d", tc.Name, days, tc.ExpectedDays)
+		}
+
+		expected := time.Date(tc.Date.Year(), tc.Date.Month(), tc.Date.Day(), 0, 0, 0, 0, time.UTC)
+		if date := DateFromDays(days); !date.Equal(expected) {
+			t.Errorf("%s: date = %v, expected %v", tc.Name, date, expected)
+		}
+	}
+}
+
+func TestDecodeMapConnectTypes(t *testing.T) {
+	schema := avro.MustParse(`{
+		"type": "record",
+		"name": "ConnectDefault",
+		"namespace": "io.confluent.connect.avro",
+		"fields": [
+			{"name": "ULTRACLUB_ID", "type": "long"},
+			{"name": "CURRENT_TIER", "type": ["null", "string"], "default": null},
+			{"name": "UPDATE_DATE", "type": ["null", {"type": "long", "connect.version": 1, "connect.name": "org.apache.kafka.connect.data.Timestamp", "logicalType": "timestamp-millis"}], "default": null},
+			{"name": "CREATED", "type": {"type": "long", "connect.name": "org.apache.kafka.connect.data.Timestamp"}},
+			{"name": "BALANCE", "type": {"type": "bytes", "connect.name": "org.apache.kafka.connect.data.Decimal", "connect.parameters": {"scale": "2"}}}
+		]
+	}`)
+
+	updated := time.Date(2022, 3, 4, 10, 30, 0, 0, time.UTC)
+	balance, _ := DecimalToBytes(big.NewRat(-1050, 100), 2)
+	data, err := avro.Marshal(schema, map[string]interface{}{
+		"ULTRACLUB_ID": int64(7),
+		"CURRENT_TIER": map[string]interface{}{"string": "gold"},
+		"UPDATE_DATE":  map[string]interface{}{"long.timestamp-millis": updated},
+		"CREATED":      updated.UnixMilli(),
+		"BALANCE":      balance,
+	})
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	payload := append([]byte{0, 0, 0, 0, 1}, data...)
+	record, err := DecodeMap(&Topic{Schema: schema}, payload)
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	if record["ULTRACLUB_ID"] != int64(7) || record["CURRENT_TIER"] != "gold" {
+		t.Errorf("record = %v", record)
+	}
+	if record["UPDATE_DATE"] != updated || record["CREATED"] != updated {
+		t.Errorf("timestamps = %v, %v", record["UPDATE_DATE"], record["CREATED"])
+	}
+	if r, ok := record["BALANCE"].(*big.Rat); !ok || r.Cmp(big.NewRat(-1050, 100)) != 0 {
+		t.Errorf("balance = %v", record["BALANCE"])
+	}
+}
+
+func TestDecodeMapLocalTimestamps(t *testing.T) {
+	topic := &Topic{RawSchema: `{
+		"type": "record",
+		"name": "Checkin",
+		"fields": [
+			{"name": "id", "type": "long"},
+			{"name": "arrival", "type": {"type": "long", "logicalType": "local-timestamp-millis"}},
+			{"name": "departure", "type": ["null", {"type": "long", "logicalType": "local-timestamp-micros"}], "default": null},
+			{"name": "stops", "type": {"type": "array", "items": {"type": "long", "logicalType": "local-timestamp-millis"}}}
+		]
+	}`}
+	topic.Schema = avro.MustParse(topic.RawSchema)
+
+	wall := time.Date(2022, 3, 4, 10, 30, 0, 0, time.UTC)
+	data, err := avro.Marshal(topic.Schema, map[string]interface{}{
+		"id":        int64(7),
+		"arrival":   int64(NewLocalTimestampMillis(wall)),
+		"departure": map[string]interface{}{"long": int64(NewLocalTimestampMicros(wall))},
+		"stops":     []interface{}{int64(NewLocalTimestampMillis(wall))},
+	})
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	record, err := DecodeMap(topic, append([]byte{0, 0, 0, 0, 1}, data...))
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+
+	if record["id"] != int64(7) {
+		t.Errorf("id = %#v, expected %#v", record["id"], int64(7))
+	}
+	if arrival, ok := record["arrival"].(LocalTimestampMillis); !ok || !arrival.In(time.UTC).Equal(wall) {
+		t.Errorf("arrival = %#v, expected %v", record["arrival"], wall)
+	}
+	if departure, ok := record["departure"].(LocalTimestampMicros); !ok || !departure.In(time.UTC).Equal(wall) {
+		t.Errorf("departure = %#v, expected %v", record["departure"], wall)
+	}
+	if stops, ok := record["stops"].([]interface{}); !ok || len(stops) != 1 || stops[0] != NewLocalTimestampMillis(wall) {
+		t.Errorf("stops = %#v, expected [%v]", record["stops"], wall)
+	}
+
+	// A schema parsed again replaces the cached one instead of adding an entry.
+	topic.Schema = avro.MustParse(topic.RawSchema)
+	record, err = DecodeMap(topic, append([]byte{0, 0, 0, 0, 1}, data...))
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+	if _, ok := record["arrival"].(LocalTimestampMillis); !ok {
+		t.Errorf("arrival = %#v, expected %v", record["arrival"], wall)
+	}
+
+	entries := 0
+	localTimestampsCache.Range(func(key, value interface{}) bool {
+		if value.(parsedLocalTimestamps).schema == topic.Schema {
+			entries++
+		}
+		return true
+	})
+	if entries != 1 {
+		t.Errorf("cache entries = %d, expected 1", entries)
+	}
+}
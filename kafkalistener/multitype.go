@@ -0,0 +1,116 @@
+package kafkalistener
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+// ErrUnknownType is permanent, the message is acked without retrying it.
+var ErrUnknownType error = fmt.Errorf("%w: no handler for the record type", ErrPermanent)
+
+var errNoDeadLetterTopic = errors.New("dead letter policy without dead letter topic")
+
+// UnknownTypePolicy is what a MultiTypeRouteHandler does with the records without handler.
+type UnknownTypePolicy int
+
+const (
+	// SkipUnknown acks the records without handler.
+	SkipUnknown UnknownTypePolicy = iota
+	// FailUnknown returns ErrUnknownType.
+	FailUnknown
+	// DeadLetterUnknown publishes the records without handler, as they are, to the DeadLetterTopic.
+	DeadLetterUnknown
+)
+
+// TypeHandler handles the records of a type, schema is the schema they were written with.
+type TypeHandler func(msg *message.Message, schema avro.Schema) error
+
+// MultiTypeRouteHandler consumes a topic carrying several record types, dispatching
+// every message by the full name of the schema it was written with.
+type MultiTypeRouteHandler struct {
+	Name  string
+	Topic *Topic
+	// Handlers by the full name of the records, namespace included.
+	Handlers map[string]TypeHandler
+	Unknown  UnknownTypePolicy
+	// DeadLetterTopic receives the records without handler with DeadLetterUnknown.
+	DeadLetterTopic string
+	// Filters skip messages before their schema is resolved.
+	Filters []Filter
+}
+
+// HandleType decodes the records into a T before calling fn.
+func HandleType[T any](fn func(msg *message.Message, record *T) error) TypeHandler {
+	return func(msg *message.Message, schema avro.Schema) error {
+		var record T
+		err := avro.Unmarshal(schema, msg.Payload[5:], &record)
+		if err != nil {
+			return err
+		}
+
+		return fn(msg, &record)
+	}
+}
+
+// AddMultiTypeHandler registers a handler of a multi-type topic, the schemas
+// are resolved from the id of every message so the topic needs no schema.
+func (mb *MessageBroker) AddMultiTypeHandler(handler MultiTypeRouteHandler) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if handler.Unknown == DeadLetterUnknown {
+		if handler.DeadLetterTopic == "" {
+			return errNoDeadLetterTopic
+		}
+		if mb.publisher == nil {
+			return ErrPublishOnConsumeOnly
+		}
+	}
+
+	return mb.registerRoute(RouteHandler{
+		Name:        handler.Name,
+		Topic:       handler.Topic,
+		HandlerFunc: dispatchTypes(handler, mb.ResolveSchema, mb.publishDeadLetter),
+		Filters:     handler.Filters,
+	})
+}
+
+func (mb *MessageBroker) publishDeadLetter(topic string, msg *message.Message) error {
+	return mb.publisher.Publish(topic, msg.Copy())
+}
+
+// dispatchTypes returns the handler function calling the TypeHandler of each record.
+func dispatchTypes(
+	handler MultiTypeRouteHandler,
+	resolve func(payload message.Payload) (avro.Schema, error),
+	deadLetter func(topic string, msg *message.Message) error,
+) message.NoPublishHandlerFunc {
+	return func(msg *message.Message) error {
+		schema, err := resolve(msg.Payload)
+		if err != nil {
+			return err
+		}
+
+		name := string(schema.Type())
+		if named, ok := schema.(avro.NamedSchema); ok {
+			name = named.FullName()
+		}
+
+		if h, ok := handler.Handlers[name]; ok {
+			return h(msg, schema)
+		}
+
+		switch handler.Unknown {
+		case FailUnknown:
+			return fmt.Errorf("%w: %s", ErrUnknownType, name)
+		case DeadLetterUnknown:
+			return deadLetter(handler.DeadLetterTopic, msg)
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,77 @@
+package kafkalistener
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+type multiTypeOrder struct {
+	ID string `avro:"id"`
+}
+
+func TestDispatchTypes(t *testing.T) {
+	orderSchema := avro.MustParse(`{"type":"record","name":"Order","namespace":"shop","fields":[{"name":"id","type":"string"}]}`)
+	refundSchema := avro.MustParse(`{"type":"record","name":"Refund","namespace":"shop","fields":[{"name":"id","type":"string"}]}`)
+	schemas := map[byte]avro.Schema{1: orderSchema, 2: refundSchema}
+
+	resolve := func(payload message.Payload) (avro.Schema, error) {
+		return schemas[payload[4]], nil
+	}
+
+	payload := func(id byte, schema avro.Schema) message.Payload {
+		data, err := avro.Marshal(schema, multiTypeOrder{ID: "42"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return append([]byte{0, 0, 0, 0, id}, data...)
+	}
+
+	testcases := []struct {
+		Name               string
+		Payload            message.Payload
+		Unknown            UnknownTypePolicy
+		ExpectedOrder      bool
+		ExpectedDeadLetter bool
+		ExpectedError      error
+	}{
+		{Name: "Known type", Payload: payload(1, orderSchema), ExpectedOrder: true},
+		{Name: "Skip unknown type", Payload: payload(2, refundSchema), Unknown: SkipUnknown},
+		{Name: "Fail unknown type", Payload: payload(2, refundSchema), Unknown: FailUnknown, ExpectedError: ErrPermanent},
+		{Name: "Dead letter unknown type", Payload: payload(2, refundSchema), Unknown: DeadLetterUnknown, ExpectedDeadLetter: true},
+	}
+
+	for _, tc := range testcases {
+		var order *multiTypeOrder
+		var deadLetter string
+
+		handler := MultiTypeRouteHandler{
+			Handlers: map[string]TypeHandler{
+				"shop.Order": HandleType(func(msg *message.Message, record *multiTypeOrder) error {
+					order = record
+					return nil
+				}),
+			},
+			Unknown:         tc.Unknown,
+			DeadLetterTopic: "orders-dlq",
+		}
+
+		h := dispatchTypes(handler, resolve, func(topic string, msg *message.Message) error {
+			deadLetter = topic
+			return nil
+		})
+
+		err := h(message.NewMessage("1", tc.Payload))
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+		if (order != nil) != tc.ExpectedOrder || (order != nil && order.ID != "42") {
+			t.Errorf("%s: order = %+v, expected order %v", tc.Name, order, tc.ExpectedOrder)
+		}
+		if (deadLetter == "orders-dlq") != tc.ExpectedDeadLetter {
+			t.Errorf("%s: dead letter topic = %q, expected dead letter %v", tc.Name, deadLetter, tc.ExpectedDeadLetter)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package kafkalistener
+
+import (
+	"context"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// Metadata keys set by the publisher middlewares.
+const (
+	PublishedAtKey = "published_at"
+	ServiceKey     = "service"
+)
+
+// PublishHandlerFunc sends an encoded message to the topic.
+type PublishHandlerFunc func(topic *Topic, msg *message.Message) error
+
+// PublisherMiddleware wraps the publishing of messages,
+// it has the same shape as the watermill handler middlewares.
+// It runs once the record is encoded, EncoderMiddleware gets the record.
+type PublisherMiddleware func(h PublishHandlerFunc) PublishHandlerFunc
+
+// EncodeHandlerFunc encodes a record of the topic into a message.
+type EncodeHandlerFunc func(ctx context.Context, topic *Topic, data interface{}) (*message.Message, error)
+
+// EncoderMiddleware wraps the encoding of the published records, it gets the record
+// before it's encoded, to validate it, redact it or measure it, and can replace it.
+type EncoderMiddleware func(h EncodeHandlerFunc) EncodeHandlerFunc
+
+// AddPublisherMiddleware adds middlewares to Publish and Tx.Publish,
+// the first added middlewares are executed first.
+func (mb *MessageBroker) AddPublisherMiddleware(m ...PublisherMiddleware) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.publisherMiddlewares = append(mb.publisherMiddlewares, m...)
+}
+
+// AddEncoderMiddleware adds middlewares to the encoding of the records of Publish, Tx.Publish,
+// Request and Reply, the first added middlewares are executed first.
+func (mb *MessageBroker) AddEncoderMiddleware(m ...EncoderMiddleware) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	mb.encoderMiddlewares = append(mb.encoderMiddlewares, m...)
+}
+
+// encodeChain wraps the encoding function with the encoder middlewares.
+func (mb *MessageBroker) encodeChain(h EncodeHandlerFunc) EncodeHandlerFunc {
+	mb.mu.Lock()
+	middlewares := mb.encoderMiddlewares
+	mb.mu.Unlock()
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// publishChain wraps the final publishing function with the publisher middlewares.
+func (mb *MessageBroker) publishChain(h PublishHandlerFunc) PublishHandlerFunc {
+	mb.mu.Lock()
+	middlewares := mb.publisherMiddlewares
+	mb.mu.Unlock()
+
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// PublishTimestamp stamps the messages with the time they're published.
+func PublishTimestamp(h PublishHandlerFunc) PublishHandlerFunc {
+	return func(topic *Topic, msg *message.Message) error {
+		msg.Metadata.Set(PublishedAtKey, time.Now().UTC().Format(time.RFC3339Nano))
+		return h(topic, msg)
+	}
+}
+
+// PublishServiceName stamps the messages with the name of the publishing service.
+func PublishServiceName(service string) PublisherMiddleware {
+	return func(h PublishHandlerFunc) PublishHandlerFunc {
+		return func(topic *Topic, msg *message.Message) error {
+			msg.Metadata.Set(ServiceKey, service)
+			return h(topic, msg)
+		}
+	}
+}
+
+// PublishLogger logs the published messages and the publishing errors.
+func PublishLogger(logger watermill.LoggerAdapter) PublisherMiddleware {
+	return func(h PublishHandlerFunc) PublishHandlerFunc {
+		return func(topic *Topic, msg *message.Message) error {
+			start := time.Now()
+			err := h(topic, msg)
+
+			fields := watermill.LogFields{
+				"topic":    topic.Name,
+				"uuid":     msg.UUID,
+				"bytes":    len(msg.Payload),
+				"duration": time.Since(start),
+			}
+			if err != nil {
+				logger.Error("Error publishing message", err, fields)
+			} else {
+				logger.Debug("Message published", fields)
+			}
+
+			return err
+		}
+	}
+}
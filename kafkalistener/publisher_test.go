@@ -0,0 +1,115 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestPublisherMiddleware(t *testing.T) {
+	mb := &MessageBroker{}
+
+	calls := []string{}
+	trace := func(name string) PublisherMiddleware {
+		return func(h PublishHandlerFunc) PublishHandlerFunc {
+			return func(topic *Topic, msg *message.Message) error {
+				calls = append(calls, name)
+				return h(topic, msg)
+			}
+		}
+	}
+
+	mb.AddPublisherMiddleware(trace("first"), PublishTimestamp, PublishServiceName("bookings"))
+	mb.AddPublisherMiddleware(trace("second"))
+
+	errPublish := errors.New("publish failed")
+	var published *message.Message
+	publish := mb.publishChain(func(topic *Topic, msg *message.Message) error {
+		calls = append(calls, "publish "+topic.Name)
+		published = msg
+		return errPublish
+	})
+
+	err := publish(&Topic{Name: "reservations"}, message.NewMessage("1", []byte{0}))
+	if err != errPublish {
+		t.Errorf("error = %v, expected %v", err, errPublish)
+	}
+
+	expected := []string{"first", "second", "publish reservations"}
+	if !reflect.DeepEqual(calls, expected) {
+		t.Errorf("calls = %v, expected %v", calls, expected)
+	}
+
+	if published.Metadata.Get(ServiceKey) != "bookings" || published.Metadata.Get(PublishedAtKey) == "" {
+		t.Errorf("metadata = %v", published.Metadata)
+	}
+}
+
+func TestEncoderMiddleware(t *testing.T) {
+	type reservation struct {
+		Email  string
+		Nights int64
+	}
+
+	errInvalid := errors.New("nights must be positive")
+
+	mb := &MessageBroker{}
+	mb.AddEncoderMiddleware(
+		// Validation
+		func(h EncodeHandlerFunc) EncodeHandlerFunc {
+			return func(ctx context.Context, topic *Topic, data interface{}) (*message.Message, error) {
+				if data.(reservation).Nights <= 0 {
+					return nil, errInvalid
+				}
+				return h(ctx, topic, data)
+			}
+		},
+		// Redaction
+		func(h EncodeHandlerFunc) EncodeHandlerFunc {
+			return func(ctx context.Context, topic *Topic, data interface{}) (*message.Message, error) {
+				r := data.(reservation)
+				r.Email = ""
+				return h(ctx, topic, r)
+			}
+		},
+	)
+
+	var encoded []interface{}
+	encode := mb.encodeChain(func(ctx context.Context, topic *Topic, data interface{}) (*message.Message, error) {
+		encoded = append(encoded, data)
+		return message.NewMessage("1", nil), nil
+	})
+
+	testcases := []struct {
+		Name          string
+		Data          reservation
+		ExpectedData  []interface{}
+		ExpectedError error
+	}{
+		{
+			Name:          "Invalid record isn't encoded",
+			Data:          reservation{Email: "ana@test.com"},
+			ExpectedError: errInvalid,
+		},
+		{
+			Name:         "Redacted record",
+			Data:         reservation{Email: "ana@test.com", Nights: 2},
+			ExpectedData: []interface{}{reservation{Nights: 2}},
+		},
+	}
+
+	for _, tc := range testcases {
+		encoded = nil
+
+		_, err := encode(context.Background(), &Topic{Name: "reservations"}, tc.Data)
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+		if !reflect.DeepEqual(encoded, tc.ExpectedData) {
+			t.Errorf("%s: encoded = %v, expected %v", tc.Name, encoded, tc.ExpectedData)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package kafkalistener
+
+import (
+	"sort"
+
+	"github.com/IBM/sarama"
+)
+
+// RebalanceHooks are called when the consumer group assigns partitions to this
+// instance or revokes them, so handlers can load or flush per-partition state.
+//
+// Each handler has its own group session, so the hooks are called once per handler and topic.
+// OnRevoked is called after the messages of the revoked partitions are processed.
+type RebalanceHooks struct {
+	OnAssigned func(topic string, partitions []int32)
+	OnRevoked  func(topic string, partitions []int32)
+}
+
+// SetRebalanceHooks sets the callbacks for the partition assignments.
+func (mb *MessageBroker) SetRebalanceHooks(hooks RebalanceHooks) {
+	mb.assignmentMu.Lock()
+	defer mb.assignmentMu.Unlock()
+
+	mb.rebalanceHooks = hooks
+}
+
+// Assignment returns the partitions currently assigned to this instance by topic,
+// the partitions of the handlers of the same topic are merged.
+func (mb *MessageBroker) Assignment() map[string][]int32 {
+	mb.assignmentMu.Lock()
+	defer mb.assignmentMu.Unlock()
+
+	assignment := make(map[string][]int32)
+	for _, claims := range mb.assignment {
+		for topic, partitions := range claims {
+			assignment[topic] = append(assignment[topic], partitions...)
+		}
+	}
+	for _, partitions := range assignment {
+		sort.Slice(partitions, func(i, j int) bool { return partitions[i] < partitions[j] })
+	}
+
+	return assignment
+}
+
+// assigned keeps the claims of the group session of a handler.
+func (mb *MessageBroker) assigned(handler string, claims map[string][]int32) {
+	mb.assignmentMu.Lock()
+	if mb.assignment == nil {
+		mb.assignment = make(map[string]map[string][]int32)
+	}
+	assignment := make(map[string][]int32, len(claims))
+	for topic, partitions := range claims {
+		assignment[topic] = append([]int32(nil), partitions...)
+	}
+	mb.assignment[handler] = assignment
+	onAssigned := mb.rebalanceHooks.OnAssigned
+	mb.assignmentMu.Unlock()
+
+	if onAssigned == nil {
+		return
+	}
+	for topic, partitions := range claims {
+		onAssigned(topic, partitions)
+	}
+}
+
+// revoked forgets the claims of the group session of a handler.
+func (mb *MessageBroker) revoked(handler string, claims map[string][]int32) {
+	mb.assignmentMu.Lock()
+	delete(mb.assignment, handler)
+	onRevoked := mb.rebalanceHooks.OnRevoked
+	mb.assignmentMu.Unlock()
+
+	if onRevoked == nil {
+		return
+	}
+	for topic, partitions := range claims {
+		onRevoked(topic, partitions)
+	}
+}
+
+// rebalanceTracer hooks into the group sessions of the watermill subscriber of a handler,
+// it's the only extension point it has around the sarama consumer group handler.
+type rebalanceTracer struct {
+	mb      *MessageBroker
+	handler string
+}
+
+func (t rebalanceTracer) WrapConsumer(c sarama.Consumer) sarama.Consumer {
+	return c
+}
+
+func (t rebalanceTracer) WrapPartitionConsumer(pc sarama.PartitionConsumer) sarama.PartitionConsumer {
+	return pc
+}
+
+func (t rebalanceTracer) WrapConsumerGroupHandler(h sarama.ConsumerGroupHandler) sarama.ConsumerGroupHandler {
+	return rebalanceHandler{ConsumerGroupHandler: h, mb: t.mb, handler: t.handler}
+}
+
+func (t rebalanceTracer) WrapSyncProducer(cfg *sarama.Config, p sarama.SyncProducer) sarama.SyncProducer {
+	return p
+}
+
+type rebalanceHandler struct {
+	sarama.ConsumerGroupHandler
+	mb      *MessageBroker
+	handler string
+}
+
+func (h rebalanceHandler) Setup(session sarama.ConsumerGroupSession) error {
+	err := h.ConsumerGroupHandler.Setup(session)
+	if err != nil {
+		return err
+	}
+
+	h.mb.startCommitter(h.handler, session)
+	h.mb.assigned(h.handler, session.Claims())
+	return nil
+}
+
+// ConsumeClaim hands the committer of the session to the watermill handler.
+func (h rebalanceHandler) ConsumeClaim(session sarama.ConsumerGroupSession, claim sarama.ConsumerGroupClaim) error {
+	if c := h.mb.committer(h.handler); c != nil {
+		session = c
+	}
+
+	return h.ConsumerGroupHandler.ConsumeClaim(session, claim)
+}
+
+func (h rebalanceHandler) Cleanup(session sarama.ConsumerGroupSession) error {
+	h.mb.stopCommitter(h.handler)
+	h.mb.revoked(h.handler, session.Claims())
+	return h.ConsumerGroupHandler.Cleanup(session)
+}
@@ -0,0 +1,64 @@
+package kafkalistener
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/IBM/sarama"
+)
+
+type testGroupSession struct {
+	sarama.ConsumerGroupSession
+	claims map[string][]int32
+}
+
+func (s testGroupSession) Claims() map[string][]int32 {
+	return s.claims
+}
+
+type testGroupHandler struct {
+	sarama.ConsumerGroupHandler
+}
+
+func (h testGroupHandler) Setup(sarama.ConsumerGroupSession) error   { return nil }
+func (h testGroupHandler) Cleanup(sarama.ConsumerGroupSession) error { return nil }
+
+func TestRebalanceHooks(t *testing.T) {
+	mb := &MessageBroker{}
+
+	events := []string{}
+	mb.SetRebalanceHooks(RebalanceHooks{
+		OnAssigned: func(topic string, partitions []int32) { events = append(events, "assigned "+topic) },
+		OnRevoked:  func(topic string, partitions []int32) { events = append(events, "revoked "+topic) },
+	})
+
+	reservations := rebalanceTracer{mb: mb, handler: "reservations"}.WrapConsumerGroupHandler(testGroupHandler{})
+	payments := rebalanceTracer{mb: mb, handler: "payments"}.WrapConsumerGroupHandler(testGroupHandler{})
+	// The audit handler reads the reservations too, in its own session.
+	audit := rebalanceTracer{mb: mb, handler: "reservations-audit"}.WrapConsumerGroupHandler(testGroupHandler{})
+
+	reservationsSession := testGroupSession{claims: map[string][]int32{"reservations": {2, 0}}}
+	paymentsSession := testGroupSession{claims: map[string][]int32{"payments": {1}}}
+	auditSession := testGroupSession{claims: map[string][]int32{"reservations": {1}}}
+
+	_ = reservations.Setup(reservationsSession)
+	_ = payments.Setup(paymentsSession)
+	_ = audit.Setup(auditSession)
+
+	expected := map[string][]int32{"reservations": {0, 1, 2}, "payments": {1}}
+	if !reflect.DeepEqual(mb.Assignment(), expected) {
+		t.Errorf("assignment = %v, expected %v", mb.Assignment(), expected)
+	}
+
+	_ = reservations.Cleanup(reservationsSession)
+
+	expected = map[string][]int32{"reservations": {1}, "payments": {1}}
+	if !reflect.DeepEqual(mb.Assignment(), expected) {
+		t.Errorf("assignment = %v, expected %v", mb.Assignment(), expected)
+	}
+
+	expectedEvents := []string{"assigned reservations", "assigned payments", "assigned reservations", "revoked reservations"}
+	if !reflect.DeepEqual(events, expectedEvents) {
+		t.Errorf("events = %v, expected %v", events, expectedEvents)
+	}
+}
@@ -0,0 +1,420 @@
+package kafkalistener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro/ocf"
+)
+
+var errRecordFormat = errors.New("unknown recording format")
+
+// RecordFormat is the file format of the recordings.
+type RecordFormat string
+
+const (
+	// RecordJSONL writes a JSON object per line, the payloads are base64 encoded.
+	RecordJSONL RecordFormat = "jsonl"
+	// RecordAvro writes avro object container files.
+	RecordAvro RecordFormat = "avro"
+)
+
+// recordSchema is the schema of the RecordedMessage in the avro recordings.
+const recordSchema = `{
+	"type": "record",
+	"name": "RecordedMessage",
+	"namespace": "kafkalistener",
+	"fields": [
+		{"name": "uuid", "type": "string"},
+		{"name": "topic", "type": "string"},
+		{"name": "key", "type": "bytes"},
+		{"name": "partition", "type": "int"},
+		{"name": "offset", "type": "long"},
+		{"name": "timestamp", "type": {"type": "long", "logicalType": "timestamp-millis"}},
+		{"name": "metadata", "type": {"type": "map", "values": "string"}},
+		{"name": "payload", "type": "bytes"}
+	]
+}`
+
+// RecordedMessage is a consumed message as it's kept in the recordings,
+// the payload is kept as it was consumed, schema id included.
+type RecordedMessage struct {
+	UUID      string            `json:"uuid" avro:"uuid"`
+	Topic     string            `json:"topic" avro:"topic"`
+	Key       []byte            `json:"key,omitempty" avro:"key"`
+	Partition int32             `json:"partition" avro:"partition"`
+	Offset    int64             `json:"offset" avro:"offset"`
+	Timestamp time.Time         `json:"timestamp" avro:"timestamp"`
+	Metadata  map[string]string `json:"metadata,omitempty" avro:"metadata"`
+	Payload   []byte            `json:"payload" avro:"payload"`
+}
+
+// RecorderConfig sets where and how the consumed messages are recorded.
+// A recording file is rotated when it reaches MaxBytes or MaxAge, zero values never rotate.
+type RecorderConfig struct {
+	Dir      string        `yaml:"dir"`
+	Format   RecordFormat  `yaml:"format"`
+	MaxBytes int64         `yaml:"max_bytes"`
+	MaxAge   time.Duration `yaml:"max_age"`
+}
+
+// Recorder archives the consumed messages into a file per topic,
+// named after the topic and the time the file was created.
+type Recorder struct {
+	config RecorderConfig
+	mu     sync.Mutex
+	files  map[string]*recordFile
+	// last is the offset, or the UUID, of the last message recorded by topic and partition.
+	last map[string]string
+}
+
+// recordFile is the current recording of a topic.
+type recordFile struct {
+	file    *os.File
+	size    int64
+	created time.Time
+	// encoder is nil for JSONL recordings.
+	encoder *ocf.Encoder
+}
+
+func (f *recordFile) Write(p []byte) (int, error) {
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+// NewRecorder creates a recorder, the directory is created if it doesn't exist.
+func NewRecorder(config RecorderConfig) (*Recorder, error) {
+	if config.Format == "" {
+		config.Format = RecordJSONL
+	}
+	if config.Format != RecordJSONL && config.Format != RecordAvro {
+		return nil, fmt.Errorf("%w: %s", errRecordFormat, config.Format)
+	}
+
+	err := os.MkdirAll(config.Dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Recorder{config: config, files: make(map[string]*recordFile), last: make(map[string]string)}, nil
+}
+
+// SetRecorder records the messages consumed by every route handler before they are handled,
+// once per message: retries and redeliveries of the message aren't recorded again.
+func (mb *MessageBroker) SetRecorder(recorder *Recorder) {
+	mb.recorder = recorder
+}
+
+// Middleware records the messages before calling the handler, skipping the retries and
+// redeliveries of the last message recorded of each partition.
+// Messages that can't be recorded are still handled.
+func (r *Recorder) Middleware() message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			topic := message.SubscribeTopicFromCtx(msg.Context())
+			if r.firstDelivery(topic, msg) {
+				err := r.Record(topic, msg)
+				if err != nil {
+					log.Println("Error recording message: ", err)
+				}
+			}
+
+			return h(msg)
+		}
+	}
+}
+
+// firstDelivery tells if the message isn't the last one recorded of its partition. Messages are
+// told apart by offset, or by UUID when they weren't consumed from kafka.
+func (r *Recorder) firstDelivery(topic string, msg *message.Message) bool {
+	key, id := topic, msg.UUID
+	if partition, ok := kafka.MessagePartitionFromCtx(msg.Context()); ok {
+		offset, _ := kafka.MessagePartitionOffsetFromCtx(msg.Context())
+		key, id = topic+"/"+strconv.Itoa(int(partition)), strconv.FormatInt(offset, 10)
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.last[key] == id {
+		return false
+	}
+	r.last[key] = id
+
+	return true
+}
+
+// Record appends a message consumed from the topic to its recording.
+func (r *Recorder) Record(topic string, msg *message.Message) error {
+	recorded := RecordedMessage{
+		UUID:     msg.UUID,
+		Topic:    topic,
+		Key:      []byte(messageKey(msg)),
+		Metadata: msg.Metadata,
+		Payload:  msg.Payload,
+	}
+	recorded.Partition, _ = kafka.MessagePartitionFromCtx(msg.Context())
+	recorded.Offset, _ = kafka.MessagePartitionOffsetFromCtx(msg.Context())
+	recorded.Timestamp, _ = messageTimestamp(msg)
+	if recorded.Metadata == nil {
+		recorded.Metadata = map[string]string{}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	f, err := r.file(topic)
+	if err != nil {
+		return err
+	}
+
+	if f.encoder != nil {
+		err = f.encoder.Encode(recorded)
+		if err != nil {
+			return err
+		}
+		return f.encoder.Flush()
+	}
+
+	line, err := json.Marshal(recorded)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	return err
+}
+
+// file returns the recording of the topic, rotating it when it's full or too old.
+// The caller must hold r.mu.
+func (r *Recorder) file(topic string) (*recordFile, error) {
+	f := r.files[topic]
+	if f != nil && !r.full(f) {
+		return f, nil
+	}
+
+	if f != nil {
+		delete(r.files, topic)
+		err := f.file.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if !topicNamePattern.MatchString(topic) || topic == "." || topic == ".." {
+		return nil, fmt.Errorf("%w: %s", errTopicName, topic)
+	}
+
+	file, created, err := createRecording(r.config.Dir, topic, r.config.Format)
+	if err != nil {
+		return nil, err
+	}
+
+	f = &recordFile{file: file, created: created}
+	if r.config.Format == RecordAvro {
+		f.encoder, err = ocf.NewEncoder(recordSchema, f)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	r.files[topic] = f
+	return f, nil
+}
+
+// createRecording creates a recording named after its creation time, a recording created
+// in the same nanosecond takes the next one so the recordings keep sorted by name.
+func createRecording(dir, topic string, format RecordFormat) (*os.File, time.Time, error) {
+	created := time.Now().UTC()
+	for {
+		name := fmt.Sprintf("%s-%s.%s", topic, created.Format("20060102T150405.000000000"), format)
+
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if !errors.Is(err, os.ErrExist) {
+			return file, created, err
+		}
+
+		created = created.Add(time.Nanosecond)
+	}
+}
+
+func (r *Recorder) full(f *recordFile) bool {
+	if r.config.MaxBytes > 0 && f.size >= r.config.MaxBytes {
+		return true
+	}
+
+	return r.config.MaxAge > 0 && time.Since(f.created) >= r.config.MaxAge
+}
+
+// Close closes the recordings, the next recorded messages go to new files.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var errs []error
+	for topic, f := range r.files {
+		errs = append(errs, f.file.Close())
+		delete(r.files, topic)
+	}
+
+	return errors.Join(errs...)
+}
+
+// Replay feeds the messages recorded from the topic of the handler back into it, in the order
+// they were consumed, and returns how many were handled. The path is a recording or a directory of them.
+//
+// The messages go through the same middlewares as in the route handlers: the filters, the claim-check
+// and decryption of the broker, the record filters and the validation, which need the schema of the
+// topic to be set. The broker doesn't need to be enabled.
+// The kafka key and timestamp are in the PartitionKeyKey and PublishedAtKey metadata when the message
+// doesn't have them already. Replay stops at the first error.
+func (mb *MessageBroker) Replay(ctx context.Context, path string, handler RouteHandler) (int, error) {
+	files, err := recordingFiles(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var skipped atomic.Uint64
+	h := chain(func(msg *message.Message) ([]*message.Message, error) {
+		return nil, handler.HandlerFunc(msg)
+	}, mb.routeMiddlewares(handler, &skipped))
+
+	var replayed int
+	for _, file := range files {
+		err = readRecording(file, func(recorded RecordedMessage) error {
+			if recorded.Topic != handler.Topic.Name {
+				return nil
+			}
+
+			err := ctx.Err()
+			if err != nil {
+				return err
+			}
+
+			_, err = h(recorded.message(ctx))
+			if err != nil {
+				return fmt.Errorf("replaying message %s of %s: %w", recorded.UUID, file, err)
+			}
+
+			replayed++
+			return nil
+		})
+		if err != nil {
+			return replayed - int(skipped.Load()), err
+		}
+	}
+
+	return replayed - int(skipped.Load()), nil
+}
+
+// message rebuilds the consumed message.
+func (recorded RecordedMessage) message(ctx context.Context) *message.Message {
+	msg := message.NewMessage(recorded.UUID, recorded.Payload)
+	for k, v := range recorded.Metadata {
+		msg.Metadata.Set(k, v)
+	}
+
+	if len(recorded.Key) > 0 && msg.Metadata.Get(PartitionKeyKey) == "" {
+		msg.Metadata.Set(PartitionKeyKey, string(recorded.Key))
+	}
+	if !recorded.Timestamp.IsZero() && msg.Metadata.Get(PublishedAtKey) == "" {
+		msg.Metadata.Set(PublishedAtKey, recorded.Timestamp.Format(time.RFC3339Nano))
+	}
+
+	msg.SetContext(ctx)
+	return msg
+}
+
+// recordingFiles returns the recording or the recordings of the directory sorted by name,
+// which sorts the recordings of a topic by creation time.
+func recordingFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var files []string
+	for _, entry := range entries {
+		ext := strings.TrimPrefix(filepath.Ext(entry.Name()), ".")
+		if !entry.IsDir() && (ext == string(RecordJSONL) || ext == string(RecordAvro)) {
+			files = append(files, filepath.Join(path, entry.Name()))
+		}
+	}
+	sort.Strings(files)
+
+	return files, nil
+}
+
+// readRecording calls fn with every message of a recording, its format is taken from the extension.
+func readRecording(path string, fn func(recorded RecordedMessage) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	switch RecordFormat(strings.TrimPrefix(filepath.Ext(path), ".")) {
+	case RecordJSONL:
+		decoder := json.NewDecoder(f)
+		for {
+			var recorded RecordedMessage
+			err = decoder.Decode(&recorded)
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+
+			err = fn(recorded)
+			if err != nil {
+				return err
+			}
+		}
+	case RecordAvro:
+		decoder, err := ocf.NewDecoder(f)
+		if err != nil {
+			return err
+		}
+
+		for decoder.HasNext() {
+			var recorded RecordedMessage
+			err = decoder.Decode(&recorded)
+			if err != nil {
+				return err
+			}
+
+			err = fn(recorded)
+			if err != nil {
+				return err
+			}
+		}
+		return decoder.Error()
+	}
+
+	return fmt.Errorf("%w: %s", errRecordFormat, path)
+}
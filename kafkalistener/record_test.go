@@ -0,0 +1,178 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+func TestRecordReplay(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Format        RecordFormat
+		MaxBytes      int64
+		ExpectedFiles int
+	}{
+		{Name: "JSON lines", Format: RecordJSONL, ExpectedFiles: 2},
+		{Name: "Avro", Format: RecordAvro, ExpectedFiles: 2},
+		{Name: "Rotated by size", Format: RecordJSONL, MaxBytes: 1, ExpectedFiles: 5},
+	}
+
+	for _, tc := range testcases {
+		dir := t.TempDir()
+
+		recorder, err := NewRecorder(RecorderConfig{Dir: dir, Format: tc.Format, MaxBytes: tc.MaxBytes})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 4; i++ {
+			msg := message.NewMessage(fmt.Sprint(i), []byte{0, 0, 0, 0, 1, byte(i)})
+			msg.Metadata.Set("source", "web")
+			if i == 2 {
+				msg.Metadata.Set("source", "batch")
+			}
+
+			err = recorder.Record("orders", msg)
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		err = recorder.Record("payments", message.NewMessage("payment", []byte{0}))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = recorder.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(entries) != tc.ExpectedFiles {
+			t.Errorf("%s: recordings = %d, expected %d", tc.Name, len(entries), tc.ExpectedFiles)
+		}
+
+		var replayed []string
+		handled, err := (&MessageBroker{}).Replay(context.Background(), dir, RouteHandler{
+			Topic:   &Topic{Name: "orders"},
+			Filters: []Filter{HeaderEquals("source", "web")},
+			HandlerFunc: func(msg *message.Message) error {
+				replayed = append(replayed, fmt.Sprint(msg.UUID, ":", msg.Payload[5]))
+				return nil
+			},
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+
+		if handled != 3 || fmt.Sprint(replayed) != "[0:0 1:1 3:3]" {
+			t.Errorf("%s: handled = %d %v, expected 3 [0:0 1:1 3:3]", tc.Name, handled, replayed)
+		}
+	}
+}
+
+func TestReplayStopsOnError(t *testing.T) {
+	dir := t.TempDir()
+
+	recorder, err := NewRecorder(RecorderConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		err = recorder.Record("orders", message.NewMessage(fmt.Sprint(i), []byte{0}))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	recorder.Close()
+
+	errHandler := errors.New("invalid order")
+	handled, err := (&MessageBroker{}).Replay(context.Background(), dir, RouteHandler{
+		Topic: &Topic{Name: "orders"},
+		HandlerFunc: func(msg *message.Message) error {
+			if msg.UUID == "1" {
+				return errHandler
+			}
+			return nil
+		},
+	})
+	if !errors.Is(err, errHandler) || handled != 1 {
+		t.Errorf("handled = %d, error = %v, expected 1 %v", handled, err, errHandler)
+	}
+}
+
+func TestRecordOncePerDelivery(t *testing.T) {
+	recorder, err := NewRecorder(RecorderConfig{Dir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	first := message.NewMessage("1", []byte{0})
+	second := message.NewMessage("2", []byte{0})
+
+	// The retries of a message reach the recorder with the same message.
+	deliveries := []*message.Message{first, first, first, second, second}
+	var recorded int
+	for _, msg := range deliveries {
+		if recorder.firstDelivery("orders", msg) {
+			recorded++
+		}
+	}
+
+	if recorded != 2 {
+		t.Errorf("recorded = %d, expected 2", recorded)
+	}
+}
+
+func TestReplayMiddlewares(t *testing.T) {
+	dir := t.TempDir()
+
+	blobStore, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = blobStore.Put(context.Background(), "1", []byte("large order"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder, err := NewRecorder(RecorderConfig{Dir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := message.NewMessage("1", []byte("1"))
+	msg.Metadata.Set(ClaimCheckKey, "1")
+	err = recorder.Record("orders", msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	recorder.Close()
+
+	mb := &MessageBroker{}
+	mb.SetClaimCheck(blobStore, 0)
+
+	var payload string
+	_, err = mb.Replay(context.Background(), dir, RouteHandler{
+		Topic: &Topic{Name: "orders"},
+		HandlerFunc: func(msg *message.Message) error {
+			payload = string(msg.Payload)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if payload != "large order" {
+		t.Errorf("payload = %s, expected large order", payload)
+	}
+}
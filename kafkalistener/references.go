@@ -0,0 +1,153 @@
+package kafkalistener
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+)
+
+var (
+	errReferenceVersion = errors.New("registered version of the schema reference not found")
+	errReferenceSchema  = errors.New("version of the schema reference doesn't hold its raw schema")
+)
+
+// SchemaReference is a schema referenced by name from the schema of a topic,
+// like a record shared by several events.
+type SchemaReference struct {
+	// Name is the full name of the referenced type, as it's used in the referencing schema.
+	Name string
+	// Subject is the subject of the referenced schema in the registry.
+	Subject string
+	// Version of the subject, the latest one when it's zero.
+	// With RawSchema set, it must be the version the registry keeps the schema as.
+	Version int
+	// RawSchema is registered in the subject when it's set, otherwise the subject must exist.
+	RawSchema string
+	// References are the schemas referenced by this one.
+	References []SchemaReference
+}
+
+// resolveReferences registers and parses the referenced schemas in dependency order, so the
+// schemas referencing them can be parsed, and returns them as registry references.
+// Resolved keeps the references already resolved by subject and version.
+func (mb *MessageBroker) resolveReferences(refs []SchemaReference, resolved map[string]registry.SchemaReference) ([]registry.SchemaReference, error) {
+	var registryRefs []registry.SchemaReference
+
+	for _, ref := range refs {
+		key := fmt.Sprintf("%s/%d", ref.Subject, ref.Version)
+		if r, ok := resolved[key]; ok {
+			registryRefs = append(registryRefs, registry.SchemaReference{Name: ref.Name, Subject: r.Subject, Version: r.Version})
+			continue
+		}
+
+		nested, err := mb.resolveReferences(ref.References, resolved)
+		if err != nil {
+			return nil, err
+		}
+
+		version, err := mb.resolveReference(ref, nested)
+		if err != nil {
+			return nil, fmt.Errorf("schema reference %s: %w", ref.Subject, err)
+		}
+
+		r := registry.SchemaReference{Name: ref.Name, Subject: ref.Subject, Version: version}
+		resolved[key] = r
+		registryRefs = append(registryRefs, r)
+	}
+
+	return registryRefs, nil
+}
+
+// resolveReference registers or fetches a referenced schema, which parses it, and returns its version.
+func (mb *MessageBroker) resolveReference(ref SchemaReference, nested []registry.SchemaReference) (int, error) {
+	if ref.RawSchema == "" {
+		if ref.Version > 0 {
+			_, err := mb.registryClient.GetSchemaByVersion(ref.Subject, ref.Version)
+			return ref.Version, err
+		}
+
+		info, err := mb.registryClient.GetLatestSchemaInfo(ref.Subject)
+		return info.Version, err
+	}
+
+	id, schema, err := mb.registryClient.CreateSchema(ref.Subject, ref.RawSchema, nested...)
+	if err != nil {
+		return 0, err
+	}
+	if ref.Version > 0 {
+		registered, err := mb.registryClient.GetSchemaByVersion(ref.Subject, ref.Version)
+		if err != nil {
+			return 0, err
+		}
+		if registered.Fingerprint() != schema.Fingerprint() {
+			return 0, fmt.Errorf("%w: version %d", errReferenceSchema, ref.Version)
+		}
+		return ref.Version, nil
+	}
+
+	info, err := mb.registryClient.GetLatestSchemaInfo(ref.Subject)
+	if err != nil {
+		return 0, err
+	}
+	if info.ID == id {
+		return info.Version, nil
+	}
+
+	// The schema was registered before, look for its version from the newest one.
+	versions, err := mb.registryClient.GetVersions(ref.Subject)
+	if err != nil {
+		return 0, err
+	}
+	for i := len(versions) - 1; i >= 0; i-- {
+		s, err := mb.registryClient.GetSchemaByVersion(ref.Subject, versions[i])
+		if err != nil {
+			return 0, err
+		}
+		if s.Fingerprint() == schema.Fingerprint() {
+			return versions[i], nil
+		}
+	}
+
+	return 0, errReferenceVersion
+}
+
+// parseLocalReferences parses the referenced schemas in dependency order in local mode.
+func parseLocalReferences(refs []SchemaReference) error {
+	for _, ref := range refs {
+		err := parseLocalReferences(ref.References)
+		if err != nil {
+			return err
+		}
+
+		if ref.RawSchema == "" {
+			return fmt.Errorf("schema reference %s: %w", ref.Subject, errNoSchemaProvided)
+		}
+
+		_, err = avro.Parse(ref.RawSchema)
+		if err != nil {
+			return fmt.Errorf("schema reference %s: %w", ref.Subject, err)
+		}
+	}
+
+	return nil
+}
+
+// setReferences keeps the references of a subject for the schemas registered when publishing.
+func (mb *MessageBroker) setReferences(subject string, refs []registry.SchemaReference) {
+	mb.schemaIDsMu.Lock()
+	defer mb.schemaIDsMu.Unlock()
+
+	if mb.schemaRefs == nil {
+		mb.schemaRefs = make(map[string][]registry.SchemaReference)
+	}
+	mb.schemaRefs[subject] = refs
+}
+
+func (mb *MessageBroker) references(subject string) []registry.SchemaReference {
+	mb.schemaIDsMu.Lock()
+	defer mb.schemaIDsMu.Unlock()
+
+	return mb.schemaRefs[subject]
+}
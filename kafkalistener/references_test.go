@@ -0,0 +1,201 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+)
+
+const (
+	refsAddressSchema  = `{"type":"record","name":"Address","namespace":"refstest","fields":[{"name":"city","type":"string"}]}`
+	refsCustomerSchema = `{"type":"record","name":"Customer","namespace":"refstest","fields":[{"name":"name","type":"string"},{"name":"address","type":"refstest.Address"}]}`
+	refsOrderSchema    = `{"type":"record","name":"Order","namespace":"refstest","fields":[{"name":"customer","type":"refstest.Customer"},{"name":"shipping","type":"refstest.Address"}]}`
+)
+
+// refsRegistry keeps the versions of every subject and rejects schemas referencing unknown subjects.
+type refsRegistry struct {
+	registry.Registry
+	subjects map[string][]string
+	// created are the subjects and references of the registered schemas, in order.
+	created []string
+}
+
+func (r *refsRegistry) CreateSchema(subject, schema string, references ...registry.SchemaReference) (int, avro.Schema, error) {
+	for _, ref := range references {
+		if len(r.subjects[ref.Subject]) < ref.Version {
+			return 0, nil, registry.Error{StatusCode: 422, Message: "unknown reference " + ref.Subject}
+		}
+	}
+
+	parsed, err := avro.Parse(schema)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	r.created = append(r.created, fmt.Sprintf("%s %v", subject, references))
+
+	versions := r.subjects[subject]
+	for i, s := range versions {
+		if s == schema {
+			return 100*len(r.subjects) + i, parsed, nil
+		}
+	}
+	r.subjects[subject] = append(versions, schema)
+	return 100*len(r.subjects) + len(versions), parsed, nil
+}
+
+func (r *refsRegistry) GetLatestSchemaInfo(subject string) (registry.SchemaInfo, error) {
+	versions := r.subjects[subject]
+	if len(versions) == 0 {
+		return registry.SchemaInfo{}, registry.Error{StatusCode: 404}
+	}
+
+	schema, err := avro.Parse(versions[len(versions)-1])
+	return registry.SchemaInfo{Schema: schema, Version: len(versions)}, err
+}
+
+func (r *refsRegistry) GetLatestSchema(subject string) (avro.Schema, error) {
+	info, err := r.GetLatestSchemaInfo(subject)
+	return info.Schema, err
+}
+
+func (r *refsRegistry) GetSchemaByVersion(subject string, version int) (avro.Schema, error) {
+	if len(r.subjects[subject]) < version {
+		return nil, registry.Error{StatusCode: 404}
+	}
+	return avro.Parse(r.subjects[subject][version-1])
+}
+
+func (r *refsRegistry) GetVersions(subject string) ([]int, error) {
+	var versions []int
+	for i := range r.subjects[subject] {
+		versions = append(versions, i+1)
+	}
+	return versions, nil
+}
+
+func (r *refsRegistry) IsRegistered(subject, schema string) (int, avro.Schema, error) {
+	return 0, nil, registry.Error{StatusCode: 404}
+}
+
+func TestSchemaReferences(t *testing.T) {
+	reg := &refsRegistry{subjects: map[string][]string{
+		// The address was registered before with an older version.
+		"address": {`{"type":"record","name":"Address","namespace":"refstest","fields":[]}`, refsAddressSchema},
+	}}
+	mb := &MessageBroker{enabled: true, registryClient: reg}
+
+	address := SchemaReference{Name: "refstest.Address", Subject: "address", RawSchema: refsAddressSchema}
+	topic := &Topic{
+		Name:           "orders",
+		RawSchema:      refsOrderSchema,
+		RegisterSchema: true,
+		References: []SchemaReference{
+			{
+				Name:       "refstest.Customer",
+				Subject:    "customer",
+				RawSchema:  refsCustomerSchema,
+				References: []SchemaReference{address},
+			},
+			address,
+		},
+	}
+
+	err := mb.SetSchema(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if topic.Schema.(*avro.RecordSchema).FullName() != "refstest.Order" {
+		t.Errorf("schema = %s, expected refstest.Order", topic.Schema.String())
+	}
+
+	expected := []string{
+		"address []",
+		"customer [{refstest.Address address 2}]",
+		"orders-value [{refstest.Customer customer 1} {refstest.Address address 2}]",
+	}
+	if fmt.Sprint(reg.created) != fmt.Sprint(expected) {
+		t.Errorf("created = %v, expected %v", reg.created, expected)
+	}
+
+	// Publishing registers the schema with the same references.
+	compact, err := compactSchema(topic.RawSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = mb.schemaID(context.Background(), "orders-value", compact)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := reg.created[len(reg.created)-1]; last != expected[2] {
+		t.Errorf("published = %s, expected %s", last, expected[2])
+	}
+
+	// The references without schema are fetched from the registry.
+	consumer := &Topic{
+		Name:       "orders",
+		References: []SchemaReference{{Name: "refstest.Customer", Subject: "customer", Version: 1}},
+	}
+	err = mb.SetSchema(consumer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if consumer.Schema == nil {
+		t.Error("schema = nil, expected the latest schema of the topic")
+	}
+}
+
+func TestSchemaReferenceVersion(t *testing.T) {
+	oldAddress := `{"type":"record","name":"Address","namespace":"refstest","fields":[]}`
+
+	testcases := []struct {
+		Name            string
+		Version         int
+		ExpectedVersion int
+		ExpectedError   error
+	}{
+		{Name: "Latest version", ExpectedVersion: 2},
+		{Name: "Version holding the schema", Version: 2, ExpectedVersion: 2},
+		{Name: "Version holding another schema", Version: 1, ExpectedError: errReferenceSchema},
+	}
+
+	for _, tc := range testcases {
+		reg := &refsRegistry{subjects: map[string][]string{"address": {oldAddress, refsAddressSchema}}}
+		mb := &MessageBroker{enabled: true, registryClient: reg}
+
+		ref := SchemaReference{Name: "refstest.Address", Subject: "address", Version: tc.Version, RawSchema: refsAddressSchema}
+		version, err := mb.resolveReference(ref, nil)
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+		if version != tc.ExpectedVersion {
+			t.Errorf("%s: version = %d, expected %d", tc.Name, version, tc.ExpectedVersion)
+		}
+	}
+}
+
+func TestLocalSchemaReferences(t *testing.T) {
+	topic := &Topic{
+		Name:      "orders",
+		RawSchema: refsOrderSchema,
+		References: []SchemaReference{
+			{Name: "refstest.Address", Subject: "address", RawSchema: refsAddressSchema},
+			{Name: "refstest.Customer", Subject: "customer"},
+		},
+	}
+
+	err := setLocalSchema(topic)
+	if err == nil {
+		t.Error("error = nil, expected an error for a reference without schema")
+	}
+
+	topic.References[1].RawSchema = refsCustomerSchema
+	err = setLocalSchema(topic)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
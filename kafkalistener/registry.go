@@ -0,0 +1,171 @@
+package kafkalistener
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hamba/avro/registry"
+	tlskit "github.com/sanservices/kit/tls"
+)
+
+const (
+	// DefaultRegistryTimeout is the timeout of each registry request when it's not set.
+	DefaultRegistryTimeout = 10 * time.Second
+	// DefaultRegistryBackoff is the wait before the first retry when it's not set, it doubles on every retry.
+	DefaultRegistryBackoff = 500 * time.Millisecond
+)
+
+var errNoRegistryURL = errors.New("no schema registry url configured")
+
+// RegistryConfig sets the authentication, failover and retries of the schema registry requests.
+type RegistryConfig struct {
+	// URLs are tried in order after the schema_registration url when it's unreachable or fails with a 5xx.
+	URLs []string `yaml:"urls"`
+	// Username and Password are sent with basic auth, BearerToken takes precedence over them.
+	Username    string `yaml:"username"`
+	Password    string `yaml:"password"`
+	BearerToken string `yaml:"bearer_token"`
+	// Timeout is the timeout of every request to a registry.
+	Timeout time.Duration `yaml:"timeout"`
+	// Retries is how many more times every url is tried, waiting Backoff before the first retry.
+	Retries int           `yaml:"retries"`
+	Backoff time.Duration `yaml:"backoff"`
+}
+
+// GetRegistryClient creates the client of a single schema registry without authentication.
+func GetRegistryClient(tlsConfig *tls.Config, schemaReg string) (*registry.Client, error) {
+	return NewRegistryClient(tlsConfig, schemaReg, RegistryConfig{})
+}
+
+// NewRegistryClient creates the client of the schema registry at schemaReg and the failover URLs of the config.
+func NewRegistryClient(tlsConfig *tls.Config, schemaReg string, config RegistryConfig) (*registry.Client, error) {
+	var urls []*url.URL
+	for _, raw := range append([]string{schemaReg}, config.URLs...) {
+		if raw == "" {
+			continue
+		}
+
+		u, err := url.Parse(strings.TrimSuffix(raw, "/"))
+		if err != nil {
+			return nil, err
+		}
+		urls = append(urls, u)
+	}
+
+	if len(urls) == 0 {
+		return nil, errNoRegistryURL
+	}
+
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultRegistryTimeout
+	}
+	if config.Backoff <= 0 {
+		config.Backoff = DefaultRegistryBackoff
+	}
+
+	httpsClient := tlskit.GetHTTPSClient(tlsConfig)
+	httpsClient.Transport = &registryTransport{
+		next:   httpsClient.Transport,
+		urls:   urls,
+		config: config,
+	}
+
+	return registry.NewClient(urls[0].String(), registry.WithHTTPClient(httpsClient))
+}
+
+// registryTransport sends the requests of the registry client, built for the first url,
+// to the url that answered last, failing over to the next ones.
+type registryTransport struct {
+	next   http.RoundTripper
+	urls   []*url.URL
+	config RegistryConfig
+	// current is the index of the url that answered last.
+	current atomic.Int32
+}
+
+func (t *registryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		body, err = io.ReadAll(req.Body)
+		req.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var resp *http.Response
+	var err error
+	for retry := 0; ; retry++ {
+		start := int(t.current.Load())
+
+		for i := range t.urls {
+			if resp != nil {
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+
+			index := (start + i) % len(t.urls)
+			resp, err = t.send(req, body, t.urls[index])
+			if err == nil && resp.StatusCode < http.StatusInternalServerError {
+				t.current.Store(int32(index))
+				return resp, nil
+			}
+		}
+
+		if retry >= t.config.Retries || !sleepContext(req.Context(), t.config.Backoff<<retry) {
+			return resp, err
+		}
+	}
+}
+
+// send sends the request to target with the timeout and the credentials of the config.
+func (t *registryTransport) send(req *http.Request, body []byte, target *url.URL) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.config.Timeout)
+
+	r := req.Clone(ctx)
+	r.URL.Scheme = target.Scheme
+	r.URL.Host = target.Host
+	r.URL.Path = target.Path + strings.TrimPrefix(req.URL.Path, t.urls[0].Path)
+	r.URL.RawPath = ""
+	r.Host = ""
+
+	if body != nil {
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		r.ContentLength = int64(len(body))
+	}
+
+	if t.config.BearerToken != "" {
+		r.Header.Set("Authorization", "Bearer "+t.config.BearerToken)
+	} else if t.config.Username != "" || t.config.Password != "" {
+		r.SetBasicAuth(t.config.Username, t.config.Password)
+	}
+
+	resp, err := t.next.RoundTrip(r)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	// The timeout covers reading the body too.
+	resp.Body = cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b cancelBody) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
+}
@@ -0,0 +1,119 @@
+package kafkalistener
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro/registry"
+)
+
+func TestRegistryFailover(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	testcases := []struct {
+		Name string
+		// Failures is how many requests fail with a 503 before the registry answers.
+		Failures      int32
+		Status        int
+		Config        RegistryConfig
+		ExpectedAuth  string
+		ExpectedCalls int32
+		ExpectedError int
+	}{
+		{
+			Name:          "Fail over an unreachable registry",
+			Status:        http.StatusOK,
+			ExpectedCalls: 1,
+		},
+		{
+			Name:          "Retry 5xx with backoff",
+			Failures:      2,
+			Status:        http.StatusOK,
+			Config:        RegistryConfig{Retries: 2, Backoff: time.Millisecond},
+			ExpectedCalls: 3,
+		},
+		{
+			Name:          "Give up after the retries",
+			Failures:      5,
+			Status:        http.StatusOK,
+			Config:        RegistryConfig{Retries: 1, Backoff: time.Millisecond},
+			ExpectedCalls: 2,
+			ExpectedError: http.StatusServiceUnavailable,
+		},
+		{
+			Name:          "4xx is not retried",
+			Status:        http.StatusUnauthorized,
+			Config:        RegistryConfig{Retries: 2, Backoff: time.Millisecond},
+			ExpectedCalls: 1,
+			ExpectedError: http.StatusUnauthorized,
+		},
+		{
+			Name:          "Basic auth",
+			Status:        http.StatusOK,
+			Config:        RegistryConfig{Username: "key", Password: "secret"},
+			ExpectedAuth:  "Basic a2V5OnNlY3JldA==",
+			ExpectedCalls: 1,
+		},
+		{
+			Name:          "Bearer token",
+			Status:        http.StatusOK,
+			Config:        RegistryConfig{BearerToken: "token", Username: "key"},
+			ExpectedAuth:  "Bearer token",
+			ExpectedCalls: 1,
+		},
+	}
+
+	for _, tc := range testcases {
+		var calls atomic.Int32
+		var auth string
+
+		up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := calls.Add(1)
+			auth = r.Header.Get("Authorization")
+
+			if r.URL.Path != "/registry/subjects" {
+				t.Errorf("%s: unexpected path %s", tc.Name, r.URL.Path)
+			}
+
+			if n <= tc.Failures {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(tc.Status)
+			w.Write([]byte(`["orders-value"]`))
+		}))
+
+		tc.Config.URLs = []string{up.URL + "/registry/"}
+		client, err := NewRegistryClient(nil, down.URL, tc.Config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		subjects, err := client.GetSubjects()
+
+		var registryErr registry.Error
+		if errors.As(err, &registryErr) {
+			if registryErr.StatusCode != tc.ExpectedError {
+				t.Errorf("%s: expected status %d, got %d", tc.Name, tc.ExpectedError, registryErr.StatusCode)
+			}
+		} else if err != nil || tc.ExpectedError != 0 {
+			t.Errorf("%s: expected status %d, got %v", tc.Name, tc.ExpectedError, err)
+		} else if len(subjects) != 1 {
+			t.Errorf("%s: expected the subjects, got %v", tc.Name, subjects)
+		}
+
+		if calls.Load() != tc.ExpectedCalls {
+			t.Errorf("%s: expected %d calls, got %d", tc.Name, tc.ExpectedCalls, calls.Load())
+		}
+		if auth != tc.ExpectedAuth {
+			t.Errorf("%s: expected authorization %q, got %q", tc.Name, tc.ExpectedAuth, auth)
+		}
+
+		up.Close()
+	}
+}
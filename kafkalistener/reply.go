@@ -0,0 +1,222 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+)
+
+var ErrNoReplyTo error = errors.New("message has no reply_to header")
+
+// ReplyToKey is the metadata key with the topic where the reply is expected.
+const ReplyToKey = "reply_to"
+
+// DefaultRequestTimeout is used by Request when the context has no deadline.
+const DefaultRequestTimeout = 30 * time.Second
+
+// replyListener reads a reply topic and hands the replies to the waiting requests.
+type replyListener struct {
+	subscriber message.Subscriber
+	mu         sync.Mutex
+	pending    map[string]chan *message.Message
+}
+
+// Request publishes a message with a correlation id and a reply_to header
+// and waits for the reply with the same correlation id in the reply topic.
+//
+// Replies are read by every instance from the newest offset, without consumer group.
+// They go through the claim-check, decryption and validation of the handlers of replyTopic.
+func (mb *MessageBroker) Request(ctx context.Context, topic *Topic, data interface{}, replyTopic *Topic) (*message.Message, error) {
+	if !mb.enabled {
+		return nil, ErrBrokerNotEnabled
+	}
+
+	if mb.publisher == nil {
+		return nil, ErrPublishOnConsumeOnly
+	}
+
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, DefaultRequestTimeout)
+		defer cancel()
+	}
+
+	listener, err := mb.replyListener(replyTopic.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := mb.newMessage(ctx, topic, data)
+	if err != nil {
+		return nil, err
+	}
+
+	correlationID := watermill.NewUUID()
+	middleware.SetCorrelationID(correlationID, msg)
+	msg.Metadata.Set(ReplyToKey, replyTopic.Name)
+
+	replies := listener.wait(correlationID)
+	defer listener.forget(correlationID)
+
+	err = mb.publishChain(mb.publish)(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	var reply *message.Message
+	select {
+	case reply = <-replies:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	reply.SetContext(ctx)
+	prepared, err := mb.prepareChain(replyTopic)(reply)
+	if err != nil {
+		return nil, err
+	}
+
+	return prepared[0], nil
+}
+
+// Reply publishes the reply of a request to the topic of its reply_to header,
+// encoded with the schema of replyTopic, with the context of the request.
+// The schema is registered under the subject of replyTopic, whatever the topic of the header.
+// It's called by the handler of the request, the context of the request is done once it's acked.
+func (mb *MessageBroker) Reply(request *message.Message, replyTopic *Topic, data interface{}) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if mb.publisher == nil {
+		return ErrPublishOnConsumeOnly
+	}
+
+	replyTo := request.Metadata.Get(ReplyToKey)
+	if replyTo == "" {
+		return ErrNoReplyTo
+	}
+
+	msg, err := mb.newMessage(request.Context(), replyTopic, data)
+	if err != nil {
+		return err
+	}
+
+	topic := *replyTopic
+	topic.Name = replyTo
+	middleware.SetCorrelationID(middleware.MessageCorrelationID(request), msg)
+
+	return mb.publishChain(mb.publish)(&topic, msg)
+}
+
+// replyListener returns the listener of a reply topic, subscribing to it the first time.
+func (mb *MessageBroker) replyListener(topic string) (*replyListener, error) {
+	mb.replyMu.Lock()
+	defer mb.replyMu.Unlock()
+
+	if listener, ok := mb.replyListeners[topic]; ok {
+		return listener, nil
+	}
+
+	subscriber, err := mb.replySubscriber()
+	if err != nil {
+		return nil, err
+	}
+
+	messages, err := subscriber.Subscribe(context.Background(), topic)
+	if err != nil {
+		subscriber.Close()
+		return nil, err
+	}
+
+	listener := newReplyListener(subscriber)
+	go listener.run(messages)
+
+	if mb.replyListeners == nil {
+		mb.replyListeners = make(map[string]*replyListener)
+	}
+	mb.replyListeners[topic] = listener
+
+	return listener, nil
+}
+
+// replySubscriber creates a subscriber without consumer group reading from the newest offset.
+func (mb *MessageBroker) replySubscriber() (message.Subscriber, error) {
+	if mb.localDir != "" {
+		return newLocalSubscriber(mb.localDir, "", true, mb.logger), nil
+	}
+
+	saramaConfig := *mb.subscriberConfig.OverwriteSaramaConfig
+	saramaConfig.Consumer.Offsets.Initial = sarama.OffsetNewest
+
+	return kafka.NewSubscriber(kafka.SubscriberConfig{
+		Brokers:               mb.subscriberConfig.Brokers,
+		Unmarshaler:           mb.subscriberConfig.Unmarshaler,
+		OverwriteSaramaConfig: &saramaConfig,
+		ReconnectRetrySleep:   mb.subscriberConfig.ReconnectRetrySleep,
+	}, mb.logger)
+}
+
+// closeReplyListeners closes the subscribers of the reply topics.
+func (mb *MessageBroker) closeReplyListeners() error {
+	mb.replyMu.Lock()
+	defer mb.replyMu.Unlock()
+
+	var errs []error
+	for topic, listener := range mb.replyListeners {
+		errs = append(errs, listener.subscriber.Close())
+		delete(mb.replyListeners, topic)
+	}
+
+	return errors.Join(errs...)
+}
+
+func newReplyListener(subscriber message.Subscriber) *replyListener {
+	return &replyListener{
+		subscriber: subscriber,
+		pending:    make(map[string]chan *message.Message),
+	}
+}
+
+func (l *replyListener) run(messages <-chan *message.Message) {
+	for msg := range messages {
+		msg.Ack()
+
+		l.mu.Lock()
+		replies, ok := l.pending[middleware.MessageCorrelationID(msg)]
+		l.mu.Unlock()
+
+		if !ok {
+			continue
+		}
+
+		// Duplicated replies are dropped.
+		select {
+		case replies <- msg:
+		default:
+		}
+	}
+}
+
+func (l *replyListener) wait(correlationID string) <-chan *message.Message {
+	replies := make(chan *message.Message, 1)
+
+	l.mu.Lock()
+	l.pending[correlationID] = replies
+	l.mu.Unlock()
+
+	return replies
+}
+
+func (l *replyListener) forget(correlationID string) {
+	l.mu.Lock()
+	delete(l.pending, correlationID)
+	l.mu.Unlock()
+}
@@ -0,0 +1,153 @@
+package kafkalistener
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+)
+
+func TestReplyListener(t *testing.T) {
+	listener := newReplyListener(nil)
+	messages := make(chan *message.Message)
+	go listener.run(messages)
+	defer close(messages)
+
+	replies := listener.wait("request-1")
+	defer listener.forget("request-1")
+
+	// The last message makes sure the duplicated reply was handled.
+	for _, correlationID := range []string{"request-0", "request-1", "request-1", "request-0"} {
+		msg := message.NewMessage(correlationID, nil)
+		middleware.SetCorrelationID(correlationID, msg)
+		messages <- msg
+	}
+
+	select {
+	case reply := <-replies:
+		if middleware.MessageCorrelationID(reply) != "request-1" {
+			t.Errorf("reply = %s, expected request-1", middleware.MessageCorrelationID(reply))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("reply not received")
+	}
+
+	select {
+	case reply := <-replies:
+		t.Errorf("duplicated reply %s received", reply.UUID)
+	default:
+	}
+}
+
+func TestRequestNotEnabled(t *testing.T) {
+	mb := &MessageBroker{}
+
+	_, err := mb.Request(context.Background(), &Topic{Name: "prices"}, nil, &Topic{Name: "prices-replies"})
+	if err != ErrBrokerNotEnabled {
+		t.Errorf("error = %v, expected %v", err, ErrBrokerNotEnabled)
+	}
+
+	err = mb.Reply(message.NewMessage("1", nil), &Topic{Name: "prices-replies"}, nil)
+	if err != ErrBrokerNotEnabled {
+		t.Errorf("error = %v, expected %v", err, ErrBrokerNotEnabled)
+	}
+}
+
+// subjectsRegistry records the subjects the schemas are registered under.
+type subjectsRegistry struct {
+	registry.Registry
+	mu       sync.Mutex
+	subjects []string
+}
+
+func (r *subjectsRegistry) IsRegistered(subject, schema string) (int, avro.Schema, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subjects = append(r.subjects, subject)
+	return 1, nil, nil
+}
+
+// loopbackPublisher delivers the published messages to the channel of their topic.
+type loopbackPublisher struct {
+	message.Publisher
+	topics map[string]chan *message.Message
+}
+
+func (p *loopbackPublisher) Publish(topic string, messages ...*message.Message) error {
+	for _, msg := range messages {
+		p.topics[topic] <- msg
+	}
+	return nil
+}
+
+func TestRequestReply(t *testing.T) {
+	requests := &Topic{Name: "prices", RawSchema: `{"type":"record","name":"Quote","fields":[{"name":"id","type":"string"}]}`}
+	requests.Schema = avro.MustParse(requests.RawSchema)
+
+	// The requester reads the replies from its own topic, with the schema of the replies.
+	replies := &Topic{
+		Name:            "prices-replies",
+		RawSchema:       `{"type":"record","name":"Price","fields":[{"name":"id","type":"string"},{"name":"customer","type":"string"}]}`,
+		EncryptedFields: []string{"customer"},
+	}
+	replies.Schema = avro.MustParse(replies.RawSchema)
+	instanceReplies := *replies
+	instanceReplies.Name = "prices-replies-host1"
+
+	blobs, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg := &subjectsRegistry{}
+	publisher := &loopbackPublisher{topics: map[string]chan *message.Message{
+		requests.Name:        make(chan *message.Message, 1),
+		instanceReplies.Name: make(chan *message.Message, 1),
+	}}
+	mb := &MessageBroker{enabled: true, registryClient: reg, publisher: publisher}
+	mb.SetClaimCheck(blobs, 1)
+	mb.SetKeyProvider(&Keyring{Current: "k1", Keys: map[string][]byte{"k1": []byte("0123456789abcdef")}})
+
+	listener := newReplyListener(nil)
+	go listener.run(publisher.topics[instanceReplies.Name])
+	defer close(publisher.topics[instanceReplies.Name])
+	mb.replyListeners = map[string]*replyListener{instanceReplies.Name: listener}
+
+	// The handler of the requests.
+	replied := make(chan error, 1)
+	go func() {
+		request := <-publisher.topics[requests.Name]
+		replied <- mb.Reply(request, replies, map[string]interface{}{"id": "1", "customer": "ana@test.com"})
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reply, err := mb.Request(ctx, requests, map[string]interface{}{"id": "1"}, &instanceReplies)
+	if err != nil {
+		t.Fatalf("error = %v", err)
+	}
+	if err = <-replied; err != nil {
+		t.Fatalf("reply error = %v", err)
+	}
+
+	price, err := DecodeMap(&instanceReplies, reply.Payload)
+	if err != nil {
+		t.Fatalf("decode error = %v", err)
+	}
+	if price["id"] != "1" || price["customer"] != "ana@test.com" {
+		t.Errorf("reply = %v, expected the decrypted price", price)
+	}
+
+	expected := []string{"prices-value", "prices-replies-value"}
+	if fmt.Sprint(reg.subjects) != fmt.Sprint(expected) {
+		t.Errorf("subjects = %v, expected %v", reg.subjects, expected)
+	}
+}
@@ -37,7 +37,8 @@ type Retry struct {
 	// The number of the current retry is passed as retryNum,
 	OnRetryHook func(retryNum int, delay time.Duration)
 
-	// AckAfterMaxRetries sets the message as aknowledged after the max-retry count.
+	// AckAfterMaxRetries sets the message as aknowledged after the max-retry count,
+	// and right away for the errors wrapping ErrPermanent. The route handlers ack them anyway.
 	AckAfterMaxRetries bool
 
 	Logger watermill.LoggerAdapter
@@ -51,6 +52,16 @@ func (r Retry) Middleware(h message.HandlerFunc) message.HandlerFunc {
 			return producedMessages, nil
 		}
 
+		if errors.Is(err, ErrPermanent) {
+			if r.Logger != nil {
+				r.Logger.Error("Permanent error, not retrying", err, watermill.LogFields{"uuid": msg.UUID})
+			}
+			if r.AckAfterMaxRetries {
+				return nil, nil
+			}
+			return nil, err
+		}
+
 		expBackoff := backoff.NewExponentialBackOff()
 		expBackoff.InitialInterval = r.InitialInterval
 		expBackoff.MaxInterval = r.MaxInterval
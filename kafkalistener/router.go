@@ -2,17 +2,84 @@ package kafkalistener
 
 import (
 	"context"
+	"errors"
+	"sort"
+	"sync/atomic"
 
 	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
 	"github.com/ThreeDotsLabs/watermill/message"
 	"github.com/ThreeDotsLabs/watermill/message/router/middleware"
 	"github.com/ThreeDotsLabs/watermill/message/router/plugin"
+	"github.com/ThreeDotsLabs/watermill/pubsub/gochannel"
 )
 
+var ErrHandlerExists error = errors.New("a handler with the same name is already registered")
+var ErrHandlerNotFound error = errors.New("handler is not registered")
+var ErrRouterNotRunning error = errors.New("router is not running, the handler can't be stopped")
+
+// idleHandlerName is the handler that keeps the router alive when every
+// route handler has been removed, otherwise watermill closes the router.
+const idleHandlerName = "kafkalistener_idle"
+
 type RouteHandler struct {
 	Name        string
 	Topic       *Topic
 	HandlerFunc message.NoPublishHandlerFunc
+	// Filters skip messages before the payload is decoded, RecordFilters after.
+	Filters       []Filter
+	RecordFilters []RecordFilter
+	// Commit overrides the commit mode of the KafkaConfig for the topic.
+	Commit *CommitPolicy
+}
+
+// HandlerStatus is the lifecycle state of a registered handler.
+type HandlerStatus string
+
+const (
+	// HandlerPending is a handler waiting for the router to start.
+	HandlerPending HandlerStatus = "pending"
+	// HandlerRunning is a handler consuming messages.
+	HandlerRunning HandlerStatus = "running"
+	// HandlerStopped is a handler whose subscription has ended.
+	HandlerStopped HandlerStatus = "stopped"
+)
+
+// HandlerInfo describes a registered handler.
+type HandlerInfo struct {
+	Name   string
+	Topic  string
+	Status HandlerStatus
+	// Skipped is the number of messages acked by the filters.
+	Skipped uint64
+}
+
+// route is a registered handler and its watermill counterpart,
+// wmHandler is nil until the handler is added to the router.
+type route struct {
+	handler   RouteHandler
+	wmHandler *message.Handler
+	// subscriber is closed when the handler is removed, it's nil in local mode.
+	subscriber message.Subscriber
+	skipped    atomic.Uint64
+}
+
+func (r *route) status() HandlerStatus {
+	if r.wmHandler == nil {
+		return HandlerPending
+	}
+
+	select {
+	case <-r.wmHandler.Started():
+	default:
+		return HandlerPending
+	}
+
+	select {
+	case <-r.wmHandler.Stopped():
+		return HandlerStopped
+	default:
+		return HandlerRunning
+	}
 }
 
 // SetRetry attempts to set the retry policy for the router.
@@ -26,19 +93,16 @@ func (mb *MessageBroker) SetRetry(retry *Retry) {
 
 // Listen starts the router and the message broker. This call is blocking while the router is running.
 //
+// More handlers can be added or removed while the router is running with AddHandler and RemoveHandler.
+//
 // To stop Listen() you should call Stop().
 func (mb *MessageBroker) Listen(ctx context.Context, handlers []RouteHandler) error {
 	if !mb.enabled {
 		return ErrBrokerNotEnabled
 	}
 
-	sub, err := kafka.NewSubscriber(mb.subscriberConfig, mb.logger)
-	if err != nil {
-		return err
-	}
-
 	for _, h := range handlers {
-		err := mb.registerHandler(h, sub)
+		err := mb.AddHandler(h)
 		if err != nil {
 			return err
 		}
@@ -47,35 +111,279 @@ func (mb *MessageBroker) Listen(ctx context.Context, handlers []RouteHandler) er
 	mb.router.AddPlugin(plugin.SignalsHandler)
 	mb.router.AddMiddleware(middleware.CorrelationID)
 
+	mb.addIdleHandler()
+
+	mb.mu.Lock()
+	mb.listenCtx = ctx
+	for _, r := range mb.routes {
+		err := mb.addRoute(r)
+		if err != nil {
+			mb.mu.Unlock()
+			return err
+		}
+	}
+	for _, r := range mb.batchRoutes {
+		mb.startBatchRoute(ctx, r)
+	}
+	mb.mu.Unlock()
+
 	return mb.router.Run(ctx)
 }
 
-// registerHandler sets the Schema and adds the handler to the router.
-func (mb *MessageBroker) registerHandler(
-	handler RouteHandler,
-	subscriber *kafka.Subscriber,
-) error {
+// AddHandler registers a handler, if the router is already running
+// the handler starts consuming right away.
+//
+// When the name of the handler is empty the name of the topic is used.
+func (mb *MessageBroker) AddHandler(handler RouteHandler) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
 
 	err := mb.SetSchema(handler.Topic)
 	if err != nil {
 		return err
 	}
 
-	mb.router.AddNoPublisherHandler(
-		handler.Name,
-		handler.Topic.Name,
+	return mb.registerRoute(handler)
+}
+
+// registerRoute adds a handler to the routes and starts it when the router is running.
+func (mb *MessageBroker) registerRoute(handler RouteHandler) error {
+	if handler.Name == "" {
+		handler.Name = handler.Topic.Name
+	}
+
+	mb.mu.Lock()
+	if _, ok := mb.routes[handler.Name]; ok {
+		mb.mu.Unlock()
+		return ErrHandlerExists
+	}
+
+	r := &route{handler: handler}
+	mb.routes[handler.Name] = r
+	listening := mb.listenCtx != nil
+	mb.mu.Unlock()
+
+	if !listening {
+		return nil
+	}
+
+	err := mb.startRoute(r)
+	if err != nil {
+		mb.mu.Lock()
+		delete(mb.routes, handler.Name)
+		mb.mu.Unlock()
+	}
+
+	return err
+}
+
+// RemoveHandler stops a handler and unregisters it,
+// it waits until the in-flight message of the handler has been processed.
+// A handler already added to a router that never ran can't be stopped, it stays registered.
+func (mb *MessageBroker) RemoveHandler(name string) error {
+	mb.mu.Lock()
+	r, ok := mb.routes[name]
+	if !ok {
+		mb.mu.Unlock()
+		return ErrHandlerNotFound
+	}
+
+	if r.wmHandler != nil {
+		select {
+		case <-mb.router.Running():
+		default:
+			mb.mu.Unlock()
+			return ErrRouterNotRunning
+		}
+	}
+
+	delete(mb.routes, name)
+	mb.mu.Unlock()
+
+	if r.wmHandler == nil {
+		return nil
+	}
+
+	// The running router starts every handler added to it.
+	<-r.wmHandler.Started()
+	r.wmHandler.Stop()
+	<-r.wmHandler.Stopped()
+
+	if r.subscriber != nil {
+		return r.subscriber.Close()
+	}
+
+	return nil
+}
+
+// Handlers returns the registered handlers sorted by name.
+func (mb *MessageBroker) Handlers() []HandlerInfo {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	infos := make([]HandlerInfo, 0, len(mb.routes))
+	for name, r := range mb.routes {
+		infos = append(infos, HandlerInfo{
+			Name:    name,
+			Topic:   r.handler.Topic.Name,
+			Status:  r.status(),
+			Skipped: r.skipped.Load(),
+		})
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	return infos
+}
+
+// HandlerStatus returns the status of a registered handler.
+func (mb *MessageBroker) HandlerStatus(name string) (HandlerStatus, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+
+	r, ok := mb.routes[name]
+	if !ok {
+		return "", ErrHandlerNotFound
+	}
+
+	return r.status(), nil
+}
+
+// startRoute adds a handler registered after Listen to the running router.
+func (mb *MessageBroker) startRoute(r *route) error {
+	mb.mu.Lock()
+	err := mb.addRoute(r)
+	ctx := mb.listenCtx
+	mb.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Handlers added before the router finished starting are run by the router itself.
+	<-mb.router.Running()
+
+	return mb.router.RunHandlers(ctx)
+}
+
+// addRoute adds the handler to the router, the caller must hold mb.mu.
+func (mb *MessageBroker) addRoute(r *route) error {
+	if r.wmHandler != nil {
+		return nil
+	}
+
+	subscriber, err := mb.getSubscriber(r.handler.Name)
+	if err != nil {
+		return err
+	}
+	if subscriber != mb.subscriber {
+		r.subscriber = subscriber
+	}
+
+	r.wmHandler = mb.router.AddNoPublisherHandler(
+		r.handler.Name,
+		r.handler.Topic.Name,
 		subscriber,
-		handler.HandlerFunc,
+		r.handler.HandlerFunc,
 	)
 
+	r.wmHandler.AddMiddleware(permanentMiddleware(r.handler.Name, mb.logger))
+	if mb.recorder != nil {
+		r.wmHandler.AddMiddleware(mb.recorder.Middleware())
+	}
+	for _, m := range mb.routeMiddlewares(r.handler, &r.skipped) {
+		r.wmHandler.AddMiddleware(m)
+	}
+
 	return nil
 }
 
+// routeMiddlewares returns the middlewares of a route handler in the order they run:
+// the filters, the claim-check and decryption of the payload, the record filters and the validation.
+func (mb *MessageBroker) routeMiddlewares(handler RouteHandler, skipped *atomic.Uint64) []message.HandlerMiddleware {
+	var middlewares []message.HandlerMiddleware
+
+	if len(handler.Filters) > 0 {
+		middlewares = append(middlewares, filterMiddleware(handler.Filters, skipped, mb.logger))
+	}
+	if mb.blobStore != nil {
+		middlewares = append(middlewares, ClaimCheckMiddleware(mb.blobStore))
+	}
+	if len(handler.Topic.EncryptedFields) > 0 {
+		middlewares = append(middlewares, DecryptionMiddleware(handler.Topic, mb.keyProvider))
+	}
+	if len(handler.RecordFilters) > 0 {
+		middlewares = append(middlewares, recordFilterMiddleware(handler.Topic, handler.RecordFilters, skipped, mb.logger))
+	}
+	if len(handler.Topic.Rules) > 0 {
+		middlewares = append(middlewares, ValidationMiddleware(handler.Topic))
+	}
+
+	return middlewares
+}
+
+// chain wraps h with the middlewares, the first one runs first like in the router.
+func chain(h message.HandlerFunc, middlewares []message.HandlerMiddleware) message.HandlerFunc {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		h = middlewares[i](h)
+	}
+
+	return h
+}
+
+// getSubscriber creates the kafka subscriber of a handler, whose group sessions are tracked by
+// handler name, or returns the local subscriber shared by every handler. The caller must hold mb.mu.
+func (mb *MessageBroker) getSubscriber(handler string) (message.Subscriber, error) {
+	if mb.localDir != "" {
+		if mb.subscriber == nil {
+			mb.subscriber = newLocalSubscriber(mb.localDir, mb.consumerGroup, false, mb.logger)
+		}
+		return mb.subscriber, nil
+	}
+
+	config := mb.subscriberConfig
+	config.OverwriteSaramaConfig = mb.committerSaramaConfig()
+	config.Tracer = rebalanceTracer{mb: mb, handler: handler}
+
+	return kafka.NewSubscriber(config, mb.logger)
+}
+
+// addIdleHandler adds a handler that never receives messages,
+// so the router keeps running after the last route handler is removed.
+func (mb *MessageBroker) addIdleHandler() {
+	idle := gochannel.NewGoChannel(gochannel.Config{}, mb.logger)
+
+	mb.router.AddNoPublisherHandler(
+		idleHandlerName,
+		idleHandlerName,
+		idle,
+		func(msg *message.Message) error { return nil },
+	)
+}
+
+// close closes the router and the producers of a broker that never listened.
+func (mb *MessageBroker) close() error {
+	var errs []error
+	if mb.router != nil {
+		errs = append(errs, mb.router.Close())
+	}
+	if mb.publisher != nil {
+		errs = append(errs, mb.publisher.Close())
+	}
+	if mb.txProducer != nil {
+		errs = append(errs, mb.txProducer.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
 // Stop gracefully closes the router with a timeout provided in the configuration.
 func (mb *MessageBroker) Stop() error {
+	mb.stopBatchRoutes()
+	err := mb.closeReplyListeners()
+
 	if mb.router != nil {
-		return mb.router.Close()
+		return errors.Join(mb.router.Close(), err)
 	}
 
-	return nil
+	return err
 }
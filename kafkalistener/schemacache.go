@@ -0,0 +1,536 @@
+package kafkalistener
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+)
+
+var ErrSchemaNotCached error = errors.New("schema registry is unreachable and the schema is not cached")
+var ErrSchemaCacheStale error = errors.New("schema registry is unreachable and the schema cache is too old")
+
+// SchemaCache is a schema registry that keeps the subjects, versions and ids it reads
+// in a file, and answers from it when the schema registry can't be reached.
+//
+// Schemas read while the registry was down are refreshed once it's back.
+type SchemaCache struct {
+	registry registry.Registry
+	path     string
+
+	mu      sync.Mutex
+	data    schemaCacheData
+	offline bool
+}
+
+// SchemaCacheStatus describes the cache for health checks.
+type SchemaCacheStatus struct {
+	// UpdatedAt is the last time the registry answered.
+	UpdatedAt time.Time     `json:"updated_at"`
+	Age       time.Duration `json:"age"`
+	// Offline is set while the schemas are being read from the cache.
+	Offline bool `json:"offline"`
+}
+
+// schemaCacheData is the content of the cache file.
+type schemaCacheData struct {
+	UpdatedAt time.Time                 `json:"updated_at"`
+	Schemas   map[int]string            `json:"schemas"`
+	Subjects  map[string]*cachedSubject `json:"subjects"`
+}
+
+type cachedSubject struct {
+	LatestID      int            `json:"latest_id"`
+	LatestVersion int            `json:"latest_version"`
+	Versions      map[int]string `json:"versions"`
+	// IDs are the ids of the schemas registered under the subject.
+	IDs []int `json:"ids"`
+}
+
+// NewSchemaCache wraps a registry with a cache kept in the file of path.
+//
+// embedded is an optional cache file embedded at build time, it's merged
+// with the cache file so services can start without registry on a fresh host.
+func NewSchemaCache(reg registry.Registry, path string, embedded []byte) (*SchemaCache, error) {
+	c := &SchemaCache{
+		registry: reg,
+		path:     path,
+		data: schemaCacheData{
+			Schemas:  make(map[int]string),
+			Subjects: make(map[string]*cachedSubject),
+		},
+	}
+
+	if len(embedded) > 0 {
+		err := c.merge(embedded)
+		if err != nil {
+			return nil, fmt.Errorf("embedded schema cache: %w", err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		err = c.merge(data)
+		if err != nil {
+			return nil, fmt.Errorf("schema cache %s: %w", path, err)
+		}
+	}
+
+	return c, nil
+}
+
+// SetSchemaCache makes the broker fall back to a schema cache file when the
+// schema registry can't be reached, see NewSchemaCache.
+//
+// It should be called before setting the schemas of the topics.
+func (mb *MessageBroker) SetSchemaCache(path string, embedded []byte) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if mb.localDir != "" {
+		return ErrLocalMode
+	}
+
+	cache, err := NewSchemaCache(mb.registryClient, path, embedded)
+	if err != nil {
+		return err
+	}
+
+	mb.registryClient = cache
+	mb.schemaCache = cache
+	return nil
+}
+
+// SchemaCacheStatus returns the status of the schema cache, false when there's no cache.
+func (mb *MessageBroker) SchemaCacheStatus() (SchemaCacheStatus, bool) {
+	if mb.schemaCache == nil {
+		return SchemaCacheStatus{}, false
+	}
+
+	return mb.schemaCache.Status(), true
+}
+
+// CheckSchemaCache is a health check of the schema registry: it fails while the schemas are
+// read from a cache that wasn't updated for maxAge. It passes when there's no cache.
+func (mb *MessageBroker) CheckSchemaCache(maxAge time.Duration) error {
+	status, ok := mb.SchemaCacheStatus()
+	if !ok || !status.Offline {
+		return nil
+	}
+
+	if status.UpdatedAt.IsZero() || status.Age > maxAge {
+		return fmt.Errorf("%w: updated at %s", ErrSchemaCacheStale, status.UpdatedAt.Format(time.RFC3339))
+	}
+
+	return nil
+}
+
+// Status returns the last time the registry answered and whether the cache is being used instead.
+func (c *SchemaCache) Status() SchemaCacheStatus {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	status := SchemaCacheStatus{UpdatedAt: c.data.UpdatedAt, Offline: c.offline}
+	if !c.data.UpdatedAt.IsZero() {
+		status.Age = time.Since(c.data.UpdatedAt)
+	}
+
+	return status
+}
+
+// GetSchema returns the schema of an id, from the cache while the registry is down.
+func (c *SchemaCache) GetSchema(id int) (avro.Schema, error) {
+	schema, err := c.registry.GetSchema(id)
+	if !isOffline(err) {
+		if err == nil {
+			c.update(func(d *schemaCacheData) bool { return d.setSchema(id, schema) })
+		}
+		c.answered()
+		return schema, err
+	}
+
+	c.mu.Lock()
+	raw, ok := c.data.Schemas[id]
+	c.mu.Unlock()
+
+	return c.fallback(raw, ok, err)
+}
+
+// GetSubjects returns the subjects of the registry, or the cached ones while it's down.
+func (c *SchemaCache) GetSubjects() ([]string, error) {
+	subjects, err := c.registry.GetSubjects()
+	if !isOffline(err) {
+		c.answered()
+		return subjects, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.offline = true
+	subjects = make([]string, 0, len(c.data.Subjects))
+	for subject := range c.data.Subjects {
+		subjects = append(subjects, subject)
+	}
+	sort.Strings(subjects)
+
+	return subjects, nil
+}
+
+// GetVersions returns the versions of a subject, or the cached ones while the registry is down.
+func (c *SchemaCache) GetVersions(subject string) ([]int, error) {
+	versions, err := c.registry.GetVersions(subject)
+	if !isOffline(err) {
+		c.answered()
+		return versions, err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.data.Subjects[subject]
+	if !ok || len(s.Versions) == 0 {
+		return nil, fmt.Errorf("%w: %v", ErrSchemaNotCached, err)
+	}
+
+	c.offline = true
+	versions = make([]int, 0, len(s.Versions))
+	for version := range s.Versions {
+		versions = append(versions, version)
+	}
+	sort.Ints(versions)
+
+	return versions, nil
+}
+
+// GetSchemaByVersion returns a version of a subject, from the cache while the registry is down.
+func (c *SchemaCache) GetSchemaByVersion(subject string, version int) (avro.Schema, error) {
+	schema, err := c.registry.GetSchemaByVersion(subject, version)
+	if !isOffline(err) {
+		if err == nil {
+			c.update(func(d *schemaCacheData) bool { return d.setVersion(subject, version, schema) })
+		}
+		c.answered()
+		return schema, err
+	}
+
+	c.mu.Lock()
+	raw, ok := "", false
+	if s, found := c.data.Subjects[subject]; found {
+		raw, ok = s.Versions[version]
+	}
+	c.mu.Unlock()
+
+	return c.fallback(raw, ok, err)
+}
+
+// GetLatestSchema returns the latest schema of a subject, see GetLatestSchemaInfo.
+func (c *SchemaCache) GetLatestSchema(subject string) (avro.Schema, error) {
+	info, err := c.GetLatestSchemaInfo(subject)
+	return info.Schema, err
+}
+
+// GetLatestSchemaInfo returns the latest version of a subject, while the registry
+// is down it's the latest version cached, which may be outdated.
+func (c *SchemaCache) GetLatestSchemaInfo(subject string) (registry.SchemaInfo, error) {
+	info, err := c.registry.GetLatestSchemaInfo(subject)
+	if !isOffline(err) {
+		if err == nil {
+			c.update(func(d *schemaCacheData) bool { return d.setLatest(subject, info) })
+		}
+		c.answered()
+		return info, err
+	}
+
+	c.mu.Lock()
+	s, ok := c.data.Subjects[subject]
+	if !ok || s.LatestVersion == 0 {
+		c.mu.Unlock()
+		return registry.SchemaInfo{}, fmt.Errorf("%w: %v", ErrSchemaNotCached, err)
+	}
+	info = registry.SchemaInfo{ID: s.LatestID, Version: s.LatestVersion}
+	raw := s.Versions[s.LatestVersion]
+	c.mu.Unlock()
+
+	info.Schema, err = c.fallback(raw, true, err)
+	return info, err
+}
+
+// CreateSchema needs the registry, while it's down only schemas already registered are found.
+func (c *SchemaCache) CreateSchema(subject, schema string, references ...registry.SchemaReference) (int, avro.Schema, error) {
+	id, parsed, err := c.registry.CreateSchema(subject, schema, references...)
+	if !isOffline(err) {
+		if err == nil {
+			c.update(func(d *schemaCacheData) bool { return d.register(subject, id, schema) })
+		}
+		c.answered()
+		return id, parsed, err
+	}
+
+	return c.cachedID(subject, schema, err)
+}
+
+// IsRegistered returns the id of a schema registered under a subject, while the registry
+// is down it's looked up by fingerprint among the cached ids of the subject.
+func (c *SchemaCache) IsRegistered(subject, schema string) (int, avro.Schema, error) {
+	id, parsed, err := c.registry.IsRegistered(subject, schema)
+	if !isOffline(err) {
+		if err == nil {
+			c.update(func(d *schemaCacheData) bool { return d.register(subject, id, schema) })
+		}
+		c.answered()
+		return id, parsed, err
+	}
+
+	return c.cachedID(subject, schema, err)
+}
+
+// Reconcile refreshes the latest version of every cached subject from the registry,
+// it runs after the registry comes back.
+func (c *SchemaCache) Reconcile() error {
+	c.mu.Lock()
+	subjects := make([]string, 0, len(c.data.Subjects))
+	for subject := range c.data.Subjects {
+		subjects = append(subjects, subject)
+	}
+	c.mu.Unlock()
+
+	var errs []error
+	for _, subject := range subjects {
+		info, err := c.registry.GetLatestSchemaInfo(subject)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", subject, err))
+			continue
+		}
+
+		c.mu.Lock()
+		c.data.setLatest(subject, info)
+		c.mu.Unlock()
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return errors.Join(append(errs, c.save())...)
+}
+
+// cachedID looks for the id of a schema registered under the subject, comparing their fingerprints.
+func (c *SchemaCache) cachedID(subject, schema string, registryErr error) (int, avro.Schema, error) {
+	parsed, err := avro.Parse(schema)
+	if err != nil {
+		return 0, nil, err
+	}
+	fingerprint := parsed.Fingerprint()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	s, ok := c.data.Subjects[subject]
+	if !ok {
+		return 0, nil, fmt.Errorf("%w: %v", ErrSchemaNotCached, registryErr)
+	}
+
+	for _, id := range s.IDs {
+		cached, err := avro.Parse(c.data.Schemas[id])
+		if err == nil && cached.Fingerprint() == fingerprint {
+			c.offline = true
+			return id, parsed, nil
+		}
+	}
+
+	return 0, nil, fmt.Errorf("%w: %v", ErrSchemaNotCached, registryErr)
+}
+
+// fallback parses a cached schema after the registry failed with registryErr.
+func (c *SchemaCache) fallback(raw string, ok bool, registryErr error) (avro.Schema, error) {
+	if !ok || raw == "" {
+		return nil, fmt.Errorf("%w: %v", ErrSchemaNotCached, registryErr)
+	}
+
+	c.mu.Lock()
+	c.offline = true
+	c.mu.Unlock()
+
+	return avro.Parse(raw)
+}
+
+// update applies what was read from the registry, saving the cache when fn changed it.
+func (c *SchemaCache) update(fn func(d *schemaCacheData) bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if !fn(&c.data) {
+		return
+	}
+	c.data.UpdatedAt = time.Now().UTC()
+
+	err := c.save()
+	if err != nil {
+		log.Println("Error saving schema cache: ", err)
+	}
+}
+
+// answered reconciles the cache when the registry answers after an outage.
+func (c *SchemaCache) answered() {
+	c.mu.Lock()
+	wasOffline := c.offline
+	c.offline = false
+	c.data.UpdatedAt = time.Now().UTC()
+	c.mu.Unlock()
+
+	if wasOffline {
+		go func() {
+			err := c.Reconcile()
+			if err != nil {
+				log.Println("Error reconciling schema cache: ", err)
+			}
+		}()
+	}
+}
+
+// save writes the cache file, the caller must hold c.mu.
+func (c *SchemaCache) save() error {
+	data, err := json.Marshal(c.data)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file so a crash never leaves a partial cache.
+	tmp := filepath.Join(filepath.Dir(c.path), "."+filepath.Base(c.path)+".tmp")
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, c.path)
+}
+
+// merge adds the content of a cache file, keeping the newest latest versions.
+func (c *SchemaCache) merge(raw []byte) error {
+	var data schemaCacheData
+	err := json.Unmarshal(raw, &data)
+	if err != nil {
+		return err
+	}
+
+	for id, schema := range data.Schemas {
+		c.data.Schemas[id] = schema
+	}
+
+	for name, s := range data.Subjects {
+		subject := c.data.subject(name)
+		for version, schema := range s.Versions {
+			subject.Versions[version] = schema
+		}
+		for _, id := range s.IDs {
+			subject.addID(id)
+		}
+		if s.LatestVersion > subject.LatestVersion {
+			subject.LatestVersion = s.LatestVersion
+			subject.LatestID = s.LatestID
+		}
+	}
+
+	if data.UpdatedAt.After(c.data.UpdatedAt) {
+		c.data.UpdatedAt = data.UpdatedAt
+	}
+
+	return nil
+}
+
+func (d *schemaCacheData) subject(name string) *cachedSubject {
+	s, ok := d.Subjects[name]
+	if !ok {
+		s = &cachedSubject{Versions: make(map[int]string)}
+		d.Subjects[name] = s
+	}
+	if s.Versions == nil {
+		s.Versions = make(map[int]string)
+	}
+
+	return s
+}
+
+// The setters return false when the cache already had the schema,
+// ids and versions never change their schema once they're registered.
+
+func (d *schemaCacheData) setSchema(id int, schema avro.Schema) bool {
+	if _, ok := d.Schemas[id]; ok {
+		return false
+	}
+
+	d.Schemas[id] = schema.String()
+	return true
+}
+
+func (d *schemaCacheData) setVersion(subject string, version int, schema avro.Schema) bool {
+	s := d.subject(subject)
+	if _, ok := s.Versions[version]; ok {
+		return false
+	}
+
+	s.Versions[version] = schema.String()
+	return true
+}
+
+func (d *schemaCacheData) setLatest(subject string, info registry.SchemaInfo) bool {
+	s := d.subject(subject)
+	if s.LatestID == info.ID && s.LatestVersion == info.Version {
+		return false
+	}
+
+	s.LatestID = info.ID
+	s.LatestVersion = info.Version
+	s.addID(info.ID)
+	d.setVersion(subject, info.Version, info.Schema)
+	d.setSchema(info.ID, info.Schema)
+	return true
+}
+
+func (d *schemaCacheData) register(subject string, id int, schema string) bool {
+	changed := d.subject(subject).addID(id)
+	if _, ok := d.Schemas[id]; !ok {
+		d.Schemas[id] = schema
+		changed = true
+	}
+
+	return changed
+}
+
+func (s *cachedSubject) addID(id int) bool {
+	for _, existing := range s.IDs {
+		if existing == id {
+			return false
+		}
+	}
+
+	s.IDs = append(s.IDs, id)
+	return true
+}
+
+// isOffline tells if the registry couldn't be reached, registry answers
+// other than server errors are returned as they are.
+func isOffline(err error) bool {
+	if err == nil {
+		return false
+	}
+
+	var regErr registry.Error
+	if errors.As(err, &regErr) {
+		return regErr.StatusCode >= 500
+	}
+
+	return true
+}
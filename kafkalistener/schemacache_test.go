@@ -0,0 +1,178 @@
+package kafkalistener
+
+import (
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/hamba/avro"
+	"github.com/hamba/avro/registry"
+)
+
+const cacheTestSchema = `{"type":"record","name":"Order","fields":[{"name":"id","type":"string"}]}`
+
+// fakeRegistry answers with a single subject and fails like an unreachable registry when down.
+type fakeRegistry struct {
+	registry.Registry
+	down bool
+}
+
+func (r *fakeRegistry) err() error {
+	if r.down {
+		return &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+	}
+	return nil
+}
+
+func (r *fakeRegistry) GetSchema(id int) (avro.Schema, error) {
+	if err := r.err(); err != nil {
+		return nil, err
+	}
+	if id != 7 {
+		return nil, registry.Error{StatusCode: 404}
+	}
+	return avro.Parse(cacheTestSchema)
+}
+
+func (r *fakeRegistry) GetLatestSchemaInfo(subject string) (registry.SchemaInfo, error) {
+	if err := r.err(); err != nil {
+		return registry.SchemaInfo{}, err
+	}
+	if subject != "orders-value" {
+		return registry.SchemaInfo{}, registry.Error{StatusCode: 404}
+	}
+	schema, err := avro.Parse(cacheTestSchema)
+	return registry.SchemaInfo{Schema: schema, ID: 7, Version: 2}, err
+}
+
+func (r *fakeRegistry) IsRegistered(subject, schema string) (int, avro.Schema, error) {
+	if err := r.err(); err != nil {
+		return 0, nil, err
+	}
+	parsed, err := avro.Parse(schema)
+	return 7, parsed, err
+}
+
+func TestSchemaCache(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "schemas.json")
+	reg := &fakeRegistry{}
+
+	cache, err := NewSchemaCache(reg, path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = cache.GetLatestSchemaInfo("orders-value")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = cache.IsRegistered("orders-value", cacheTestSchema)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	embedded, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	reg.down = true
+	testcases := []struct {
+		Name     string
+		Embedded bool
+	}{
+		{Name: "From the cache file"},
+		{Name: "From the embedded cache", Embedded: true},
+	}
+
+	for _, tc := range testcases {
+		cachePath := path
+		var data []byte
+		if tc.Embedded {
+			cachePath = filepath.Join(t.TempDir(), "schemas.json")
+			data = embedded
+		}
+
+		cache, err := NewSchemaCache(reg, cachePath, data)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+
+		info, err := cache.GetLatestSchemaInfo("orders-value")
+		if err != nil || info.ID != 7 || info.Version != 2 {
+			t.Errorf("%s: latest schema = %+v, error = %v, expected id 7 version 2", tc.Name, info, err)
+		}
+
+		// The schema is found in the cache even when it's formatted differently.
+		id, _, err := cache.IsRegistered("orders-value", " "+cacheTestSchema)
+		if err != nil || id != 7 {
+			t.Errorf("%s: id = %d, error = %v, expected 7", tc.Name, id, err)
+		}
+
+		_, err = cache.GetSchema(7)
+		if err != nil {
+			t.Errorf("%s: error = %v", tc.Name, err)
+		}
+
+		_, err = cache.GetLatestSchemaInfo("payments-value")
+		if !errors.Is(err, ErrSchemaNotCached) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, ErrSchemaNotCached)
+		}
+
+		if !cache.Status().Offline {
+			t.Errorf("%s: offline = false, expected true", tc.Name)
+		}
+	}
+
+	reg.down = false
+	_, err = cache.GetSchema(8)
+	var regErr registry.Error
+	if !errors.As(err, &regErr) || regErr.StatusCode != 404 {
+		t.Errorf("error = %v, expected the registry 404 error", err)
+	}
+
+	status := cache.Status()
+	if status.Offline || status.UpdatedAt.IsZero() {
+		t.Errorf("status = %+v, expected online and updated", status)
+	}
+}
+
+func TestCheckSchemaCache(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Cache         *SchemaCache
+		ExpectedError error
+	}{
+		{Name: "Without cache"},
+		{
+			Name:  "Registry answering",
+			Cache: &SchemaCache{data: schemaCacheData{UpdatedAt: time.Now().Add(-time.Hour)}},
+		},
+		{
+			Name:  "Offline with a recent cache",
+			Cache: &SchemaCache{data: schemaCacheData{UpdatedAt: time.Now().Add(-time.Minute)}, offline: true},
+		},
+		{
+			Name:          "Offline with an old cache",
+			Cache:         &SchemaCache{data: schemaCacheData{UpdatedAt: time.Now().Add(-time.Hour)}, offline: true},
+			ExpectedError: ErrSchemaCacheStale,
+		},
+		{
+			Name:          "Offline with a cache never updated",
+			Cache:         &SchemaCache{offline: true},
+			ExpectedError: ErrSchemaCacheStale,
+		},
+	}
+
+	for _, tc := range testcases {
+		mb := &MessageBroker{schemaCache: tc.Cache}
+
+		err := mb.CheckSchemaCache(10 * time.Minute)
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+	}
+}
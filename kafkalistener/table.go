@@ -0,0 +1,515 @@
+package kafkalistener
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/jmoiron/sqlx"
+)
+
+var ErrEmptyKey error = errors.New("message key is empty")
+
+// tableIdleFetches is how many fetch waits a partition of a table is idle before it's caught up.
+const tableIdleFetches = 4
+
+// PartitionKeyKey is the metadata key set by PublishWithKey, it's sent as the kafka message key.
+const PartitionKeyKey = "partition_key"
+
+// keyMarshaler is the watermill marshaler with kafka keys and null values for tombstones.
+type keyMarshaler struct {
+	kafka.DefaultMarshaler
+}
+
+func (m keyMarshaler) Marshal(topic string, msg *message.Message) (*sarama.ProducerMessage, error) {
+	kafkaMsg, err := m.DefaultMarshaler.Marshal(topic, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	key := msg.Metadata.Get(PartitionKeyKey)
+	if key == "" {
+		return kafkaMsg, nil
+	}
+
+	kafkaMsg.Key = sarama.StringEncoder(key)
+	if len(msg.Payload) == 0 {
+		kafkaMsg.Value = nil
+	}
+
+	headers := kafkaMsg.Headers[:0]
+	for _, h := range kafkaMsg.Headers {
+		if string(h.Key) != PartitionKeyKey {
+			headers = append(headers, h)
+		}
+	}
+	kafkaMsg.Headers = headers
+
+	return kafkaMsg, nil
+}
+
+// PublishWithKey publishes a message with a kafka key, messages with
+// the same key go to the same partition and compaction keeps the last one.
+func (mb *MessageBroker) PublishWithKey(topic *Topic, key string, data interface{}) error {
+	return mb.PublishWithKeyContext(context.Background(), topic, key, data)
+}
+
+// PublishWithKeyContext is PublishWithKey with the context of PublishContext.
+func (mb *MessageBroker) PublishWithKeyContext(ctx context.Context, topic *Topic, key string, data interface{}) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if mb.publisher == nil {
+		return ErrPublishOnConsumeOnly
+	}
+
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	msg, err := mb.newMessage(ctx, topic, data)
+	if err != nil {
+		return err
+	}
+	msg.Metadata.Set(PartitionKeyKey, key)
+
+	return mb.publishChain(mb.publish)(topic, msg)
+}
+
+// PublishTombstone publishes a null value for the key, compacted topics delete the key.
+func (mb *MessageBroker) PublishTombstone(topic *Topic, key string) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if mb.publisher == nil {
+		return ErrPublishOnConsumeOnly
+	}
+
+	if key == "" {
+		return ErrEmptyKey
+	}
+
+	msg := message.NewMessage(watermill.NewUUID(), nil)
+	msg.Metadata.Set(PartitionKeyKey, key)
+
+	return mb.publishChain(mb.publish)(topic, msg)
+}
+
+// TableStore keeps the last payload of every key of a table.
+type TableStore interface {
+	Put(key string, payload []byte) error
+	Delete(key string) error
+	Get(key string) ([]byte, bool, error)
+	// Range calls fn for the keys in order until it returns false.
+	Range(fn func(key string, payload []byte) bool) error
+}
+
+// Table materializes a compacted topic into a key/value store,
+// reading every partition from the beginning without consumer group.
+// The values go through the claim-check, decryption and validation of the handlers before
+// they're stored, invalid values are dropped. The EncryptedFields are stored decrypted,
+// a store that persists them keeps the PII in plain text.
+type Table struct {
+	mb    *MessageBroker
+	topic *Topic
+	store TableStore
+	// prepare is the chain of middlewares of the values.
+	prepare message.HandlerFunc
+
+	ready     chan struct{}
+	readyOnce sync.Once
+	// pending are the offsets each partition has to reach to be caught up.
+	pendingMu sync.Mutex
+	pending   map[int32]int64
+}
+
+// NewTable creates a table of a topic, it's filled by Run.
+//
+// It should be called after SetClaimCheck and SetKeyProvider.
+func (mb *MessageBroker) NewTable(topic *Topic, store TableStore) *Table {
+	return &Table{
+		mb:      mb,
+		topic:   topic,
+		store:   store,
+		prepare: mb.prepareChain(topic),
+		ready:   make(chan struct{}),
+	}
+}
+
+// Ready is closed once the table has caught up with the messages
+// that were in the topic when Run started.
+//
+// A partition is caught up when it reaches its high-water mark. Transaction markers and
+// aborted records aren't delivered, so a partition idle for a few fetch waits after its
+// last message is caught up too. A partition that only has aborted records waits for a new message.
+func (t *Table) Ready() <-chan struct{} {
+	return t.ready
+}
+
+// Run consumes the topic into the store, it blocks until the context is done.
+func (t *Table) Run(ctx context.Context) error {
+	if !t.mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if t.mb.localDir != "" {
+		return ErrLocalMode
+	}
+
+	if t.topic.Schema == nil {
+		err := t.mb.SetSchema(t.topic)
+		if err != nil {
+			return err
+		}
+	}
+
+	client, err := sarama.NewClient(t.mb.subscriberConfig.Brokers, t.mb.subscriberConfig.OverwriteSaramaConfig)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	consumer, err := sarama.NewConsumerFromClient(client)
+	if err != nil {
+		return err
+	}
+	defer consumer.Close()
+
+	partitions, err := client.Partitions(t.topic.Name)
+	if err != nil {
+		return err
+	}
+
+	idleTimeout := tableIdleFetches * sarama.NewConfig().Consumer.MaxWaitTime
+	if config := t.mb.subscriberConfig.OverwriteSaramaConfig; config != nil {
+		idleTimeout = tableIdleFetches * config.Consumer.MaxWaitTime
+	}
+
+	targets := make(map[int32]int64, len(partitions))
+	for _, partition := range partitions {
+		oldest, err := client.GetOffset(t.topic.Name, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		newest, err := client.GetOffset(t.topic.Name, partition, sarama.OffsetNewest)
+		if err != nil {
+			return err
+		}
+
+		if newest > oldest {
+			targets[partition] = newest
+		}
+	}
+	t.start(targets)
+
+	messages := make(chan *sarama.ConsumerMessage)
+	idle := make(chan int32)
+	errs := make(chan error, len(partitions))
+	for _, partition := range partitions {
+		pc, err := consumer.ConsumePartition(t.topic.Name, partition, sarama.OffsetOldest)
+		if err != nil {
+			return err
+		}
+		defer pc.Close()
+
+		go t.consumePartition(ctx, pc, partition, idleTimeout, messages, idle, errs)
+	}
+
+	for {
+		select {
+		case msg := <-messages:
+			err := t.apply(msg)
+			if err != nil {
+				return fmt.Errorf("table %s: %w", t.topic.Name, err)
+			}
+		case partition := <-idle:
+			t.caughtUp(partition)
+		case err := <-errs:
+			return fmt.Errorf("table %s: %w", t.topic.Name, err)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// consumePartition sends the messages of a partition to the table, and the partition to idle
+// once it has been idle for idleTimeout. The idle timer starts with the first message so
+// a slow first fetch doesn't mark the partition caught up.
+func (t *Table) consumePartition(ctx context.Context, pc sarama.PartitionConsumer, partition int32, idleTimeout time.Duration, messages chan<- *sarama.ConsumerMessage, idle chan<- int32, errs chan<- error) {
+	idleTimer := time.NewTimer(idleTimeout)
+	idleTimer.Stop()
+	defer idleTimer.Stop()
+
+	// idleC is nil, and never fires, until the first message.
+	var idleC <-chan time.Time
+	for {
+		select {
+		case msg, ok := <-pc.Messages():
+			if !ok {
+				return
+			}
+			select {
+			case messages <- msg:
+			case <-ctx.Done():
+				return
+			}
+			idleTimer.Reset(idleTimeout)
+			idleC = idleTimer.C
+		case <-idleC:
+			select {
+			case idle <- partition:
+			case <-ctx.Done():
+				return
+			}
+		case err, ok := <-pc.Errors():
+			if ok {
+				errs <- err
+			}
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// start sets the offsets to reach, the table is ready right away for empty topics.
+func (t *Table) start(targets map[int32]int64) {
+	t.pendingMu.Lock()
+	t.pending = targets
+	t.pendingMu.Unlock()
+
+	if len(targets) == 0 {
+		t.readyOnce.Do(func() { close(t.ready) })
+	}
+}
+
+// apply writes a message into the store, null payloads delete the key.
+func (t *Table) apply(msg *sarama.ConsumerMessage) error {
+	err := t.storeValue(msg)
+	if err != nil {
+		return err
+	}
+
+	t.pendingMu.Lock()
+	target, ok := t.pending[msg.Partition]
+	t.pendingMu.Unlock()
+
+	if ok && msg.Offset+1 >= target {
+		t.caughtUp(msg.Partition)
+	}
+
+	return nil
+}
+
+// storeValue writes the value of a message, once it's gone through the middlewares, into the store.
+func (t *Table) storeValue(msg *sarama.ConsumerMessage) error {
+	key := string(msg.Key)
+	if msg.Value == nil {
+		return t.store.Delete(key)
+	}
+
+	watermillMsg, err := keyMarshaler{}.Unmarshal(msg)
+	if err != nil {
+		return err
+	}
+
+	prepared, err := t.prepare(watermillMsg)
+	if errors.Is(err, ErrPermanent) {
+		t.mb.logger.Error("Permanent error, dropping table value", err, watermill.LogFields{
+			"topic":     t.topic.Name,
+			"partition": msg.Partition,
+			"offset":    msg.Offset,
+		})
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return t.store.Put(key, prepared[0].Payload)
+}
+
+// caughtUp marks a partition as caught up, the table is ready once every partition is.
+func (t *Table) caughtUp(partition int32) {
+	t.pendingMu.Lock()
+	defer t.pendingMu.Unlock()
+
+	_, ok := t.pending[partition]
+	if !ok {
+		return
+	}
+
+	delete(t.pending, partition)
+	if len(t.pending) == 0 {
+		t.readyOnce.Do(func() { close(t.ready) })
+	}
+}
+
+// Get decodes the payload of a key into v, it returns false when the key doesn't exist.
+func (t *Table) Get(key string, v interface{}) (bool, error) {
+	payload, ok, err := t.store.Get(key)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	return true, DecodePayload(t.topic, payload, v)
+}
+
+// Range calls fn with the payload of every key in order until it returns false.
+func (t *Table) Range(fn func(key string, payload message.Payload) bool) error {
+	return t.store.Range(func(key string, payload []byte) bool {
+		return fn(key, payload)
+	})
+}
+
+// Snapshot returns a copy of the payloads by key.
+func (t *Table) Snapshot() (map[string]message.Payload, error) {
+	snapshot := make(map[string]message.Payload)
+	err := t.store.Range(func(key string, payload []byte) bool {
+		snapshot[key] = append(message.Payload{}, payload...)
+		return true
+	})
+
+	return snapshot, err
+}
+
+// MemoryTableStore keeps the table in memory.
+type MemoryTableStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+func NewMemoryTableStore() *MemoryTableStore {
+	return &MemoryTableStore{data: make(map[string][]byte)}
+}
+
+func (s *MemoryTableStore) Put(key string, payload []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data[key] = payload
+	return nil
+}
+
+func (s *MemoryTableStore) Delete(key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.data, key)
+	return nil
+}
+
+func (s *MemoryTableStore) Get(key string) ([]byte, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	payload, ok := s.data[key]
+	return payload, ok, nil
+}
+
+func (s *MemoryTableStore) Range(fn func(key string, payload []byte) bool) error {
+	s.mu.RLock()
+	keys := make([]string, 0, len(s.data))
+	for key := range s.data {
+		keys = append(keys, key)
+	}
+	s.mu.RUnlock()
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		payload, ok, _ := s.Get(key)
+		if ok && !fn(key, payload) {
+			break
+		}
+	}
+
+	return nil
+}
+
+// SQLiteTableStore keeps the table in a sqlite database created with
+// database.CreateSqliteConnection. The table is emptied when it's created
+// because the topic is read again from the beginning.
+//
+// The payloads are written decrypted, the database of a topic with EncryptedFields
+// should be in memory or encrypted at rest.
+type SQLiteTableStore struct {
+	db    *sqlx.DB
+	table string
+}
+
+func NewSQLiteTableStore(ctx context.Context, db *sqlx.DB, table string) (*SQLiteTableStore, error) {
+	if !tableNamePattern.MatchString(table) {
+		return nil, errTableName
+	}
+
+	_, err := db.ExecContext(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (key TEXT PRIMARY KEY, payload BLOB NOT NULL)", table))
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = db.ExecContext(ctx, fmt.Sprintf("DELETE FROM %s", table))
+	if err != nil {
+		return nil, err
+	}
+
+	return &SQLiteTableStore{db: db, table: table}, nil
+}
+
+func (s *SQLiteTableStore) Put(key string, payload []byte) error {
+	_, err := s.db.Exec(fmt.Sprintf(
+		"INSERT INTO %s (key, payload) VALUES (?, ?) ON CONFLICT(key) DO UPDATE SET payload = excluded.payload",
+		s.table,
+	), key, payload)
+	return err
+}
+
+func (s *SQLiteTableStore) Delete(key string) error {
+	_, err := s.db.Exec(fmt.Sprintf("DELETE FROM %s WHERE key = ?", s.table), key)
+	return err
+}
+
+func (s *SQLiteTableStore) Get(key string) ([]byte, bool, error) {
+	var payload []byte
+	err := s.db.Get(&payload, fmt.Sprintf("SELECT payload FROM %s WHERE key = ?", s.table), key)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	return payload, true, nil
+}
+
+func (s *SQLiteTableStore) Range(fn func(key string, payload []byte) bool) error {
+	rows, err := s.db.Query(fmt.Sprintf("SELECT key, payload FROM %s ORDER BY key", s.table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var key string
+		var payload []byte
+		err := rows.Scan(&key, &payload)
+		if err != nil {
+			return err
+		}
+
+		if !fn(key, payload) {
+			break
+		}
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,276 @@
+package kafkalistener
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+	"github.com/jmoiron/sqlx"
+)
+
+func TestTable(t *testing.T) {
+	db, err := sqlx.Connect("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	sqlStore, err := NewSQLiteTableStore(context.Background(), db, "table_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testcases := []struct {
+		Name  string
+		Store TableStore
+	}{
+		{Name: "Memory store", Store: NewMemoryTableStore()},
+		{Name: "SQLite store", Store: sqlStore},
+	}
+
+	for _, tc := range testcases {
+		table := (&MessageBroker{}).NewTable(&Topic{Name: "customers"}, tc.Store)
+		table.start(map[int32]int64{0: 3, 1: 1})
+
+		messages := []*sarama.ConsumerMessage{
+			{Partition: 0, Offset: 0, Key: []byte("b"), Value: []byte("b1")},
+			{Partition: 1, Offset: 0, Key: []byte("a"), Value: []byte("a1")},
+			{Partition: 0, Offset: 1, Key: []byte("c"), Value: []byte("c1")},
+			{Partition: 0, Offset: 2, Key: []byte("c"), Value: nil},
+		}
+
+		for i, msg := range messages {
+			select {
+			case <-table.Ready():
+				t.Errorf("%s: table ready before message %d", tc.Name, i)
+			default:
+			}
+
+			err := table.apply(msg)
+			if err != nil {
+				t.Fatalf("%s: %v", tc.Name, err)
+			}
+		}
+
+		select {
+		case <-table.Ready():
+		default:
+			t.Errorf("%s: table not ready after catching up", tc.Name)
+		}
+
+		err = table.apply(&sarama.ConsumerMessage{Partition: 0, Offset: 3, Key: []byte("b"), Value: []byte("b2")})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+
+		snapshot, err := table.Snapshot()
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+		expected := map[string]string{"a": "a1", "b": "b2"}
+		if len(snapshot) != len(expected) {
+			t.Errorf("%s: keys = %d, expected %d", tc.Name, len(snapshot), len(expected))
+		}
+		for key, value := range expected {
+			if string(snapshot[key]) != value {
+				t.Errorf("%s: value of %s = %s, expected %s", tc.Name, key, snapshot[key], value)
+			}
+		}
+
+		var keys []string
+		err = table.Range(func(key string, payload message.Payload) bool {
+			keys = append(keys, key)
+			return false
+		})
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+		if len(keys) != 1 || keys[0] != "a" {
+			t.Errorf("%s: range keys = %v, expected [a]", tc.Name, keys)
+		}
+	}
+}
+
+// TestTableCaughtUpWhenIdle checks a partition ending with a transaction marker,
+// whose offset is never delivered, is caught up once it's idle.
+func TestTableCaughtUpWhenIdle(t *testing.T) {
+	table := (&MessageBroker{}).NewTable(&Topic{Name: "customers"}, NewMemoryTableStore())
+	// The record at offset 1 is the commit marker of the transaction.
+	table.start(map[int32]int64{0: 2, 1: 1})
+
+	err := table.apply(&sarama.ConsumerMessage{Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("a1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	table.caughtUp(0)
+
+	select {
+	case <-table.Ready():
+		t.Error("table ready with a partition behind")
+	default:
+	}
+
+	err = table.apply(&sarama.ConsumerMessage{Partition: 1, Offset: 0, Key: []byte("b"), Value: []byte("b1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-table.Ready():
+	default:
+		t.Error("table not ready after the idle partition")
+	}
+}
+
+// testPartitionConsumer delivers the messages sent to its channel.
+type testPartitionConsumer struct {
+	sarama.PartitionConsumer
+	messages chan *sarama.ConsumerMessage
+	errors   chan *sarama.ConsumerError
+}
+
+func (pc *testPartitionConsumer) Messages() <-chan *sarama.ConsumerMessage { return pc.messages }
+func (pc *testPartitionConsumer) Errors() <-chan *sarama.ConsumerError     { return pc.errors }
+
+// TestTableSlowFirstFetch checks a partition isn't idle before its first fetch returns.
+func TestTableSlowFirstFetch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pc := &testPartitionConsumer{messages: make(chan *sarama.ConsumerMessage), errors: make(chan *sarama.ConsumerError)}
+	messages := make(chan *sarama.ConsumerMessage)
+	idle := make(chan int32)
+	idleTimeout := 10 * time.Millisecond
+
+	table := (&MessageBroker{}).NewTable(&Topic{Name: "customers"}, NewMemoryTableStore())
+	go table.consumePartition(ctx, pc, 0, idleTimeout, messages, idle, make(chan error, 1))
+
+	// The first fetch takes longer than the idle timeout.
+	select {
+	case <-idle:
+		t.Fatal("partition idle before the first fetch")
+	case <-time.After(10 * idleTimeout):
+	}
+
+	pc.messages <- &sarama.ConsumerMessage{Partition: 0, Offset: 0, Key: []byte("a"), Value: []byte("a1")}
+	<-messages
+
+	select {
+	case partition := <-idle:
+		if partition != 0 {
+			t.Errorf("partition = %d, expected 0", partition)
+		}
+	case <-time.After(time.Second):
+		t.Error("partition not idle after its last message")
+	}
+}
+
+func TestTableValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keyring.json")
+	err := os.WriteFile(path, []byte(`{"current": "k1", "keys": {"k1": "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="}}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyring, err := NewFileKeyring(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	blobStore, err := NewFileBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := &Topic{
+		Name:            "customers",
+		Schema:          avro.MustParse(`{"type": "record", "name": "Customer", "fields": [{"name": "email", "type": "string"}]}`),
+		EncryptedFields: []string{"email"},
+	}
+
+	mb := &MessageBroker{}
+	mb.SetKeyProvider(keyring)
+	mb.SetClaimCheck(blobStore, 16)
+
+	data, err := avro.Marshal(topic.Schema, map[string]interface{}{"email": "ana.maria@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The value is encrypted and then, being oversized, stored in the blob store.
+	msg := message.NewMessage("uuid", append([]byte{0, 0, 0, 0, 1}, data...))
+	err = mb.encryptMessage(topic, msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = mb.claimCheck(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var headers []*sarama.RecordHeader
+	for key, value := range msg.Metadata {
+		headers = append(headers, &sarama.RecordHeader{Key: []byte(key), Value: []byte(value)})
+	}
+
+	table := mb.NewTable(topic, NewMemoryTableStore())
+	table.start(map[int32]int64{0: 1})
+
+	err = table.apply(&sarama.ConsumerMessage{Partition: 0, Offset: 0, Key: []byte("a"), Value: msg.Payload, Headers: headers})
+	if err != nil {
+		t.Fatalf("apply error = %v", err)
+	}
+
+	var customer struct {
+		Email string `avro:"email"`
+	}
+	ok, err := table.Get("a", &customer)
+	if err != nil || !ok {
+		t.Fatalf("get = %v, error = %v", ok, err)
+	}
+	if customer.Email != "ana.maria@example.com" {
+		t.Errorf("email = %s, expected ana.maria@example.com", customer.Email)
+	}
+}
+
+func TestKeyMarshaler(t *testing.T) {
+	testcases := []struct {
+		Name        string
+		Key         string
+		Payload     []byte
+		ExpectedKey bool
+		ExpectNull  bool
+	}{
+		{Name: "Without key", Payload: []byte("data")},
+		{Name: "With key", Key: "42", Payload: []byte("data"), ExpectedKey: true},
+		{Name: "Tombstone", Key: "42", ExpectedKey: true, ExpectNull: true},
+	}
+
+	for _, tc := range testcases {
+		msg := message.NewMessage("uuid", tc.Payload)
+		if tc.Key != "" {
+			msg.Metadata.Set(PartitionKeyKey, tc.Key)
+		}
+
+		kafkaMsg, err := keyMarshaler{}.Marshal("topic", msg)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.Name, err)
+		}
+
+		if (kafkaMsg.Key != nil) != tc.ExpectedKey {
+			t.Errorf("%s: key = %v, expected key %v", tc.Name, kafkaMsg.Key, tc.ExpectedKey)
+		}
+		if (kafkaMsg.Value == nil) != tc.ExpectNull {
+			t.Errorf("%s: value = %v, expected null %v", tc.Name, kafkaMsg.Value, tc.ExpectNull)
+		}
+		for _, h := range kafkaMsg.Headers {
+			if string(h.Key) == PartitionKeyKey {
+				t.Errorf("%s: key sent as header", tc.Name)
+			}
+		}
+	}
+}
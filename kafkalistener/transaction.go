@@ -0,0 +1,130 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"log"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill-kafka/v3/pkg/kafka"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+var ErrTransactionsNotEnabled error = errors.New("message broker has no transactional id configured")
+var ErrNoConsumerGroup error = errors.New("message broker has no consumer group configured")
+var ErrNotTransactional error = errors.New("handler doesn't use the transactional commit mode, the offset would be committed outside the transaction too")
+
+var errMissingOffset = errors.New("message has no kafka partition or offset")
+
+// Tx is an open kafka transaction, it's only valid inside the PublishTx callback.
+type Tx struct {
+	ctx      context.Context
+	mb       *MessageBroker
+	producer sarama.SyncProducer
+}
+
+// PublishTx runs fn inside a kafka transaction.
+//
+// Every message published and every offset marked through the Tx is committed
+// atomically when fn returns nil, otherwise the transaction is aborted.
+// Consumers only ignore aborted messages when they're set as ReadCommitted.
+func (mb *MessageBroker) PublishTx(ctx context.Context, fn func(tx *Tx) error) error {
+	if !mb.enabled {
+		return ErrBrokerNotEnabled
+	}
+
+	if mb.txProducer == nil {
+		return ErrTransactionsNotEnabled
+	}
+
+	// The producer can only hold one open transaction at a time.
+	mb.txLock.Lock()
+	defer mb.txLock.Unlock()
+
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	err := mb.txProducer.BeginTxn()
+	if err != nil {
+		return err
+	}
+
+	err = fn(&Tx{ctx: ctx, mb: mb, producer: mb.txProducer})
+	if err == nil {
+		err = ctx.Err()
+	}
+	if err != nil {
+		mb.abortTx()
+		return err
+	}
+
+	err = mb.txProducer.CommitTxn()
+	if err != nil && mb.txProducer.TxnStatus()&sarama.ProducerTxnFlagAbortableError != 0 {
+		mb.abortTx()
+	}
+
+	return err
+}
+
+func (mb *MessageBroker) abortTx() {
+	err := mb.txProducer.AbortTxn()
+	if err != nil {
+		log.Println("Error aborting transaction: ", err)
+	}
+}
+
+// Publish adds a message to the transaction, with the correlation id and trace of the context of PublishTx.
+func (tx *Tx) Publish(topic *Topic, data interface{}) error {
+	msg, err := tx.mb.newMessage(tx.ctx, topic, data)
+	if err != nil {
+		return err
+	}
+
+	return tx.mb.publishChain(tx.send)(topic, msg)
+}
+
+func (tx *Tx) send(topic *Topic, msg *message.Message) error {
+	kafkaMsg, err := keyMarshaler{}.Marshal(topic.Name, msg)
+	if err != nil {
+		return err
+	}
+
+	_, _, err = tx.producer.SendMessage(kafkaMsg)
+	return err
+}
+
+// MarkConsumed commits the offset of a consumed message as part of the transaction,
+// this is what makes consume-transform-produce flows exactly-once.
+//
+// The handler of the message must use CommitTransactional, so acking the message doesn't commit its offset again.
+func (tx *Tx) MarkConsumed(topic *Topic, msg *message.Message) error {
+	if tx.mb.consumerGroup == "" {
+		return ErrNoConsumerGroup
+	}
+
+	if tx.mb.commitPolicy(message.HandlerNameFromCtx(msg.Context())).Mode != CommitTransactional {
+		return ErrNotTransactional
+	}
+
+	partition, ok := kafka.MessagePartitionFromCtx(msg.Context())
+	if !ok {
+		return errMissingOffset
+	}
+
+	offset, ok := kafka.MessagePartitionOffsetFromCtx(msg.Context())
+	if !ok {
+		return errMissingOffset
+	}
+
+	return tx.markOffset(topic.Name, partition, offset)
+}
+
+// markOffset adds the offset after the consumed one to the transaction.
+func (tx *Tx) markOffset(topic string, partition int32, offset int64) error {
+	offsets := map[string][]*sarama.PartitionOffsetMetadata{
+		topic: {{Partition: partition, Offset: offset + 1}},
+	}
+
+	return tx.producer.AddOffsetsToTxn(offsets, tx.mb.consumerGroup)
+}
@@ -0,0 +1,177 @@
+package kafkalistener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/IBM/sarama"
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+// testTxProducer records the calls of the transactions.
+type testTxProducer struct {
+	sarama.SyncProducer
+	calls     []string
+	commitErr error
+	status    sarama.ProducerTxnStatusFlag
+}
+
+func (p *testTxProducer) BeginTxn() error {
+	p.calls = append(p.calls, "begin")
+	return nil
+}
+
+func (p *testTxProducer) CommitTxn() error {
+	p.calls = append(p.calls, "commit")
+	return p.commitErr
+}
+
+func (p *testTxProducer) AbortTxn() error {
+	p.calls = append(p.calls, "abort")
+	return nil
+}
+
+func (p *testTxProducer) TxnStatus() sarama.ProducerTxnStatusFlag {
+	return p.status
+}
+
+func (p *testTxProducer) SendMessage(msg *sarama.ProducerMessage) (int32, int64, error) {
+	p.calls = append(p.calls, "send "+msg.Topic)
+	return 0, 0, nil
+}
+
+func (p *testTxProducer) AddOffsetsToTxn(offsets map[string][]*sarama.PartitionOffsetMetadata, groupID string) error {
+	for topic, partitions := range offsets {
+		for _, partition := range partitions {
+			p.calls = append(p.calls, fmt.Sprintf("offset %s %s/%d %d", groupID, topic, partition.Partition, partition.Offset))
+		}
+	}
+	return nil
+}
+
+func TestPublishTx(t *testing.T) {
+	errCharge := errors.New("charge failed")
+	errCommit := errors.New("commit failed")
+
+	charges := &Topic{
+		Name:      "charges",
+		RawSchema: `{"type":"record","name":"Charge","fields":[{"name":"id","type":"string"}]}`,
+	}
+	charges.Schema = avro.MustParse(charges.RawSchema)
+	invoices := &Topic{Name: "invoices"}
+
+	testcases := []struct {
+		Name string
+		// Fn is the callback of the transaction, cancel cancels its context.
+		Fn            func(tx *Tx, cancel context.CancelFunc) error
+		CommitErr     error
+		Status        sarama.ProducerTxnStatusFlag
+		ExpectedCalls []string
+		ExpectedError error
+	}{
+		{
+			Name: "Commits the messages and the offset",
+			Fn: func(tx *Tx, cancel context.CancelFunc) error {
+				err := tx.Publish(charges, map[string]interface{}{"id": "1"})
+				if err != nil {
+					return err
+				}
+				return tx.markOffset(invoices.Name, 2, 7)
+			},
+			ExpectedCalls: []string{"begin", "send charges", "offset billing invoices/2 8", "commit"},
+		},
+		{
+			Name: "Aborts when the callback fails",
+			Fn: func(tx *Tx, cancel context.CancelFunc) error {
+				err := tx.Publish(charges, map[string]interface{}{"id": "1"})
+				if err != nil {
+					return err
+				}
+				return errCharge
+			},
+			ExpectedCalls: []string{"begin", "send charges", "abort"},
+			ExpectedError: errCharge,
+		},
+		{
+			Name: "Aborts when the context is canceled",
+			Fn: func(tx *Tx, cancel context.CancelFunc) error {
+				cancel()
+				return nil
+			},
+			ExpectedCalls: []string{"begin", "abort"},
+			ExpectedError: context.Canceled,
+		},
+		{
+			Name:          "Aborts after an abortable commit error",
+			Fn:            func(tx *Tx, cancel context.CancelFunc) error { return nil },
+			CommitErr:     errCommit,
+			Status:        sarama.ProducerTxnFlagInError | sarama.ProducerTxnFlagAbortableError,
+			ExpectedCalls: []string{"begin", "commit", "abort"},
+			ExpectedError: errCommit,
+		},
+		{
+			Name:          "Doesn't abort after a fatal commit error",
+			Fn:            func(tx *Tx, cancel context.CancelFunc) error { return nil },
+			CommitErr:     errCommit,
+			Status:        sarama.ProducerTxnFlagInError | sarama.ProducerTxnFlagFatalError,
+			ExpectedCalls: []string{"begin", "commit"},
+			ExpectedError: errCommit,
+		},
+	}
+
+	for _, tc := range testcases {
+		producer := &testTxProducer{commitErr: tc.CommitErr, status: tc.Status}
+		mb := &MessageBroker{enabled: true, localDir: t.TempDir(), consumerGroup: "billing", txProducer: producer}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		err := mb.PublishTx(ctx, func(tx *Tx) error { return tc.Fn(tx, cancel) })
+		cancel()
+
+		if !errors.Is(err, tc.ExpectedError) {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+		if fmt.Sprint(producer.calls) != fmt.Sprint(tc.ExpectedCalls) {
+			t.Errorf("%s: calls = %v, expected %v", tc.Name, producer.calls, tc.ExpectedCalls)
+		}
+	}
+}
+
+func TestMarkConsumed(t *testing.T) {
+	testcases := []struct {
+		Name          string
+		Broker        *MessageBroker
+		ExpectedError error
+	}{
+		{
+			Name:          "Without consumer group",
+			Broker:        &MessageBroker{commit: CommitPolicy{Mode: CommitTransactional}},
+			ExpectedError: ErrNoConsumerGroup,
+		},
+		{
+			Name:          "Handler committing the acks",
+			Broker:        &MessageBroker{consumerGroup: "billing"},
+			ExpectedError: ErrNotTransactional,
+		},
+		{
+			Name:          "Message without offset",
+			Broker:        &MessageBroker{consumerGroup: "billing", commit: CommitPolicy{Mode: CommitTransactional}},
+			ExpectedError: errMissingOffset,
+		},
+	}
+
+	for _, tc := range testcases {
+		producer := &testTxProducer{}
+		tx := &Tx{ctx: context.Background(), mb: tc.Broker, producer: producer}
+
+		err := tx.MarkConsumed(&Topic{Name: "invoices"}, message.NewMessage("uuid", nil))
+		if err != tc.ExpectedError {
+			t.Errorf("%s: error = %v, expected %v", tc.Name, err, tc.ExpectedError)
+		}
+		if len(producer.calls) != 0 {
+			t.Errorf("%s: calls = %v, expected none", tc.Name, producer.calls)
+		}
+	}
+}
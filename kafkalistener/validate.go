@@ -0,0 +1,217 @@
+package kafkalistener
+
+import (
+	"errors"
+	"fmt"
+	"math/big"
+	"regexp"
+	"strings"
+
+	"github.com/ThreeDotsLabs/watermill"
+	"github.com/ThreeDotsLabs/watermill/message"
+)
+
+// ErrPermanent marks the errors that fail the same way on every retry, the route handlers
+// ack them right away, with or without Retry. Wrap it to make a handler error permanent.
+var ErrPermanent error = errors.New("permanent error, the message won't be retried")
+
+// FieldRule is a business constraint on a field of the topic records.
+type FieldRule struct {
+	// Field is the name of the field, nested fields are separated by dots.
+	Field string
+	// Required rejects missing and null values.
+	Required bool
+	// OneOf is the whitelist of values.
+	OneOf []string
+	// Pattern has to match string values.
+	Pattern *regexp.Regexp
+	// Min and Max are the range of numeric values.
+	Min *float64
+	Max *float64
+}
+
+// Violation is a field that broke one of the rules.
+type Violation struct {
+	Field   string
+	Rule    string
+	Message string
+}
+
+// ValidationError has the violations of a record,
+// it's permanent so the message isn't retried.
+type ValidationError struct {
+	Topic      string
+	Violations []Violation
+}
+
+func (e *ValidationError) Error() string {
+	violations := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		violations[i] = v.Field + " " + v.Message
+	}
+
+	return fmt.Sprintf("invalid record for topic %s: %s", e.Topic, strings.Join(violations, "; "))
+}
+
+func (e *ValidationError) Unwrap() error {
+	return ErrPermanent
+}
+
+// Validate checks a decoded record against the rules of the topic.
+func Validate(topic *Topic, record map[string]interface{}) error {
+	var violations []Violation
+	for _, rule := range topic.Rules {
+		violations = append(violations, rule.check(record)...)
+	}
+
+	if len(violations) == 0 {
+		return nil
+	}
+
+	return &ValidationError{Topic: topic.Name, Violations: violations}
+}
+
+// permanentMiddleware acks the messages failing with a permanent error instead of redelivering them,
+// so they don't block the partition. It's the first middleware of the route handlers.
+func permanentMiddleware(handler string, logger watermill.LoggerAdapter) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			produced, err := h(msg)
+			if !errors.Is(err, ErrPermanent) {
+				return produced, err
+			}
+
+			if logger != nil {
+				logger.Error("Permanent error, dropping message", err, watermill.LogFields{
+					"handler": handler,
+					"uuid":    msg.UUID,
+				})
+			}
+			return nil, nil
+		}
+	}
+}
+
+// ValidationMiddleware rejects the consumed messages that break the rules of the topic.
+//
+// It's added to the handlers of topics with rules, after the router middlewares like Retry.
+func ValidationMiddleware(topic *Topic) message.HandlerMiddleware {
+	return func(h message.HandlerFunc) message.HandlerFunc {
+		return func(msg *message.Message) ([]*message.Message, error) {
+			record, err := DecodeMap(topic, msg.Payload)
+			if err != nil {
+				// Decoding errors are left to the handler.
+				return h(msg)
+			}
+
+			err = Validate(topic, record)
+			if err != nil {
+				return nil, err
+			}
+
+			return h(msg)
+		}
+	}
+}
+
+// validatePayload checks the avro body of a message before it's published.
+func validatePayload(topic *Topic, data []byte) error {
+	if len(topic.Rules) == 0 {
+		return nil
+	}
+
+	record, err := decodeMap(topic, data)
+	if err != nil {
+		return err
+	}
+
+	return Validate(topic, record)
+}
+
+func (rule FieldRule) check(record map[string]interface{}) []Violation {
+	value := fieldValue(record, rule.Field)
+	if value == nil {
+		if rule.Required {
+			return []Violation{{Field: rule.Field, Rule: "required", Message: "is required"}}
+		}
+		return nil
+	}
+
+	var violations []Violation
+	if len(rule.OneOf) > 0 && !oneOf(fmt.Sprint(value), rule.OneOf) {
+		violations = append(violations, Violation{
+			Field:   rule.Field,
+			Rule:    "one_of",
+			Message: fmt.Sprintf("%v is not one of %s", value, strings.Join(rule.OneOf, ", ")),
+		})
+	}
+
+	if rule.Pattern != nil {
+		str, ok := value.(string)
+		if !ok || !rule.Pattern.MatchString(str) {
+			violations = append(violations, Violation{
+				Field:   rule.Field,
+				Rule:    "pattern",
+				Message: fmt.Sprintf("%v does not match %s", value, rule.Pattern),
+			})
+		}
+	}
+
+	if rule.Min != nil || rule.Max != nil {
+		n, ok := number(value)
+		switch {
+		case !ok:
+			violations = append(violations, Violation{Field: rule.Field, Rule: "range", Message: fmt.Sprintf("%v is not a number", value)})
+		case rule.Min != nil && n < *rule.Min:
+			violations = append(violations, Violation{Field: rule.Field, Rule: "range", Message: fmt.Sprintf("%v is lower than %v", value, *rule.Min)})
+		case rule.Max != nil && n > *rule.Max:
+			violations = append(violations, Violation{Field: rule.Field, Rule: "range", Message: fmt.Sprintf("%v is greater than %v", value, *rule.Max)})
+		}
+	}
+
+	return violations
+}
+
+// fieldValue returns the value of a dotted field path, nil when it's missing.
+func fieldValue(record map[string]interface{}, path string) interface{} {
+	var value interface{} = record
+	for _, field := range strings.Split(path, ".") {
+		obj, ok := value.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		value = obj[field]
+	}
+
+	return value
+}
+
+func oneOf(value string, values []string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func number(value interface{}) (float64, bool) {
+	switch n := value.(type) {
+	case int:
+		return float64(n), true
+	case int32:
+		return float64(n), true
+	case int64:
+		return float64(n), true
+	case float32:
+		return float64(n), true
+	case float64:
+		return n, true
+	case *big.Rat:
+		f, _ := n.Float64()
+		return f, true
+	}
+
+	return 0, false
+}
@@ -0,0 +1,114 @@
+package kafkalistener
+
+import (
+	"errors"
+	"regexp"
+	"testing"
+
+	"github.com/ThreeDotsLabs/watermill/message"
+	"github.com/hamba/avro"
+)
+
+func TestValidate(t *testing.T) {
+	min, max := 1.0, 30.0
+	topic := &Topic{
+		Name: "reservations",
+		Rules: []FieldRule{
+			{Field: "guest", Required: true},
+			{Field: "tier", OneOf: []string{"SILVER", "GOLD"}},
+			{Field: "email", Pattern: regexp.MustCompile(`^[^@]+@[^@]+$`)},
+			{Field: "stay.nights", Min: &min, Max: &max},
+		},
+	}
+
+	testcases := []struct {
+		Name               string
+		Record             map[string]interface{}
+		ExpectedViolations []string
+	}{
+		{
+			Name:   "Valid record",
+			Record: map[string]interface{}{"guest": "ana", "tier": "GOLD", "email": "ana@test.com", "stay": map[string]interface{}{"nights": int32(3)}},
+		},
+		{
+			Name:               "Missing required and optional fields",
+			Record:             map[string]interface{}{"guest": nil},
+			ExpectedViolations: []string{"required"},
+		},
+		{
+			Name:               "Every rule broken",
+			Record:             map[string]interface{}{"tier": "BRONZE", "email": "ana", "stay": map[string]interface{}{"nights": int64(31)}},
+			ExpectedViolations: []string{"required", "one_of", "pattern", "range"},
+		},
+		{
+			Name:               "Not a number",
+			Record:             map[string]interface{}{"guest": "ana", "stay": map[string]interface{}{"nights": "three"}},
+			ExpectedViolations: []string{"range"},
+		},
+	}
+
+	for _, tc := range testcases {
+		err := Validate(topic, tc.Record)
+		if len(tc.ExpectedViolations) == 0 {
+			if err != nil {
+				t.Errorf("%s: error = %v", tc.Name, err)
+			}
+			continue
+		}
+
+		var validationErr *ValidationError
+		if !errors.As(err, &validationErr) || !errors.Is(err, ErrPermanent) {
+			t.Errorf("%s: error = %v, expected a permanent validation error", tc.Name, err)
+			continue
+		}
+
+		if len(validationErr.Violations) != len(tc.ExpectedViolations) {
+			t.Errorf("%s: violations = %v", tc.Name, validationErr.Violations)
+			continue
+		}
+		for i, v := range validationErr.Violations {
+			if v.Rule != tc.ExpectedViolations[i] {
+				t.Errorf("%s: rule = %s, expected %s", tc.Name, v.Rule, tc.ExpectedViolations[i])
+			}
+		}
+	}
+}
+
+func TestValidationMiddleware(t *testing.T) {
+	topic := &Topic{
+		Name:   "reservations",
+		Schema: avro.MustParse(`{"type": "record", "name": "Reservation", "fields": [{"name": "guest", "type": ["null", "string"]}]}`),
+		Rules:  []FieldRule{{Field: "guest", Required: true}},
+	}
+
+	calls := 0
+	handler := func(msg *message.Message) ([]*message.Message, error) {
+		calls++
+		return nil, nil
+	}
+
+	// The validation error is permanent, Retry acks it without retrying.
+	retry := Retry{MaxRetries: 3, AckAfterMaxRetries: true}
+	h := retry.Middleware(ValidationMiddleware(topic)(handler))
+
+	for _, guest := range []interface{}{nil, map[string]interface{}{"string": "ana"}} {
+		data, err := avro.Marshal(topic.Schema, map[string]interface{}{"guest": guest})
+		if err != nil {
+			t.Fatalf("error = %v", err)
+		}
+
+		_, err = h(message.NewMessage("1", append([]byte{0, 0, 0, 0, 1}, data...)))
+		if err != nil {
+			t.Errorf("guest %v: error = %v", guest, err)
+		}
+	}
+
+	if calls != 1 {
+		t.Errorf("handler calls = %d, expected 1", calls)
+	}
+
+	err := validatePayload(topic, []byte{0})
+	if !errors.Is(err, ErrPermanent) {
+		t.Errorf("publish error = %v, expected %v", err, ErrPermanent)
+	}
+}